@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// known scopes, they are orthogonal: none of them implies another.
+const (
+	scopeSettingsRead  = "settings:read"
+	scopeSettingsWrite = "settings:write"
+	scopeCatalogAdmin  = "catalog:admin"
+	scopeAuditRead     = "audit:read"
+)
+
+const (
+	hdrAPIKey        = "X-API-Key"
+	hdrClientID      = "X-Client-ID"
+	hdrTimestamp     = "X-Timestamp"
+	hdrSignature     = "X-Signature"
+	hdrNonce         = "X-Nonce"
+	hdrAuthorization = "Authorization"
+	bearerPrefix     = "Bearer "
+	maxBodySize      = 1 << 20
+	maxClockSkew     = 5 * time.Minute
+	maxNonceSize     = 128
+)
+
+var (
+	errNoCredentials  = errors.New("no credentials")
+	errBadCredentials = errors.New("bad credentials")
+	errBadSignature   = errors.New("bad signature")
+	errReplayed       = errors.New("replayed request")
+	errBadToken       = errors.New("bad token")
+	errTokenExpired   = errors.New("token expired")
+	errBodyTooLarge   = errors.New("body too large")
+)
+
+// identity describes authenticated caller.
+type identity struct {
+	Subject string
+	Scopes  []string
+}
+
+// Has reports whenever identity is granted with `scope`.
+func (id *identity) Has(scope string) bool {
+	for _, s := range id.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// authenticator checks request credentials, it returns errNoCredentials
+// if request carries none of kind it can handle.
+type authenticator interface {
+	Authenticate(r *http.Request) (*identity, error)
+}
+
+// guard wraps apiHandler with access checks.
+type guard func(next apiHandler) apiHandler
+
+// allowAll is a guard that allows everything.
+func allowAll(next apiHandler) apiHandler {
+	return next
+}
+
+// authChain tries authenticators one by one, until one of them finds its credentials.
+type authChain []authenticator
+
+func (ac authChain) Authenticate(r *http.Request) (*identity, error) {
+	for _, a := range ac {
+		id, err := a.Authenticate(r)
+		if errors.Is(err, errNoCredentials) {
+			continue
+		}
+
+		return id, err
+	}
+
+	return nil, errNoCredentials
+}
+
+// newAuth builds authenticator from config, returns nil if none configured.
+func newAuth(cfg *authConfig) authenticator {
+	var chain authChain
+
+	if len(cfg.APIKeys) > 0 {
+		keys := make(apiKeyAuth, len(cfg.APIKeys))
+
+		for _, k := range cfg.APIKeys {
+			keys[k.Key] = &identity{Subject: k.Subject, Scopes: k.Scopes}
+		}
+
+		chain = append(chain, keys)
+	}
+
+	if len(cfg.HMAC) > 0 {
+		ha := newHMACAuth()
+
+		for _, c := range cfg.HMAC {
+			ha.clients[c.ClientID] = hmacClient{
+				secret: []byte(c.Secret),
+				id:     &identity{Subject: c.ClientID, Scopes: c.Scopes},
+			}
+		}
+
+		chain = append(chain, ha)
+	}
+
+	if cfg.JWT.Secret != "" {
+		chain = append(chain, &jwtAuth{
+			secret:   []byte(cfg.JWT.Secret),
+			issuer:   cfg.JWT.Issuer,
+			audience: cfg.JWT.Audience,
+		})
+	}
+
+	if len(chain) == 0 {
+		return nil
+	}
+
+	return chain
+}
+
+// require builds guard, that passes only callers granted with `scope`,
+// caller identity is recorded to request info, nil authenticator allows everyone.
+func require(a authenticator, scope string) guard {
+	if a == nil {
+		return allowAll
+	}
+
+	return func(next apiHandler) apiHandler {
+		return func(w io.Writer, r *http.Request) int {
+			ctx := r.Context()
+
+			id, err := a.Authenticate(r)
+			if err != nil {
+				slog.WarnContext(ctx, "authentication", "err", err)
+
+				if errors.Is(err, errBodyTooLarge) {
+					return http.StatusRequestEntityTooLarge
+				}
+
+				return http.StatusUnauthorized
+			}
+
+			setActor(ctx, id.Subject)
+
+			if !id.Has(scope) {
+				slog.WarnContext(ctx, "authorization", "subject", id.Subject, "scope", scope)
+
+				return http.StatusForbidden
+			}
+
+			return next(w, r)
+		}
+	}
+}
+
+// setActor records caller identity for current request (if any).
+func setActor(ctx context.Context, actor string) {
+	if ri := reqInfoFrom(ctx); ri != nil {
+		ri.Actor = actor
+	}
+}
+
+// apiKeyAuth authenticates requests by static key in `X-API-Key` header.
+type apiKeyAuth map[string]*identity
+
+func (ak apiKeyAuth) Authenticate(r *http.Request) (*identity, error) {
+	key := r.Header.Get(hdrAPIKey)
+	if key == "" {
+		return nil, errNoCredentials
+	}
+
+	id, ok := ak[key]
+	if !ok {
+		return nil, errBadCredentials
+	}
+
+	return id, nil
+}
+
+type hmacClient struct {
+	secret []byte
+	id     *identity
+}
+
+// hmacAuth authenticates requests signed with per-client shared secret,
+// see signRequest for signature details. Every signed request carries unique nonce,
+// seen ones are remembered (by this instance) for as long, as their timestamp is acceptable,
+// so captured requests can not be replayed.
+type hmacAuth struct {
+	clients map[string]hmacClient
+
+	mu    sync.Mutex
+	seen  map[string]time.Time // client id and nonce -> time, it can be forgotten at.
+	sweep time.Time
+}
+
+func newHMACAuth() *hmacAuth {
+	return &hmacAuth{
+		clients: make(map[string]hmacClient),
+		seen:    make(map[string]time.Time),
+	}
+}
+
+func (ha *hmacAuth) Authenticate(r *http.Request) (*identity, error) {
+	cid := r.Header.Get(hdrClientID)
+	if cid == "" {
+		return nil, errNoCredentials
+	}
+
+	c, ok := ha.clients[cid]
+	if !ok {
+		return nil, errBadCredentials
+	}
+
+	nonce := r.Header.Get(hdrNonce)
+	if nonce == "" || len(nonce) > maxNonceSize {
+		return nil, errBadSignature
+	}
+
+	target, err := canonicalTarget(r.URL)
+	if err != nil {
+		return nil, errBadSignature
+	}
+
+	ts, err := strconv.ParseInt(r.Header.Get(hdrTimestamp), 10, 64)
+	if err != nil {
+		return nil, errBadSignature
+	}
+
+	if skew := time.Since(time.Unix(ts, 0)); skew > maxClockSkew || skew < -maxClockSkew {
+		return nil, errBadSignature
+	}
+
+	sig, err := hex.DecodeString(r.Header.Get(hdrSignature))
+	if err != nil {
+		return nil, errBadSignature
+	}
+
+	// read one byte past the limit, to tell oversized body from the one that fits exactly.
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(body) > maxBodySize {
+		return nil, errBodyTooLarge
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	if !hmac.Equal(sig, signRequest(c.secret, r.Method, target, ts, nonce, body)) {
+		return nil, errBadSignature
+	}
+
+	if !ha.remember(cid+"\n"+nonce, time.Unix(ts, 0).Add(maxClockSkew)) {
+		return nil, errReplayed
+	}
+
+	return c.id, nil
+}
+
+// remember records nonce key until `until`, it reports false, if key is already known.
+func (ha *hmacAuth) remember(key string, until time.Time) bool {
+	now := time.Now()
+
+	ha.mu.Lock()
+	defer ha.mu.Unlock()
+
+	if now.After(ha.sweep) {
+		for k, t := range ha.seen {
+			if now.After(t) {
+				delete(ha.seen, k)
+			}
+		}
+
+		ha.sweep = now.Add(maxClockSkew)
+	}
+
+	if _, ok := ha.seen[key]; ok {
+		return false
+	}
+
+	ha.seen[key] = until
+
+	return true
+}
+
+// canonicalTarget returns request path, followed by query with parameters sorted by name
+// (if any), as it is signed by clients.
+func canonicalTarget(u *url.URL) (string, error) {
+	if u.RawQuery == "" {
+		return u.Path, nil
+	}
+
+	q, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return "", err
+	}
+
+	return u.Path + "?" + q.Encode(), nil
+}
+
+// signRequest calculates HMAC-SHA256 over method, canonical target (see canonicalTarget),
+// unix timestamp, nonce and body hash, joined by new lines.
+func signRequest(secret []byte, method, target string, ts int64, nonce string, body []byte) []byte {
+	bh := sha256.Sum256(body)
+
+	m := hmac.New(sha256.New, secret)
+	fmt.Fprintf(m, "%s\n%s\n%d\n%s\n%x", method, target, ts, nonce, bh)
+
+	return m.Sum(nil)
+}
+
+// jwtAuth authenticates requests by HS256-signed JWT in `Authorization: Bearer` header,
+// scopes are taken from space-separated `scope` claim.
+type jwtAuth struct {
+	secret   []byte
+	issuer   string
+	audience string
+}
+
+type jwtClaims struct {
+	Subject   string          `json:"sub"`
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	Scope     string          `json:"scope"`
+	ExpiresAt int64           `json:"exp"`
+	NotBefore int64           `json:"nbf"`
+}
+
+func (ja *jwtAuth) Authenticate(r *http.Request) (*identity, error) {
+	hdr := r.Header.Get(hdrAuthorization)
+	if !strings.HasPrefix(hdr, bearerPrefix) {
+		return nil, errNoCredentials
+	}
+
+	claims, err := ja.parse(strings.TrimPrefix(hdr, bearerPrefix), time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	return &identity{Subject: claims.Subject, Scopes: strings.Fields(claims.Scope)}, nil
+}
+
+func (ja *jwtAuth) parse(token string, now time.Time) (c *jwtClaims, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errBadToken
+	}
+
+	var hdr struct {
+		Alg string `json:"alg"`
+	}
+
+	if err = decodeSegment(parts[0], &hdr); err != nil || hdr.Alg != "HS256" {
+		return nil, errBadToken
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errBadToken
+	}
+
+	m := hmac.New(sha256.New, ja.secret)
+	m.Write([]byte(parts[0] + "." + parts[1]))
+
+	if !hmac.Equal(sig, m.Sum(nil)) {
+		return nil, errBadToken
+	}
+
+	c = &jwtClaims{}
+
+	if err = decodeSegment(parts[1], c); err != nil || c.Subject == "" {
+		return nil, errBadToken
+	}
+
+	if c.ExpiresAt == 0 || now.Unix() >= c.ExpiresAt || now.Unix() < c.NotBefore {
+		return nil, errTokenExpired
+	}
+
+	if ja.issuer != "" && c.Issuer != ja.issuer {
+		return nil, errBadToken
+	}
+
+	if ja.audience != "" && !c.hasAudience(ja.audience) {
+		return nil, errBadToken
+	}
+
+	return c, nil
+}
+
+// hasAudience checks `aud` claim, which can be either string or array of strings.
+func (c *jwtClaims) hasAudience(aud string) bool {
+	var one string
+
+	if json.Unmarshal(c.Audience, &one) == nil {
+		return one == aud
+	}
+
+	var many []string
+
+	if json.Unmarshal(c.Audience, &many) != nil {
+		return false
+	}
+
+	for _, a := range many {
+		if a == aud {
+			return true
+		}
+	}
+
+	return false
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	buf, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(buf, v)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func testAuth() authenticator {
+	var cfg authConfig
+
+	cfg.APIKeys = []apiKeyConfig{
+		{Key: "k1", Subject: "ops", Scopes: []string{scopeSettingsRead}},
+	}
+
+	cfg.HMAC = []hmacConfig{
+		{ClientID: "billing", Secret: "s3cr3t", Scopes: []string{scopeSettingsWrite}},
+	}
+
+	cfg.JWT.Secret = "jwt-secret"
+	cfg.JWT.Audience = "props"
+
+	return newAuth(&cfg)
+}
+
+func makeJWT(secret, claims string) string {
+	enc := base64.RawURLEncoding
+	msg := enc.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + enc.EncodeToString([]byte(claims))
+
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write([]byte(msg))
+
+	return msg + "." + enc.EncodeToString(m.Sum(nil))
+}
+
+func TestAuthGuard(t *testing.T) {
+	var (
+		actor string
+		body  []byte
+	)
+
+	h := mAPI(http.MethodPost, require(testAuth(), scopeSettingsWrite)(func(_ io.Writer, r *http.Request) int {
+		actor = reqInfoFrom(r.Context()).Actor
+		body, _ = io.ReadAll(r.Body)
+
+		return http.StatusCreated
+	}))
+
+	call := func(body string, hdr map[string]string) int {
+		req := httptest.NewRequest(http.MethodPost, "/set-tag", bytes.NewBufferString(body))
+		for k, v := range hdr {
+			req.Header.Set(k, v)
+		}
+
+		rec := httptest.NewRecorder()
+		h(rec, req)
+
+		return rec.Code
+	}
+
+	if code := call("{}", nil); code != http.StatusUnauthorized {
+		t.Fatal("step 1 fail: no credentials", code)
+	}
+
+	if code := call("{}", map[string]string{hdrAPIKey: "bad"}); code != http.StatusUnauthorized {
+		t.Fatal("step 2 fail: bad key", code)
+	}
+
+	if code := call("{}", map[string]string{hdrAPIKey: "k1"}); code != http.StatusForbidden || actor != "" {
+		t.Fatal("step 3 fail: read-only key", code)
+	}
+
+	const payload = `{"user_id":1}`
+
+	ts := time.Now().Unix()
+	sig := hex.EncodeToString(signRequest([]byte("s3cr3t"), http.MethodPost, "/set-tag", ts, "n1", []byte(payload)))
+	hdr := map[string]string{
+		hdrClientID:  "billing",
+		hdrTimestamp: strconv.FormatInt(ts, 10),
+		hdrNonce:     "n1",
+		hdrSignature: sig,
+	}
+
+	if code := call(payload, hdr); code != http.StatusCreated || actor != "billing" || string(body) != payload {
+		t.Fatal("step 4 fail: hmac", code, actor, string(body))
+	}
+
+	if code := call(payload+" ", hdr); code != http.StatusUnauthorized {
+		t.Fatal("step 5 fail: tampered body", code)
+	}
+
+	exp := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+
+	tok := makeJWT("jwt-secret", `{"sub":"alice","aud":["props"],"scope":"settings:read settings:write","exp":`+exp+`}`)
+	if code := call("{}", map[string]string{hdrAuthorization: bearerPrefix + tok}); code != http.StatusCreated || actor != "alice" {
+		t.Fatal("step 6 fail: jwt", code, actor)
+	}
+
+	tok = makeJWT("jwt-secret", `{"sub":"carol","aud":"props","scope":"catalog:admin","exp":`+exp+`}`)
+	if code := call("{}", map[string]string{hdrAuthorization: bearerPrefix + tok}); code != http.StatusForbidden {
+		t.Fatal("step 6.1 fail: catalog admin wrote user settings", code)
+	}
+
+	tok = makeJWT("jwt-secret", `{"sub":"bob","aud":"other","scope":"settings:write","exp":`+exp+`}`)
+	if code := call("{}", map[string]string{hdrAuthorization: bearerPrefix + tok}); code != http.StatusUnauthorized {
+		t.Fatal("step 7 fail: jwt audience", code)
+	}
+
+	tok = makeJWT("jwt-secret", `{"sub":"bob","aud":"props","scope":"settings:write","exp":1}`)
+	if code := call("{}", map[string]string{hdrAuthorization: bearerPrefix + tok}); code != http.StatusUnauthorized {
+		t.Fatal("step 8 fail: jwt expired", code)
+	}
+
+	tok = makeJWT("other-secret", `{"sub":"bob","aud":"props","scope":"settings:write","exp":`+exp+`}`)
+	if code := call("{}", map[string]string{hdrAuthorization: bearerPrefix + tok}); code != http.StatusUnauthorized {
+		t.Fatal("step 9 fail: jwt signature", code)
+	}
+}
+
+func TestAuthHMACBodyLimit(t *testing.T) {
+	h := mAPI(http.MethodPost, require(testAuth(), scopeSettingsWrite)(func(_ io.Writer, _ *http.Request) int {
+		return http.StatusCreated
+	}))
+
+	call := func(body []byte) int {
+		ts := time.Now().Unix()
+		nonce := strconv.Itoa(len(body))
+
+		req := httptest.NewRequest(http.MethodPost, "/set-tag", bytes.NewReader(body))
+		req.Header.Set(hdrClientID, "billing")
+		req.Header.Set(hdrTimestamp, strconv.FormatInt(ts, 10))
+		req.Header.Set(hdrNonce, nonce)
+		req.Header.Set(hdrSignature, hex.EncodeToString(signRequest([]byte("s3cr3t"), http.MethodPost, "/set-tag", ts, nonce, body)))
+
+		rec := httptest.NewRecorder()
+		h(rec, req)
+
+		return rec.Code
+	}
+
+	if code := call(bytes.Repeat([]byte{' '}, maxBodySize)); code != http.StatusCreated {
+		t.Fatal("step 1 fail: body at limit", code)
+	}
+
+	if code := call(bytes.Repeat([]byte{' '}, maxBodySize+1)); code != http.StatusRequestEntityTooLarge {
+		t.Fatal("step 2 fail: body over limit", code)
+	}
+}
+
+func TestAuthHMACReplay(t *testing.T) {
+	h := mAPI(http.MethodGet, require(testAuth(), scopeSettingsWrite)(func(_ io.Writer, _ *http.Request) int {
+		return http.StatusOK
+	}))
+
+	ts := time.Now().Unix()
+
+	call := func(target, signed, nonce string) int {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set(hdrClientID, "billing")
+		req.Header.Set(hdrTimestamp, strconv.FormatInt(ts, 10))
+		req.Header.Set(hdrNonce, nonce)
+		req.Header.Set(hdrSignature, hex.EncodeToString(signRequest([]byte("s3cr3t"), http.MethodGet, signed, ts, nonce, nil)))
+
+		rec := httptest.NewRecorder()
+		h(rec, req)
+
+		return rec.Code
+	}
+
+	// query is signed in canonical form, regardless of parameters order in request.
+	if code := call("/audit?user_id=2&actor=a", "/audit?actor=a&user_id=2", "n1"); code != http.StatusOK {
+		t.Fatal("step 1 fail: signed query", code)
+	}
+
+	if code := call("/audit?user_id=2&actor=a", "/audit?actor=a&user_id=2", "n1"); code != http.StatusUnauthorized {
+		t.Fatal("step 2 fail: replayed", code)
+	}
+
+	if code := call("/audit?user_id=3&actor=a", "/audit?actor=a&user_id=2", "n2"); code != http.StatusUnauthorized {
+		t.Fatal("step 3 fail: tampered query", code)
+	}
+
+	if code := call("/audit?user_id=2", "/audit", "n3"); code != http.StatusUnauthorized {
+		t.Fatal("step 4 fail: unsigned query", code)
+	}
+
+	if code := call("/audit", "/audit", ""); code != http.StatusUnauthorized {
+		t.Fatal("step 5 fail: no nonce", code)
+	}
+
+	if code := call("/audit?user_id=3&actor=a", "/audit?actor=a&user_id=3", "n2"); code != http.StatusOK {
+		t.Fatal("step 6 fail: nonce of rejected request", code)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Message is a change event, prepared for publishing.
+type Message struct {
+	// ID is an idempotency key of event.
+	ID string
+	// Key is a user id, messages of the same key are published in order.
+	Key     string
+	Payload []byte
+}
+
+// Broker publishes change events.
+type Broker interface {
+	Publish(ctx context.Context, m *Message) error
+	Close() error
+}
+
+// brokerFactories creates brokers by address scheme (part before first colon), real message
+// bus clients are registered here, wrapped into kafkaBroker or natsBroker.
+var brokerFactories = map[string]func(addr string) (Broker, error){
+	"memory": func(string) (Broker, error) { return newMemBroker(), nil },
+	"file":   func(addr string) (Broker, error) { return newFileBroker(strings.TrimPrefix(addr, "file:")) },
+}
+
+func brokerScheme(addr string) string {
+	scheme, _, _ := strings.Cut(addr, ":")
+
+	return scheme
+}
+
+// openBroker creates broker for given address.
+func openBroker(addr string) (Broker, error) {
+	f, ok := brokerFactories[brokerScheme(addr)]
+	if !ok {
+		return nil, fmt.Errorf("unknown broker '%s'", brokerScheme(addr))
+	}
+
+	return f(addr)
+}
+
+// memBroker keeps published messages in memory, it is a stand-in for tests and development.
+type memBroker struct {
+	mu   sync.Mutex
+	msgs []Message
+}
+
+func newMemBroker() *memBroker {
+	return &memBroker{}
+}
+
+// Publish stores message.
+func (mb *memBroker) Publish(_ context.Context, m *Message) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	mb.msgs = append(mb.msgs, *m)
+
+	return nil
+}
+
+// Messages returns published messages.
+func (mb *memBroker) Messages() []Message {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	return append([]Message{}, mb.msgs...)
+}
+
+// Close releases broker resources.
+func (mb *memBroker) Close() error {
+	return nil
+}
+
+// fileBroker appends messages to file as json lines, it is a stand-in for local setups.
+type fileBroker struct {
+	mu sync.Mutex
+	fd *os.File
+}
+
+type fileMessage struct {
+	ID      string          `json:"id"`
+	Key     string          `json:"key"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+func newFileBroker(path string) (*fileBroker, error) {
+	if path == "" {
+		return nil, fmt.Errorf("file broker: empty path")
+	}
+
+	fd, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileBroker{fd: fd}, nil
+}
+
+// Publish appends message to file, it returns after message is synced to disk.
+func (fb *fileBroker) Publish(_ context.Context, m *Message) error {
+	buf, err := json.Marshal(fileMessage{ID: m.ID, Key: m.Key, Payload: m.Payload})
+	if err != nil {
+		return err
+	}
+
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	if _, err = fb.fd.Write(append(buf, '\n')); err != nil {
+		return err
+	}
+
+	return fb.fd.Sync()
+}
+
+// Close closes file.
+func (fb *fileBroker) Close() error {
+	return fb.fd.Close()
+}
+
+// headerIdempotencyKey carries event id in kafka record headers.
+const headerIdempotencyKey = "idempotency-key"
+
+// kafkaProducer is a part of kafka client, used by kafkaBroker, it should wait for record
+// acknowledgement (acks=all) before return.
+type kafkaProducer interface {
+	Produce(ctx context.Context, topic string, key, value []byte, headers map[string]string) error
+	Close() error
+}
+
+// kafkaBroker publishes messages to kafka topic, keyed by user id, so events of every user
+// land in the same partition, event id is passed in headers.
+type kafkaBroker struct {
+	p     kafkaProducer
+	topic string
+}
+
+func newKafkaBroker(p kafkaProducer, topic string) *kafkaBroker {
+	return &kafkaBroker{p: p, topic: topic}
+}
+
+// Publish produces message.
+func (kb *kafkaBroker) Publish(ctx context.Context, m *Message) error {
+	return kb.p.Produce(ctx, kb.topic, []byte(m.Key), m.Payload, map[string]string{headerIdempotencyKey: m.ID})
+}
+
+// Close closes producer.
+func (kb *kafkaBroker) Close() error {
+	return kb.p.Close()
+}
+
+// headerNatsMsgID is a JetStream de-duplication header.
+const headerNatsMsgID = "Nats-Msg-Id"
+
+// natsPublisher is a part of NATS JetStream client, used by natsBroker, it should wait for
+// publish acknowledgement before return.
+type natsPublisher interface {
+	Publish(ctx context.Context, subject string, data []byte, headers map[string]string) error
+	Close() error
+}
+
+// natsBroker publishes messages to `<subject>.<user id>`, event id is passed as message id,
+// so JetStream drops duplicates within its de-duplication window.
+type natsBroker struct {
+	p       natsPublisher
+	subject string
+}
+
+func newNATSBroker(p natsPublisher, subject string) *natsBroker {
+	return &natsBroker{p: p, subject: subject}
+}
+
+// Publish publishes message.
+func (nb *natsBroker) Publish(ctx context.Context, m *Message) error {
+	return nb.p.Publish(ctx, nb.subject+"."+m.Key, m.Payload, map[string]string{headerNatsMsgID: m.ID})
+}
+
+// Close closes publisher.
+func (nb *natsBroker) Close() error {
+	return nb.p.Close()
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cacheMemory is a settings cache address for in-process cache.
+const cacheMemory = "memory:"
+
+// cacheBackend is a key-value storage for cached values.
+type cacheBackend interface {
+	// MGet returns values for given keys, nil - for missing ones.
+	MGet(ctx context.Context, keys ...string) ([][]byte, error)
+	// Set stores value for given time.
+	Set(ctx context.Context, key string, val []byte, ttl time.Duration) error
+	Close() error
+}
+
+// memCache is an in-process cacheBackend.
+type memCache struct {
+	mu   sync.Mutex
+	now  func() time.Time
+	sets int
+	data map[string]memCacheItem
+}
+
+type memCacheItem struct {
+	val []byte
+	exp time.Time
+}
+
+// memCachePurge is a number of Set calls between expired items purges.
+const memCachePurge = 1024
+
+func newMemCache() *memCache {
+	return &memCache{now: time.Now, data: make(map[string]memCacheItem)}
+}
+
+// MGet returns values for given keys, nil - for missing (or expired) ones.
+func (mc *memCache) MGet(_ context.Context, keys ...string) ([][]byte, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	now := mc.now()
+	rv := make([][]byte, len(keys))
+
+	for i, k := range keys {
+		if it, ok := mc.data[k]; ok && it.exp.After(now) {
+			rv[i] = it.val
+		}
+	}
+
+	return rv, nil
+}
+
+// Set stores value for given time.
+func (mc *memCache) Set(_ context.Context, key string, val []byte, ttl time.Duration) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	now := mc.now()
+
+	if mc.sets++; mc.sets%memCachePurge == 0 {
+		for k, it := range mc.data {
+			if !it.exp.After(now) {
+				delete(mc.data, k)
+			}
+		}
+	}
+
+	mc.data[key] = memCacheItem{val: append([]byte{}, val...), exp: now.Add(ttl)}
+
+	return nil
+}
+
+// Close releases cache resources.
+func (mc *memCache) Close() error {
+	return nil
+}
+
+// settingsCache caches resolved actual settings of users.
+//
+// Every entry is stamped with user revision token, catalog token and catalog digest, it was built
+// with: users changes replace user token, catalog invalidations - catalog one (it is shared by all
+// instances), catalog watcher - digest, so stale entries are never served, they just expire.
+// Tokens live as long as entries do, so expired token can not revive entry, built before token
+// was set.
+type settingsCache struct {
+	kv      cacheBackend
+	prefix  string
+	ttl     time.Duration
+	timeout time.Duration
+	catalog atomic.Value
+}
+
+type cacheEntry struct {
+	Rev      string    `json:"rev"`
+	Catalog  string    `json:"catalog"`
+	Gen      string    `json:"gen"`
+	Settings []Setting `json:"settings"`
+}
+
+// settingsLoader resolves actual user settings, along with time, they are valid until (if known).
+type settingsLoader func(ctx context.Context) ([]Setting, *time.Time, error)
+
+func newSettingsCache(kv cacheBackend, cfg *settingsCacheConfig) *settingsCache {
+	c := &settingsCache{
+		kv:      kv,
+		prefix:  cfg.Prefix,
+		ttl:     cfg.TTL,
+		timeout: cfg.Timeout,
+	}
+
+	c.catalog.Store("")
+
+	return c
+}
+
+func (c *settingsCache) revKey(userID int) string {
+	return c.prefix + "rev:" + strconv.Itoa(userID)
+}
+
+func (c *settingsCache) entryKey(userID int) string {
+	return c.prefix + "settings:" + strconv.Itoa(userID)
+}
+
+func (c *settingsCache) catalogKey() string {
+	return c.prefix + "catalog"
+}
+
+// Get returns cached settings of user, resolving (and caching) them with `load` on miss,
+// cache failures are logged, but not returned.
+func (c *settingsCache) Get(ctx context.Context, userID int, load settingsLoader) (rv []Setting, err error) {
+	catalog := c.catalog.Load().(string)
+	if catalog == "" { // catalog state is unknown, nothing can be cached.
+		rv, _, err = load(ctx)
+
+		return rv, err
+	}
+
+	cctx, cancel := context.WithTimeout(ctx, c.timeout)
+	vals, err := c.kv.MGet(cctx, c.revKey(userID), c.entryKey(userID), c.catalogKey())
+	cancel()
+
+	if err != nil {
+		slog.WarnContext(ctx, "settings cache get", "err", err)
+
+		rv, _, err = load(ctx)
+
+		return rv, err
+	}
+
+	rev, gen := string(vals[0]), string(vals[2])
+
+	if vals[1] != nil {
+		var e cacheEntry
+
+		if err = json.Unmarshal(vals[1], &e); err == nil && e.Rev == rev && e.Gen == gen && e.Catalog == catalog {
+			return e.Settings, nil
+		}
+	}
+
+	rv, until, err := load(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ttl := c.ttl
+
+	if until != nil {
+		if d := time.Until(*until); d < ttl {
+			ttl = d
+		}
+	}
+
+	if ttl <= 0 {
+		return rv, nil
+	}
+
+	buf, err := json.Marshal(cacheEntry{Rev: rev, Catalog: catalog, Gen: gen, Settings: rv})
+	if err != nil {
+		return nil, err
+	}
+
+	cctx, cancel = context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	if err = c.kv.Set(cctx, c.entryKey(userID), buf, ttl); err != nil {
+		slog.WarnContext(ctx, "settings cache set", "err", err)
+	}
+
+	return rv, nil
+}
+
+// Invalidate makes cached settings of user stale.
+func (c *settingsCache) Invalidate(ctx context.Context, userID int) error {
+	return c.bump(ctx, c.revKey(userID))
+}
+
+// InvalidateCatalog makes cached settings of all users stale, for every instance, sharing cache.
+func (c *settingsCache) InvalidateCatalog(ctx context.Context) error {
+	return c.bump(ctx, c.catalogKey())
+}
+
+// bump replaces token under `key` with a new random one.
+func (c *settingsCache) bump(ctx context.Context, key string) error {
+	var tok [8]byte
+
+	if _, err := rand.Read(tok[:]); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	return c.kv.Set(ctx, key, []byte(hex.EncodeToString(tok[:])), c.ttl)
+}
+
+// checkCatalog refreshes catalog digest, caching is suspended, until it succeeds.
+func (c *settingsCache) checkCatalog(ctx context.Context, ss SettingStore) {
+	d, err := ss.Digest(ctx, time.Now())
+	if err != nil {
+		slog.WarnContext(ctx, "catalog digest", "err", err)
+
+		d = ""
+	}
+
+	if old := c.catalog.Swap(d).(string); old != d && old != "" && d != "" {
+		slog.InfoContext(ctx, "catalog changed, cached settings invalidated")
+	}
+}
+
+// watchCatalog checks catalog, until `ctx` is done.
+func (c *settingsCache) watchCatalog(ctx context.Context, ss SettingStore, every time.Duration) {
+	tick := time.NewTicker(every)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			c.checkCatalog(ctx, ss)
+		}
+	}
+}
+
+// Users wraps UserStore, so every change invalidates cached settings of user.
+func (c *settingsCache) Users(us UserStore) UserStore {
+	return &cachedUserStore{UserStore: us, c: c}
+}
+
+type cachedUserStore struct {
+	UserStore
+	c *settingsCache
+}
+
+// Set sets new settings for user, and invalidates cached ones, invalidation failure is logged only:
+// change is already made at that point.
+func (cs *cachedUserStore) Set(ctx context.Context, userID int, s UserSettings, ch Change) error {
+	if err := cs.UserStore.Set(ctx, userID, s, ch); err != nil {
+		return err
+	}
+
+	if err := cs.c.Invalidate(ctx, userID); err != nil {
+		slog.ErrorContext(ctx, "settings cache invalidate", "user_id", userID, "err", err)
+	}
+
+	return nil
+}
+
+// Cancel removes scheduled revisions of user, and invalidates cached settings, if any was removed.
+func (cs *cachedUserStore) Cancel(ctx context.Context, userID int, ids []int, ch Change) (int, error) {
+	n, err := cs.UserStore.Cancel(ctx, userID, ids, ch)
+	if err != nil || n == 0 {
+		return n, err
+	}
+
+	if err := cs.c.Invalidate(ctx, userID); err != nil {
+		slog.ErrorContext(ctx, "settings cache invalidate", "user_id", userID, "err", err)
+	}
+
+	return n, nil
+}
+
+// openSettingsCache creates configured settings cache (nil, if disabled), and starts catalog
+// watcher, returned function stops it and releases cache resources.
+func openSettingsCache(cfg *settingsCacheConfig, ss SettingStore) (*settingsCache, func()) {
+	var kv cacheBackend
+
+	switch cfg.Addr {
+	case "":
+		return nil, func() {}
+	case cacheMemory:
+		slog.Warn("using in-process settings cache, it is not shared among instances")
+
+		kv = newMemCache()
+	default:
+		kv = newRedisCache(cfg.Addr, cfg.Password, cfg.DB, cfg.Timeout)
+	}
+
+	c := newSettingsCache(kv, cfg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	c.checkCatalog(ctx, ss)
+
+	go c.watchCatalog(ctx, ss, cfg.CatalogCheck)
+
+	return c, func() {
+		cancel()
+
+		if err := kv.Close(); err != nil {
+			slog.Error("settings cache close", "err", err)
+		}
+	}
+}
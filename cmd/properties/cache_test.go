@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// digestStore is a SettingStore with controlled catalog digest.
+type digestStore struct {
+	SettingStore
+	digest string
+	err    error
+}
+
+func (ds *digestStore) Digest(context.Context, time.Time) (string, error) {
+	return ds.digest, ds.err
+}
+
+func newTestSettingsCache(kv cacheBackend) *settingsCache {
+	cfg := defaultConfig().Cache.Settings
+
+	return newSettingsCache(kv, &cfg)
+}
+
+func TestMemCache(t *testing.T) {
+	var (
+		ctx = context.Background()
+		now = time.Now()
+		mc  = newMemCache()
+	)
+
+	mc.now = func() time.Time { return now }
+
+	if err := mc.Set(ctx, "a", []byte("1"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	rv, err := mc.MGet(ctx, "a", "b")
+	if err != nil || string(rv[0]) != "1" || rv[1] != nil {
+		t.Fatal("step 1 fail:", rv, err)
+	}
+
+	now = now.Add(time.Minute)
+
+	if rv, _ = mc.MGet(ctx, "a"); rv[0] != nil {
+		t.Fatal("step 2 fail: expired value returned")
+	}
+}
+
+func TestSettingsCache(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		loads int
+		until *time.Time
+		c     = newTestSettingsCache(newMemCache())
+		ds    = &digestStore{digest: "v1"}
+	)
+
+	load := func(context.Context) ([]Setting, *time.Time, error) {
+		loads++
+
+		return []Setting{{Name: "profit", Value: "85"}}, until, nil
+	}
+
+	get := func(step string, wantLoads int) {
+		t.Helper()
+
+		rv, err := c.Get(ctx, 1, load)
+		if err != nil || len(rv) != 1 || rv[0].Value != "85" {
+			t.Fatal(step, "fail:", rv, err)
+		}
+
+		if loads != wantLoads {
+			t.Fatalf("%s fail: want %d loads, got %d", step, wantLoads, loads)
+		}
+	}
+
+	// catalog state is unknown, nothing is cached.
+	get("step 1", 1)
+	get("step 2", 2)
+
+	c.checkCatalog(ctx, ds)
+
+	get("step 3", 3)
+	get("step 4", 3)
+
+	if err := c.Invalidate(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	get("step 5", 4)
+	get("step 6", 4)
+
+	ds.digest = "v2"
+	c.checkCatalog(ctx, ds)
+
+	get("step 7", 5)
+	get("step 8", 5)
+
+	ds.err = errors.New("catalog unavailable")
+	c.checkCatalog(ctx, ds)
+
+	get("step 9", 6)
+
+	ds.err = nil
+	c.checkCatalog(ctx, ds)
+
+	get("step 10", 6)
+
+	// catalog invalidation, made by other instance, sharing cache, makes entries stale.
+	if err := newTestSettingsCache(c.kv).InvalidateCatalog(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	get("step 11", 7)
+	get("step 12", 7)
+
+	// user settings, that are already expired, are not cached.
+	expired := time.Now().Add(-time.Second)
+	until = &expired
+
+	if err := c.Invalidate(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	get("step 13", 8)
+	get("step 14", 9)
+}
+
+func TestCachedUserStore(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		c     = newTestSettingsCache(newMemCache())
+		us    = c.Users(NewMemoryUserStore(userStoreOptions{}))
+		loads int
+	)
+
+	c.checkCatalog(ctx, &digestStore{digest: "v1"})
+
+	load := func(ctx context.Context) ([]Setting, *time.Time, error) {
+		loads++
+
+		s, err := us.Get(ctx, 1, time.Now())
+
+		return []Setting{{Name: "bundles", Value: string(rune('0' + len(s.Bundles)))}}, nil, err
+	}
+
+	for i, want := range []string{"0", "0", "1"} {
+		if i == 2 {
+			if err := us.Set(ctx, 1, UserSettings{Bundles: []int{1}}, Change{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		rv, err := c.Get(ctx, 1, load)
+		if err != nil || rv[0].Value != want {
+			t.Fatalf("step %d fail: want %s got %v (%v)", i+1, want, rv, err)
+		}
+	}
+
+	if loads != 2 {
+		t.Fatal("step 4 fail: loads", loads)
+	}
+}
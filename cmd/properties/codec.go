@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/fxamacker/cbor"
+)
+
+// payload codecs versions, stored as the first byte of user settings payload, they never
+// collide with headers of legacy (unversioned) CBOR payloads: arrays (0x80-0x9f) and null (0xf6).
+const (
+	codecVersionCBOR  byte = 0x01
+	codecVersionJSON  byte = 0x02
+	codecVersionDelta byte = 0x03
+)
+
+// payload codecs names.
+const (
+	codecCBOR  = "cbor"
+	codecJSON  = "json"
+	codecDelta = "delta"
+)
+
+// payloadCodec encodes bundle ids of user settings, payload is stored with codec version prefix.
+type payloadCodec interface {
+	Version() byte
+	Name() string
+	Encode(bundles []int) ([]byte, error)
+	Decode(buf []byte) ([]int, error)
+}
+
+var codecs = []payloadCodec{cborCodec{}, jsonCodec{}, deltaCodec{}}
+
+// codecByName returns codec with given name, or nil if none.
+func codecByName(name string) payloadCodec {
+	for _, c := range codecs {
+		if c.Name() == name {
+			return c
+		}
+	}
+
+	return nil
+}
+
+// encodePayload encodes bundles with given codec, prepending its version.
+func encodePayload(c payloadCodec, bundles []int) ([]byte, error) {
+	buf, err := c.Encode(bundles)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte{c.Version()}, buf...), nil
+}
+
+// decodePayload decodes payload of any known codec, including legacy unversioned CBOR.
+func decodePayload(buf []byte) ([]int, error) {
+	if len(buf) == 0 {
+		return nil, nil
+	}
+
+	for _, c := range codecs {
+		if c.Version() == buf[0] {
+			return c.Decode(buf[1:])
+		}
+	}
+
+	if buf[0] >= 0x80 { // legacy
+		return cborCodec{}.Decode(buf)
+	}
+
+	return nil, fmt.Errorf("unknown payload codec version: %#x", buf[0])
+}
+
+// payloadVersion returns codec version of payload, zero - for legacy one.
+func payloadVersion(buf []byte) byte {
+	if len(buf) == 0 || buf[0] >= 0x80 {
+		return 0
+	}
+
+	return buf[0]
+}
+
+// cborCodec encodes bundles as canonical CBOR array.
+type cborCodec struct{}
+
+func (cborCodec) Version() byte { return codecVersionCBOR }
+func (cborCodec) Name() string  { return codecCBOR }
+
+func (cborCodec) Encode(bundles []int) ([]byte, error) {
+	return cbor.Marshal(bundles, cbor.EncOptions{Canonical: true})
+}
+
+func (cborCodec) Decode(buf []byte) (rv []int, err error) {
+	return rv, cbor.Unmarshal(buf, &rv)
+}
+
+// jsonCodec encodes bundles as JSON array, it is the easiest one to inspect by hand.
+type jsonCodec struct{}
+
+func (jsonCodec) Version() byte { return codecVersionJSON }
+func (jsonCodec) Name() string  { return codecJSON }
+
+func (jsonCodec) Encode(bundles []int) ([]byte, error) {
+	return json.Marshal(bundles)
+}
+
+func (jsonCodec) Decode(buf []byte) (rv []int, err error) {
+	return rv, json.Unmarshal(buf, &rv)
+}
+
+// deltaCodec encodes bundles as zig-zag varints of differences between neighbours, it keeps
+// order and is the most compact one for ascending ids.
+type deltaCodec struct{}
+
+func (deltaCodec) Version() byte { return codecVersionDelta }
+func (deltaCodec) Name() string  { return codecDelta }
+
+func (deltaCodec) Encode(bundles []int) ([]byte, error) {
+	var (
+		prev int64
+		buf  = make([]byte, 0, len(bundles)*2)
+	)
+
+	for _, b := range bundles {
+		buf = binary.AppendVarint(buf, int64(b)-prev)
+		prev = int64(b)
+	}
+
+	return buf, nil
+}
+
+func (deltaCodec) Decode(buf []byte) (rv []int, err error) {
+	var prev int64
+
+	for len(buf) > 0 {
+		d, n := binary.Varint(buf)
+		if n <= 0 {
+			return nil, errors.New("delta: malformed varint")
+		}
+
+		prev += d
+		buf = buf[n:]
+		rv = append(rv, int(prev))
+	}
+
+	return rv, nil
+}
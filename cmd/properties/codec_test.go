@@ -0,0 +1,84 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/fxamacker/cbor"
+)
+
+func TestPayloadCodecs(t *testing.T) {
+	cases := [][]int{
+		nil,
+		{1},
+		{1, 2, 3, 10, 200, 3000},
+		{42, 7, 1_000_000, 3},
+		{-5, 0, 5},
+	}
+
+	for _, c := range codecs {
+		if codecByName(c.Name()) != c {
+			t.Fatal("codec not found by name:", c.Name())
+		}
+
+		for _, want := range cases {
+			buf, err := encodePayload(c, want)
+			if err != nil {
+				t.Fatal(c.Name(), err)
+			}
+
+			if payloadVersion(buf) != c.Version() {
+				t.Fatal(c.Name(), "bad version:", buf)
+			}
+
+			got, err := decodePayload(buf)
+			if err != nil || len(got) != len(want) || (len(want) > 0 && !reflect.DeepEqual(got, want)) {
+				t.Fatalf("%s: want %v got %v (%v)", c.Name(), want, got, err)
+			}
+		}
+	}
+
+	if codecByName("zip") != nil {
+		t.Fatal("unknown codec found")
+	}
+}
+
+func TestPayloadLegacy(t *testing.T) {
+	for _, want := range [][]int{nil, {}, {1, 5, 3}, make([]int, 30)} {
+		buf, err := cbor.Marshal(want, cbor.EncOptions{Canonical: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if payloadVersion(buf) != 0 {
+			t.Fatal("legacy payload has version:", buf)
+		}
+
+		got, err := decodePayload(buf)
+		if err != nil || len(got) != len(want) {
+			t.Fatalf("want %v got %v (%v)", want, got, err)
+		}
+	}
+
+	if _, err := decodePayload([]byte{0x7f, 1}); err == nil {
+		t.Fatal("unknown version accepted")
+	}
+
+	if _, err := decodePayload([]byte{codecVersionDelta, 0x80}); err == nil {
+		t.Fatal("truncated varint accepted")
+	}
+}
+
+func TestPayloadDeltaSize(t *testing.T) {
+	ids := make([]int, 50)
+	for i := range ids {
+		ids[i] = 1000 + i*3
+	}
+
+	d, _ := encodePayload(deltaCodec{}, ids)
+	c, _ := encodePayload(cborCodec{}, ids)
+
+	if len(d) >= len(c)/2 {
+		t.Fatal("delta is not compact:", len(d), len(c))
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	env := map[string]string{}
+	getenv := func(k string) string { return env[k] }
+
+	if _, _, err := loadConfig(nil, getenv); err == nil {
+		t.Fatal("step 1 fail: no dsn accepted")
+	}
+
+	env[envDBUsers] = "u:p@tcp(db)/usersdb"
+	env[envDBSettings] = "s:p@tcp(db)/settingsdb"
+
+	c, printOnly, err := loadConfig(nil, getenv)
+	if err != nil || printOnly {
+		t.Fatal("step 2 fail:", err)
+	}
+
+	if c.HTTP.Addr != "0.0.0.0:8080" || c.Retry.Attempts != 3 {
+		t.Fatal("step 3 fail: defaults not applied")
+	}
+
+	path := filepath.Join(t.TempDir(), "conf.yaml")
+
+	const body = `
+http:
+  addr: 127.0.0.1:9000
+  read_timeout: 2s
+db:
+  users:
+    max_open_conns: 8
+log:
+  level: debug
+`
+
+	if err = os.WriteFile(path, []byte(body), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	env[envAddr] = "127.0.0.1:9001"
+
+	c, printOnly, err = loadConfig([]string{"-config", path, "-print-config"}, getenv)
+	if err != nil || !printOnly {
+		t.Fatal("step 4 fail:", err)
+	}
+
+	if c.HTTP.Addr != "127.0.0.1:9001" || c.HTTP.ReadTimeout != 2*time.Second {
+		t.Fatal("step 5 fail: file/env precedence")
+	}
+
+	if c.DB.Users.MaxOpenConns != 8 || c.DB.Users.MaxIdleConns != 4 || c.Log.Level != levelDebug {
+		t.Fatal("step 6 fail: file values")
+	}
+
+	c, _, err = loadConfig([]string{"-config", path, "-addr", ":80", "-read-only"}, getenv)
+	if err != nil || c.HTTP.Addr != ":80" || !c.Features.ReadOnly {
+		t.Fatal("step 7 fail: flags precedence", err)
+	}
+
+	if _, _, err = loadConfig([]string{"-log-level", "trace"}, getenv); err == nil {
+		t.Fatal("step 8 fail: bad level accepted")
+	}
+
+	// invalid config is printed before validation.
+	c, printOnly, err = loadConfig([]string{"-log-level", "trace", "-print-config"}, getenv)
+	if err != nil || !printOnly || c.Log.Level != "trace" || c.Validate() == nil {
+		t.Fatal("step 8.1 fail:", err)
+	}
+
+	if err = os.WriteFile(path, []byte("http:\n  adr: x\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err = loadConfig([]string{"-config", path}, getenv); err == nil {
+		t.Fatal("step 9 fail: unknown field accepted")
+	}
+}
+
+func TestConfigPrint(t *testing.T) {
+	c := defaultConfig()
+	c.DB.Users.DSN = "usr-us:usr-pw@tcp(db)/usersdb"
+	c.DB.Users.Replicas = []string{"usr-us:rep-pw@tcp(replica)/usersdb"}
+
+	var buf bytes.Buffer
+
+	if err := c.Print(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	out := buf.String()
+
+	if strings.Contains(out, "usr-pw") || !strings.Contains(out, "usr-us:***@tcp(db)/usersdb") {
+		t.Fatal("password not masked:", out)
+	}
+
+	if strings.Contains(out, "rep-pw") || c.DB.Users.Replicas[0] != "usr-us:rep-pw@tcp(replica)/usersdb" {
+		t.Fatal("replica password not masked (or original changed):", out)
+	}
+
+	if m := maskDSN("postgres://usr:pw@db/settingsdb"); m != "postgres://usr:***@db/settingsdb" {
+		t.Fatal("bad url mask:", m)
+	}
+
+	if !strings.Contains(out, "read_timeout: 5s") {
+		t.Fatal("durations not human-readable:", out)
+	}
+}
+
+func TestDBConfigReplicas(t *testing.T) {
+	d := defaultConfig().DB.Users
+	d.DSN = "postgres://u:p@primary/usersdb"
+	d.Replicas = []string{"postgres://u:p@replica/usersdb"}
+
+	if err := d.validate(); err != nil {
+		t.Fatal("step 1 fail:", err)
+	}
+
+	for i, mod := range []func(d *dbConfig){
+		func(d *dbConfig) { d.Replicas = []string{""} },
+		func(d *dbConfig) { d.Replicas = []string{"u:p@tcp(replica)/usersdb"} },
+		func(d *dbConfig) { d.MaxLag = 0 },
+		func(d *dbConfig) { d.DSN, d.Replicas = "sqlite:a.db", []string{"sqlite:b.db"} },
+	} {
+		c := d
+		mod(&c)
+
+		if err := c.validate(); err == nil {
+			t.Fatalf("step %d fail: bad config accepted", i+2)
+		}
+	}
+}
+
+func TestConfigShards(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "conf.yaml")
+
+	const body = `
+db:
+  settings:
+    dsn: "memory:"
+  sharding: modulo
+  user_shards:
+    - name: a
+      dsn: usr:pw-a@tcp(db-a)/usersdb
+      max_open_conns: 8
+    - name: b
+      dsn: usr:pw-b@tcp(db-b)/usersdb
+`
+
+	if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := readConfig(path, func(string) string { return "" })
+	if err != nil {
+		t.Fatal("step 1 fail:", err)
+	}
+
+	if err = c.Validate(); err != nil {
+		t.Fatal("step 2 fail:", err)
+	}
+
+	if len(c.DB.UserShards) != 2 || c.DB.UserShards[0].MaxOpenConns != 8 || c.DB.Sharding != shardingModulo {
+		t.Fatal("step 3 fail:", c.DB.UserShards)
+	}
+
+	var buf bytes.Buffer
+
+	if err = c.Print(&buf); err != nil || strings.Contains(buf.String(), "pw-a") {
+		t.Fatal("step 4 fail: shard password not masked", err)
+	}
+
+	for i, mod := range []func(c *config){
+		func(c *config) { c.DB.Sharding = "random" },
+		func(c *config) { c.DB.UserShards[1].Name = "a" },
+		func(c *config) { c.DB.UserShards[1].Name = "" },
+		func(c *config) { c.DB.UserShards[1].DSN = "sqlite:b.db" },
+	} {
+		cc := c
+		cc.DB.UserShards = append([]shardConfig{}, c.DB.UserShards...)
+		mod(&cc)
+
+		if err = cc.Validate(); err == nil {
+			t.Fatalf("step %d fail: bad config accepted", i+5)
+		}
+	}
+}
+
+func TestOutboxConfig(t *testing.T) {
+	o := defaultConfig().Outbox
+
+	if err := o.validate(); err != nil {
+		t.Fatal("step 1 fail: disabled outbox rejected", err)
+	}
+
+	o.Broker = "file:/tmp/events.jsonl"
+
+	if err := o.validate(); err != nil {
+		t.Fatal("step 2 fail:", err)
+	}
+
+	for i, mod := range []func(o *outboxConfig){
+		func(o *outboxConfig) { o.Broker = "kafka://broker:9092" },
+		func(o *outboxConfig) { o.Interval = 0 },
+		func(o *outboxConfig) { o.Batch = 0 },
+	} {
+		c := o
+		mod(&c)
+
+		if err := c.validate(); err == nil {
+			t.Fatalf("step %d fail: bad config accepted", i+3)
+		}
+	}
+}
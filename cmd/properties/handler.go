@@ -2,18 +2,58 @@ package main
 
 import (
 	"context"
-	"log"
+	"errors"
+	"log/slog"
 	"time"
 )
 
+// assignMode tells how requested bundles are applied to (or removed from) user state.
+type assignMode string
+
+const (
+	// modeMerge merges requested bundles into state, upgrading or downgrading related ones.
+	modeMerge assignMode = "merge"
+	// modeReplace makes requested bundles the whole state.
+	modeReplace assignMode = "replace"
+	// modeDowngrade replaces removed bundles with their nearest kept ancestors.
+	modeDowngrade assignMode = "downgrade"
+	// modeChain removes whole branches of removed bundles.
+	modeChain assignMode = "chain"
+)
+
+func (m assignMode) valid() bool {
+	return m == "" || m == modeMerge || m == modeReplace || m == modeDowngrade || m == modeChain
+}
+
+// forSet reports whenever mode applies to bundles assignment.
+func (m assignMode) forSet() bool {
+	return m == "" || m == modeMerge || m == modeReplace
+}
+
+// forUnset reports whenever mode applies to bundles removal.
+func (m assignMode) forUnset() bool {
+	return m == "" || m == modeDowngrade || m == modeChain
+}
+
+// errUnknownBundle reports bundle, missing from catalog, requested in replace mode.
+var errUnknownBundle = errors.New("unknown bundle")
+
+// errAmbiguousBundle reports bundle name, shared by bundles of several tags, requested without tag.
+var errAmbiguousBundle = errors.New("ambiguous bundle name")
+
 type handler struct {
 	user    UserStore
 	setting SettingStore
+	// cache holds resolved actual settings, nil - caching is disabled.
+	cache *settingsCache
 }
 
 // Get returs list of settings names and values, for given user and period of time.
-func (h *handler) GetSettings(ctx context.Context, userID int, period time.Time) ([]Setting, error) {
-	log.Printf("get-settings for %d at '%s'", userID, period)
+func (h *handler) GetSettings(ctx context.Context, userID int, period time.Time) (rv []Setting, err error) {
+	ctx, span := startSpan(ctx, "handler.GetSettings", userAttr(userID))
+	defer func() { endSpan(span, err) }()
+
+	slog.DebugContext(ctx, "get-settings", "user_id", userID, "when", period)
 
 	us, err := h.user.Get(ctx, userID, period)
 	if err != nil {
@@ -23,24 +63,136 @@ func (h *handler) GetSettings(ctx context.Context, userID int, period time.Time)
 	return h.setting.Get(ctx, period, us.Bundles)
 }
 
+// InvalidateCatalog drops cached settings of all users (if caching is enabled), and refreshes
+// catalog digest right away.
+func (h *handler) InvalidateCatalog(ctx context.Context) error {
+	if h.cache == nil {
+		return nil
+	}
+
+	if err := h.cache.InvalidateCatalog(ctx); err != nil {
+		return err
+	}
+
+	h.cache.checkCatalog(ctx, h.setting)
+
+	return nil
+}
+
+// CurrentSettings returns actual settings names and values for given user, through cache (if any).
+func (h *handler) CurrentSettings(ctx context.Context, userID int) (rv []Setting, err error) {
+	if h.cache == nil {
+		return h.GetSettings(ctx, userID, time.Now())
+	}
+
+	ctx, span := startSpan(ctx, "handler.CurrentSettings", userAttr(userID))
+	defer func() { endSpan(span, err) }()
+
+	return h.cache.Get(ctx, userID, func(ctx context.Context) ([]Setting, *time.Time, error) {
+		// cache misses go to primary, to not cache state, lagging replica has.
+		ctx = withPrimary(ctx)
+		now := time.Now()
+
+		us, err := h.user.Get(ctx, userID, now)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		rv, err := h.setting.Get(ctx, now, us.Bundles)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		sc, err := h.user.Scheduled(ctx, userID, now)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return rv, earliest(us.Expire, nextStart(sc)), nil
+	})
+}
+
+// earliest returns the earliest of given times, nil ones are skipped.
+func earliest(a, b *time.Time) *time.Time {
+	if a == nil || (b != nil && b.Before(*a)) {
+		return b
+	}
+
+	return a
+}
+
+// effectiveAt returns time, change takes effect at.
+func effectiveAt(ch *Change) time.Time {
+	if ch.Start != nil {
+		return *ch.Start
+	}
+
+	return time.Now()
+}
+
+// GetSettingsBatch returns settings names and values, for given users and period of time, keyed by user id.
+func (h *handler) GetSettingsBatch(ctx context.Context, userIDs []int, period time.Time) (rv map[int][]Setting, err error) {
+	ctx, span := startSpan(ctx, "handler.GetSettingsBatch")
+	defer func() { endSpan(span, err) }()
+
+	slog.DebugContext(ctx, "get-settings-batch", "users", len(userIDs), "when", period)
+
+	uss, err := h.user.GetMany(ctx, userIDs, period)
+	if err != nil {
+		return nil, err
+	}
+
+	rv = make(map[int][]Setting, len(uss))
+
+	for uid, us := range uss {
+		if rv[uid], err = h.setting.Get(ctx, period, us.Bundles); err != nil {
+			return nil, err
+		}
+	}
+
+	return rv, nil
+}
+
 // ListSettings returns list of settings names.
-func (h *handler) ListSettings(ctx context.Context) ([]string, error) {
+func (h *handler) ListSettings(ctx context.Context) (rv []string, err error) {
+	ctx, span := startSpan(ctx, "handler.ListSettings")
+	defer func() { endSpan(span, err) }()
+
 	return h.setting.SettingsList(ctx)
 }
 
 // ListBundles returns list of bundles names.
-func (h *handler) ListBundles(ctx context.Context) ([]Bundle, error) {
+func (h *handler) ListBundles(ctx context.Context) (rv []Bundle, err error) {
+	ctx, span := startSpan(ctx, "handler.ListBundles")
+	defer func() { endSpan(span, err) }()
+
 	return h.setting.BundlesList(ctx)
 }
 
 // ListTags returns list of existing tags.
-func (h *handler) ListTags(ctx context.Context) ([]string, error) {
+func (h *handler) ListTags(ctx context.Context) (rv []string, err error) {
+	ctx, span := startSpan(ctx, "handler.ListTags")
+	defer func() { endSpan(span, err) }()
+
 	return h.setting.TagsList(ctx)
 }
 
+// Audit returns recorded changes of users settings.
+func (h *handler) Audit(ctx context.Context, f AuditFilter) (rv []AuditRecord, err error) {
+	ctx, span := startSpan(ctx, "handler.Audit")
+	defer func() { endSpan(span, err) }()
+
+	return h.user.Audit(ctx, f)
+}
+
 // SetTag sets new tag for user.
-func (h *handler) SetTag(ctx context.Context, userID int, tag string, expire *time.Time) error {
-	us, err := h.user.Get(ctx, userID, time.Now())
+func (h *handler) SetTag(ctx context.Context, userID int, tag string, expire *time.Time, mode assignMode, ch Change) (err error) {
+	ctx, span := startSpan(ctx, "handler.SetTag", userAttr(userID))
+	defer func() { endSpan(span, err) }()
+
+	ctx = withPrimary(ctx)
+
+	us, err := h.user.Get(ctx, userID, effectiveAt(&ch))
 	if err != nil {
 		return err
 	}
@@ -55,15 +207,38 @@ func (h *handler) SetTag(ctx context.Context, userID int, tag string, expire *ti
 		return err
 	}
 
+	if mode == modeReplace && len(newb) == 0 {
+		return errUnknownBundle
+	}
+
 	us.Expire = expire
-	us.Bundles = MergeBundles(curb, newb)
 
-	return h.user.Set(ctx, userID, us)
+	if mode == modeReplace {
+		if err = h.checkHierarchy(ctx, newb); err != nil {
+			return err
+		}
+
+		us.Bundles = bundleIDs(newb)
+	} else {
+		all, err := h.setting.BundlesList(ctx)
+		if err != nil {
+			return err
+		}
+
+		us.Bundles = MergeBundles(curb, newb, all)
+	}
+
+	return h.user.Set(ctx, userID, us, ch)
 }
 
 // SetBundles sets one or more bundles for user.
-func (h *handler) SetBundles(ctx context.Context, userID int, bundles []string, expire *time.Time) error {
-	us, err := h.user.Get(ctx, userID, time.Now())
+func (h *handler) SetBundles(ctx context.Context, userID int, bundles []string, expire *time.Time, mode assignMode, ch Change) (err error) {
+	ctx, span := startSpan(ctx, "handler.SetBundles", userAttr(userID))
+	defer func() { endSpan(span, err) }()
+
+	ctx = withPrimary(ctx)
+
+	us, err := h.user.Get(ctx, userID, effectiveAt(&ch))
 	if err != nil {
 		return err
 	}
@@ -78,15 +253,38 @@ func (h *handler) SetBundles(ctx context.Context, userID int, bundles []string,
 		return err
 	}
 
+	if mode == modeReplace && len(newb) != len(uniqueStrings(bundles)) {
+		return errUnknownBundle
+	}
+
 	us.Expire = expire
-	us.Bundles = MergeBundles(curb, newb)
 
-	return h.user.Set(ctx, userID, us)
+	if mode == modeReplace {
+		if err = h.checkHierarchy(ctx, newb); err != nil {
+			return err
+		}
+
+		us.Bundles = bundleIDs(newb)
+	} else {
+		all, err := h.setting.BundlesList(ctx)
+		if err != nil {
+			return err
+		}
+
+		us.Bundles = MergeBundles(curb, newb, all)
+	}
+
+	return h.user.Set(ctx, userID, us, ch)
 }
 
 // UnSetTag un-sets tag for user.
-func (h *handler) UnSetTag(ctx context.Context, userID int, tag string) error {
-	us, err := h.user.Get(ctx, userID, time.Now())
+func (h *handler) UnSetTag(ctx context.Context, userID int, tag string, mode assignMode, ch Change) (err error) {
+	ctx, span := startSpan(ctx, "handler.UnSetTag", userAttr(userID))
+	defer func() { endSpan(span, err) }()
+
+	ctx = withPrimary(ctx)
+
+	us, err := h.user.Get(ctx, userID, effectiveAt(&ch))
 	if err != nil {
 		return err
 	}
@@ -101,14 +299,24 @@ func (h *handler) UnSetTag(ctx context.Context, userID int, tag string) error {
 		return err
 	}
 
-	us.Bundles = DropBundles(curb, cutb)
+	all, err := h.setting.BundlesList(ctx)
+	if err != nil {
+		return err
+	}
+
+	us.Bundles = DropBundles(curb, cutb, all, mode == modeChain)
 
-	return h.user.Set(ctx, userID, us)
+	return h.user.Set(ctx, userID, us, ch)
 }
 
 // UnSetBundles un-sets bundles for user.
-func (h *handler) UnSetBundles(ctx context.Context, userID int, bundles []string) error {
-	us, err := h.user.Get(ctx, userID, time.Now())
+func (h *handler) UnSetBundles(ctx context.Context, userID int, bundles []string, mode assignMode, ch Change) (err error) {
+	ctx, span := startSpan(ctx, "handler.UnSetBundles", userAttr(userID))
+	defer func() { endSpan(span, err) }()
+
+	ctx = withPrimary(ctx)
+
+	us, err := h.user.Get(ctx, userID, effectiveAt(&ch))
 	if err != nil {
 		return err
 	}
@@ -123,7 +331,238 @@ func (h *handler) UnSetBundles(ctx context.Context, userID int, bundles []string
 		return err
 	}
 
-	us.Bundles = DropBundles(curb, cutb)
+	all, err := h.setting.BundlesList(ctx)
+	if err != nil {
+		return err
+	}
+
+	us.Bundles = DropBundles(curb, cutb, all, mode == modeChain)
+
+	return h.user.Set(ctx, userID, us, ch)
+}
+
+// Scheduled returns not yet effective changes of user.
+func (h *handler) Scheduled(ctx context.Context, userID int) (rv []ScheduledChange, err error) {
+	ctx, span := startSpan(ctx, "handler.Scheduled", userAttr(userID))
+	defer func() { endSpan(span, err) }()
+
+	return h.user.Scheduled(ctx, userID, time.Now())
+}
+
+// CancelScheduled cancels not yet effective changes of user, it reports number of cancelled ones.
+func (h *handler) CancelScheduled(ctx context.Context, userID int, ids []int, ch Change) (n int, err error) {
+	ctx, span := startSpan(ctx, "handler.CancelScheduled", userAttr(userID))
+	defer func() { endSpan(span, err) }()
+
+	return h.user.Cancel(withPrimary(ctx), userID, ids, ch)
+}
+
+// SetExpire replaces expiration of actual user state (nil - clears it), it reports false, if user
+// has no actual state.
+//
+// Expired revision falls back to previous one, which may still hold former expiration, so state,
+// that user would have after former expiration, is scheduled at the new one, when it is shortened.
+// Such reversion (marked with originExpire) is moved along with later changes of expiration (or
+// cancelled, if expiration is cleared), explicitly scheduled changes are left intact.
+func (h *handler) SetExpire(ctx context.Context, userID int, expire *time.Time, ch Change) (ok bool, err error) {
+	ctx, span := startSpan(ctx, "handler.SetExpire", userAttr(userID))
+	defer func() { endSpan(span, err) }()
+
+	ctx = withPrimary(ctx)
+
+	now := time.Now()
+
+	us, err := h.user.Get(ctx, userID, now)
+	if err != nil || len(us.Bundles) == 0 {
+		return false, err
+	}
+
+	var (
+		after  *UserSettings
+		revert []int
+	)
+
+	if us.Expire != nil && (expire == nil || !expire.Equal(*us.Expire)) {
+		sc, err := h.user.Scheduled(ctx, userID, now)
+		if err != nil {
+			return false, err
+		}
+
+		for _, c := range sc {
+			if c.Origin == originExpire && c.Start.Equal(*us.Expire) {
+				revert = append(revert, c.ID)
+			}
+		}
+
+		if expire != nil && (len(revert) > 0 || expire.Before(*us.Expire)) {
+			base, err := h.user.Get(ctx, userID, *us.Expire)
+			if err != nil {
+				return false, err
+			}
+
+			after = &base
+		}
+	}
+
+	if len(revert) > 0 {
+		if _, err = h.user.Cancel(ctx, userID, revert, ch); err != nil {
+			return false, err
+		}
+	}
+
+	us.Expire = expire
+
+	if err = h.user.Set(ctx, userID, us, ch); err != nil || after == nil {
+		return err == nil, err
+	}
+
+	ch.Start = expire
+	ch.Origin = originExpire
+
+	return true, h.user.Set(ctx, userID, *after, ch)
+}
+
+// Revert copies bundles of user revision, actual at `at` (nil - baseline with no bundles), forward as
+// a new revision (without expiration), it returns bundles user gets, dry run makes no change.
+func (h *handler) Revert(ctx context.Context, userID int, at *time.Time, dryRun bool, ch Change) (rv []Bundle, err error) {
+	ctx, span := startSpan(ctx, "handler.Revert", userAttr(userID))
+	defer func() { endSpan(span, err) }()
+
+	ctx = withPrimary(ctx)
+
+	var us UserSettings
+
+	if at != nil {
+		if us, err = h.user.Get(ctx, userID, *at); err != nil {
+			return nil, err
+		}
+
+		us.Expire = nil
+	}
+
+	if rv, err = h.setting.BundlesByID(ctx, us.Bundles); err != nil {
+		return nil, err
+	}
+
+	if rv == nil {
+		rv = []Bundle{}
+	}
+
+	if dryRun {
+		return rv, nil
+	}
+
+	return rv, h.user.Set(ctx, userID, us, ch)
+}
+
+// checkHierarchy checks, that none of bundles is an ancestor of another.
+func (h *handler) checkHierarchy(ctx context.Context, bundles []Bundle) error {
+	all, err := h.setting.BundlesList(ctx)
+	if err != nil {
+		return err
+	}
+
+	return CheckHierarchy(bundles, all)
+}
+
+func bundleIDs(bundles []Bundle) []int {
+	rv := make([]int, len(bundles))
+
+	for i := range bundles {
+		rv[i] = bundles[i].ID
+	}
+
+	return rv
+}
+
+func uniqueStrings(a []string) map[string]struct{} {
+	rv := make(map[string]struct{}, len(a))
+
+	for _, s := range a {
+		rv[s] = struct{}{}
+	}
+
+	return rv
+}
+
+// BundleTree returns bundles hierarchy, along with setting values of every bundle at `when`.
+func (h *handler) BundleTree(ctx context.Context, when time.Time) (rv []*BundleNode, err error) {
+	ctx, span := startSpan(ctx, "handler.BundleTree")
+	defer func() { endSpan(span, err) }()
+
+	all, err := h.setting.BundlesList(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	roots, index := buildBundleNodes(all)
+
+	if err = h.fillValues(ctx, when, index); err != nil {
+		return nil, err
+	}
+
+	if roots == nil {
+		roots = []*BundleNode{}
+	}
+
+	return roots, nil
+}
+
+// Bundle returns bundle by name (and tag, if given - names are unique only within tag), along with its
+// descendants and their setting values at `when`, nil - if there is no such bundle. Name of several
+// bundles, given without tag, is reported with errAmbiguousBundle.
+func (h *handler) Bundle(ctx context.Context, name string, tag *string, when time.Time) (rv *BundleNode, err error) {
+	ctx, span := startSpan(ctx, "handler.Bundle")
+	defer func() { endSpan(span, err) }()
+
+	all, err := h.setting.BundlesList(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	_, index := buildBundleNodes(all)
+
+	for i := range all {
+		if all[i].Name != name || (tag != nil && all[i].Tag != *tag) {
+			continue
+		}
+
+		if rv != nil {
+			return nil, errAmbiguousBundle
+		}
+
+		rv = index[all[i].ID]
+	}
+
+	if rv == nil {
+		return nil, nil
+	}
+
+	sub := make(map[int]*BundleNode)
+
+	rv.walk(func(n *BundleNode) { sub[n.ID] = n })
+
+	return rv, h.fillValues(ctx, when, sub)
+}
+
+// fillValues loads setting values of indexed bundles.
+func (h *handler) fillValues(ctx context.Context, when time.Time, index map[int]*BundleNode) error {
+	ids := make([]int, 0, len(index))
+
+	for id := range index {
+		ids = append(ids, id)
+	}
+
+	vals, err := h.setting.BundleValues(ctx, when, ids)
+	if err != nil {
+		return err
+	}
+
+	for id, vs := range vals {
+		if n, ok := index[id]; ok {
+			n.Values = vs
+		}
+	}
 
-	return h.user.Set(ctx, userID, us)
+	return nil
 }
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	hdrIdempotencyKey = "Idempotency-Key"
+	// maxIdempotencyKey is a maximum length of Idempotency-Key header value.
+	maxIdempotencyKey = 255
+	// idempotencyPurge is an interval between expired outcomes purges.
+	idempotencyPurge = time.Hour
+)
+
+// IdempotencyRecord holds outcome of request, made with idempotency key.
+type IdempotencyRecord struct {
+	// Hash identifies request, key was used with.
+	Hash string
+	// Status is an http status of response, zero - while request is in progress.
+	Status int
+	Body   []byte
+}
+
+// IdempotencyStore keeps outcomes of requests by idempotency keys, they are kept along with
+// users data, so user id selects shard.
+type IdempotencyStore interface {
+	// Claim reserves key for request with given hash, records created before `since` are
+	// replaced, if key is already taken, record of previous request is returned.
+	Claim(ctx context.Context, userID int, key, hash string, since time.Time) (*IdempotencyRecord, error)
+	// Complete stores outcome of request.
+	Complete(ctx context.Context, userID int, key string, status int, body []byte) error
+	// Release drops claim of failed request, so it can be retried.
+	Release(ctx context.Context, userID int, key string) error
+	// Purge removes records, created before `cutoff`.
+	Purge(ctx context.Context, cutoff time.Time) (int, error)
+}
+
+// idempotencyOf returns IdempotencyStore of user store, if it is one.
+func idempotencyOf(us UserStore) IdempotencyStore {
+	is, _ := us.(IdempotencyStore)
+
+	return is
+}
+
+// statusChanged is an outcome, recorded by UserStore.Set along with change, so request, that
+// made change, is never re-executed, even if its outcome was not stored.
+const statusChanged = http.StatusCreated
+
+type idempotencyKey struct{}
+
+// withIdempotencyKey returns copy of `ctx`, carrying claimed key.
+func withIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKey{}, key)
+}
+
+// claimedKey returns key, claimed by request, if any.
+func claimedKey(ctx context.Context) string {
+	key, _ := ctx.Value(idempotencyKey{}).(string)
+
+	return key
+}
+
+// sqlIdempotency is an IdempotencyStore over `user_settings_idempotency` table, its hooks adapt
+// it to particular database.
+type sqlIdempotency struct {
+	db sqlDB
+	// bind converts `?` placeholders to ones driver understands.
+	bind func(query string) string
+	// arg converts time to query argument.
+	arg func(t time.Time) interface{}
+	// insert is an insert query, that skips rows with existing keys.
+	insert string
+}
+
+const queryIdempotencyInsert = ` INTO user_settings_idempotency
+	(id_key, user_id, request_hash, status, created_at)
+VALUES
+	(?, ?, ?, 0, ?)`
+
+// Claim reserves key for request with given hash.
+func (si *sqlIdempotency) Claim(ctx context.Context, userID int, key, hash string, since time.Time) (*IdempotencyRecord, error) {
+	const (
+		queryExpire = `DELETE FROM user_settings_idempotency WHERE id_key = ? AND created_at < ?`
+		queryGet    = `SELECT request_hash, status, body FROM user_settings_idempotency WHERE id_key = ?`
+	)
+
+	if _, err := si.db.ExecContext(ctx, si.bind(queryExpire), key, si.arg(since)); err != nil {
+		return nil, err
+	}
+
+	res, err := si.db.ExecContext(ctx, si.bind(si.insert), key, userID, hash, si.arg(time.Now()))
+	if err != nil {
+		return nil, err
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n == 1 {
+		return nil, err
+	}
+
+	rec := IdempotencyRecord{}
+
+	err = si.db.QueryRowContext(withPrimary(ctx), si.bind(queryGet), key).Scan(&rec.Hash, &rec.Status, &rec.Body)
+	if err == sql.ErrNoRows { // expired and released meanwhile, report it as in progress.
+		return &IdempotencyRecord{Hash: hash}, nil
+	}
+
+	return &rec, err
+}
+
+// Complete stores outcome of request.
+func (si *sqlIdempotency) Complete(ctx context.Context, _ int, key string, status int, body []byte) error {
+	const query = `UPDATE user_settings_idempotency SET status = ?, body = ? WHERE id_key = ?`
+
+	_, err := si.db.ExecContext(ctx, si.bind(query), status, body, key)
+
+	return err
+}
+
+// Release drops claim of failed request.
+func (si *sqlIdempotency) Release(ctx context.Context, _ int, key string) error {
+	const query = `DELETE FROM user_settings_idempotency WHERE id_key = ? AND status = 0`
+
+	_, err := si.db.ExecContext(ctx, si.bind(query), key)
+
+	return err
+}
+
+// Purge removes records, created before `cutoff`.
+func (si *sqlIdempotency) Purge(ctx context.Context, cutoff time.Time) (int, error) {
+	const query = `DELETE FROM user_settings_idempotency WHERE created_at < ?`
+
+	res, err := si.db.ExecContext(ctx, si.bind(query), si.arg(cutoff))
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+
+	return int(n), err
+}
+
+// markChanged records statusChanged outcome for key, claimed by request (if any), within
+// transaction of change.
+func (si *sqlIdempotency) markChanged(ctx context.Context, tx *sql.Tx) error {
+	const query = `UPDATE user_settings_idempotency SET status = ? WHERE id_key = ? AND status = 0`
+
+	key := claimedKey(ctx)
+	if key == "" {
+		return nil
+	}
+
+	_, err := tx.ExecContext(ctx, si.bind(query), statusChanged, key)
+
+	return err
+}
+
+// idempotencyDigest returns hex-encoded sha256 of zero-separated parts.
+func idempotencyDigest(parts ...[]byte) string {
+	h := sha256.New()
+
+	for _, p := range parts {
+		h.Write(p)
+		h.Write([]byte{0})
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// idempotent makes `next` honour Idempotency-Key header: outcome of request is stored by key
+// (scoped by caller), retries with the same key and request get it back without re-execution,
+// while reuse of key for another request is rejected.
+func (svc *service) idempotent(next reqHandler) reqHandler {
+	if svc.idem == nil || svc.cfg.Idempotency.TTL <= 0 {
+		return next
+	}
+
+	return func(ctx context.Context, w io.Writer, rq *apiReq) int {
+		ri := reqInfoFrom(ctx)
+		if ri == nil || ri.IdempotencyKey == "" {
+			return next(ctx, w, rq)
+		}
+
+		if len(ri.IdempotencyKey) > maxIdempotencyKey {
+			return http.StatusBadRequest
+		}
+
+		body, err := json.Marshal(rq)
+		if err != nil {
+			return http.StatusBadRequest
+		}
+
+		var (
+			key  = idempotencyDigest([]byte(ri.Actor), []byte(ri.IdempotencyKey))
+			hash = idempotencyDigest([]byte(ri.Route), body)
+		)
+
+		rec, err := svc.idem.Claim(ctx, rq.UserID, key, hash, time.Now().Add(-svc.cfg.Idempotency.TTL))
+		if err != nil {
+			slog.ErrorContext(ctx, "idempotency claim", "err", err)
+
+			return http.StatusInternalServerError
+		}
+
+		if rec != nil {
+			return replayOutcome(ctx, w, rec, hash)
+		}
+
+		var buf bytes.Buffer
+
+		code := next(withIdempotencyKey(ctx, key), &buf, rq)
+
+		if code >= http.StatusInternalServerError {
+			err = svc.idem.Release(ctx, rq.UserID, key)
+		} else {
+			status := code
+			if status == 0 {
+				status = http.StatusOK
+			}
+
+			err = svc.idem.Complete(ctx, rq.UserID, key, status, buf.Bytes())
+		}
+
+		if err != nil {
+			slog.ErrorContext(ctx, "idempotency outcome", "err", err)
+		}
+
+		_, _ = buf.WriteTo(w)
+
+		return code
+	}
+}
+
+// replayOutcome writes stored outcome of previous request with the same key.
+func replayOutcome(ctx context.Context, w io.Writer, rec *IdempotencyRecord, hash string) int {
+	switch {
+	case rec.Hash != hash:
+		slog.WarnContext(ctx, "idempotency key reused for another request")
+
+		return http.StatusUnprocessableEntity
+	case rec.Status == 0:
+		return http.StatusConflict
+	case rec.Status == http.StatusOK:
+		_, _ = w.Write(rec.Body)
+
+		return 0
+	default:
+		slog.DebugContext(ctx, "idempotency replay", "status", rec.Status)
+
+		return rec.Status
+	}
+}
+
+// runIdempotencyPurge removes outcomes, older than `ttl`, until `ctx` is done.
+func runIdempotencyPurge(ctx context.Context, is IdempotencyStore, ttl time.Duration) {
+	tick := time.NewTicker(idempotencyPurge)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			n, err := is.Purge(ctx, time.Now().Add(-ttl))
+			if err != nil {
+				slog.ErrorContext(ctx, "idempotency purge", "err", err)
+			} else if n > 0 {
+				slog.InfoContext(ctx, "idempotency purge", "removed", n)
+			}
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServiceIdempotency(t *testing.T) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	var (
+		ctx = context.Background()
+		cfg = defaultConfig()
+		us  = NewMemoryUserStore(userStoreOptions{})
+		ts  = httptest.NewServer(newService(&cfg, us, NewMemorySettingStore(demoCatalog()), nil).routes())
+	)
+
+	t.Cleanup(ts.Close)
+
+	post := func(key, body string) int {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/set-bundles", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if key != "" {
+			req.Header.Set(hdrIdempotencyKey, key)
+		}
+
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp.Body.Close()
+
+		return resp.StatusCode
+	}
+
+	const body = `{"user_id": 1, "items": ["profit-jun"]}`
+
+	for i := 0; i < 2; i++ {
+		if code := post("k1", body); code != http.StatusCreated {
+			t.Fatal("step 1 fail:", i, code)
+		}
+	}
+
+	if recs, err := us.Audit(ctx, AuditFilter{UserID: 1}); err != nil || len(recs) != 1 {
+		t.Fatal("step 2 fail: retry re-executed", recs, err)
+	}
+
+	if code := post("k1", `{"user_id": 1, "items": ["profit-mid"]}`); code != http.StatusUnprocessableEntity {
+		t.Fatal("step 3 fail:", code)
+	}
+
+	// request in progress.
+	buf, _ := json.Marshal(&apiReq{UserID: 1, Items: []string{"profit-jun"}})
+
+	if _, err := us.(IdempotencyStore).Claim(ctx, 1, idempotencyDigest(nil, []byte("k2")),
+		idempotencyDigest([]byte("/set-bundles"), buf), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	if code := post("k2", body); code != http.StatusConflict {
+		t.Fatal("step 4 fail:", code)
+	}
+
+	if code := post(strings.Repeat("k", maxIdempotencyKey+1), body); code != http.StatusBadRequest {
+		t.Fatal("step 5 fail:", code)
+	}
+
+	for i := 0; i < 2; i++ {
+		if code := post("", body); code != http.StatusCreated {
+			t.Fatal("step 6 fail:", i, code)
+		}
+	}
+
+	if recs, _ := us.Audit(ctx, AuditFilter{UserID: 1}); len(recs) != 3 {
+		t.Fatal("step 7 fail: requests without key are not executed", recs)
+	}
+}
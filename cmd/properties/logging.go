@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	hdrRequestID    = "X-Request-ID"
+	maxRequestIDLen = 128
+)
+
+type ctxKey int
+
+const (
+	ctxKeyRequest ctxKey = iota
+)
+
+// reqInfo holds per-request data, shared between api wrappers, handlers and stores.
+type reqInfo struct {
+	ID     string
+	Actor  string
+	UserID int
+	// Route is a pattern of matched api method.
+	Route string
+	// IdempotencyKey is a value of Idempotency-Key header, if any.
+	IdempotencyKey string
+}
+
+// withReqInfo returns copy of `ctx`, carrying `ri`.
+func withReqInfo(ctx context.Context, ri *reqInfo) context.Context {
+	return context.WithValue(ctx, ctxKeyRequest, ri)
+}
+
+// reqInfoFrom extracts reqInfo from `ctx`, returns nil if none.
+func reqInfoFrom(ctx context.Context) (ri *reqInfo) {
+	ri, _ = ctx.Value(ctxKeyRequest).(*reqInfo)
+
+	return ri
+}
+
+// setUserID records user id for current request (if any), to be reported in access log.
+func setUserID(ctx context.Context, userID int) {
+	if ri := reqInfoFrom(ctx); ri != nil {
+		ri.UserID = userID
+	}
+}
+
+// requestID returns incoming request id if it looks sane, or generates new one.
+func requestID(incoming string) string {
+	if incoming != "" && len(incoming) <= maxRequestIDLen {
+		return incoming
+	}
+
+	var buf [16]byte
+
+	_, _ = rand.Read(buf[:])
+
+	return hex.EncodeToString(buf[:])
+}
+
+// ctxHandler is a slog.Handler, that adds request and trace ids (if any) to every record.
+type ctxHandler struct {
+	slog.Handler
+}
+
+func (h ctxHandler) Handle(ctx context.Context, r slog.Record) error {
+	if ri := reqInfoFrom(ctx); ri != nil {
+		r.AddAttrs(slog.String("request_id", ri.ID))
+	}
+
+	if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+		r.AddAttrs(slog.String("trace_id", sc.TraceID().String()))
+	}
+
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h ctxHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return ctxHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h ctxHandler) WithGroup(name string) slog.Handler {
+	return ctxHandler{h.Handler.WithGroup(name)}
+}
+
+// setupLogger sets default logger, writing json lines of given `level` (and above) to `w`.
+func setupLogger(w io.Writer, level string) error {
+	var lvl slog.Level
+
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return err
+	}
+
+	h := slog.NewJSONHandler(w, &slog.HandlerOptions{Level: lvl})
+
+	slog.SetDefault(slog.New(ctxHandler{h}))
+
+	return nil
+}
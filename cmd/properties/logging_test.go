@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestIDPropagation(t *testing.T) {
+	var logs bytes.Buffer
+
+	if err := setupLogger(&logs, levelInfo); err != nil {
+		t.Fatal(err)
+	}
+
+	defer slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	var seen string
+
+	h := getAPI(allowAll, func(_ io.Writer, r *http.Request) int {
+		setUserID(r.Context(), 42)
+
+		if ri := reqInfoFrom(r.Context()); ri != nil {
+			seen = ri.ID
+		}
+
+		return http.StatusTeapot
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/settings/42", nil)
+	req.Header.Set(hdrRequestID, "abc")
+
+	rec := httptest.NewRecorder()
+	h(rec, req)
+
+	if seen != "abc" || rec.Header().Get(hdrRequestID) != "abc" {
+		t.Fatal("step 1 fail: request id not propagated")
+	}
+
+	var line struct {
+		Msg       string `json:"msg"`
+		RequestID string `json:"request_id"`
+		UserID    int    `json:"user_id"`
+		Status    int    `json:"status"`
+	}
+
+	if err := json.Unmarshal(logs.Bytes(), &line); err != nil {
+		t.Fatal("step 2 fail:", err)
+	}
+
+	if line.Msg != "access" || line.RequestID != "abc" || line.UserID != 42 || line.Status != http.StatusTeapot {
+		t.Fatal("step 3 fail: bad access log", logs.String())
+	}
+
+	rec = httptest.NewRecorder()
+	h(rec, httptest.NewRequest(http.MethodGet, "/settings/42", nil))
+
+	if id := rec.Header().Get(hdrRequestID); id == "" || id == "abc" || id != seen {
+		t.Fatal("step 4 fail: request id not generated")
+	}
+}
@@ -1,44 +1,30 @@
 package main
 
 import (
-	"database/sql"
-	"fmt"
-	"log"
+	"context"
+	"io"
+	"log/slog"
 	"os"
 	"time"
-
-	_ "github.com/go-sql-driver/mysql"
 )
 
 const (
 	envDBUsers    = "APP_DB_USERS"
 	envDBSettings = "APP_DB_SETTINGS"
 	envAddr       = "APP_ADDR"
-	retryAttempts = 3
 )
 
-func mustGetEnv(key string) (val string) {
-	if val = os.Getenv(key); val == "" {
-		log.Fatal("no env value for:", key)
-	}
-
-	return
+// commands holds maintenance sub-commands, invoked as `properties <name> [args]`.
+var commands = map[string]func(args []string, getenv func(string) string, w io.Writer) error{
+	"migrate":          migrateCommand,
+	"backfill-current": backfillCommand,
+	"reshard":          reshardCommand,
+	"rewrite-payloads": rewriteCommand,
 }
 
-func connectDB(dsn string) (*sql.DB, error) {
-	db, err := sql.Open("mysql", dsn)
-	if err != nil {
-		return nil, err
-	}
-
-	return db, db.Ping()
-}
-
-func retry(times int, fn func() error) (err error) {
-	const delay = time.Millisecond * 500
-
+func retry(times int, delay time.Duration, fn func() error) (err error) {
 	for i := 0; i < times; i++ {
-		if err = fn(); err == nil || i == times {
+		if err = fn(); err == nil || i == times-1 {
 			return
 		}
 
@@ -48,64 +34,103 @@ func retry(times int, fn func() error) (err error) {
 	return
 }
 
-func serve(addr, userDSN, settingDSN string) (err error) {
-	var (
-		uDB *sql.DB
-		sDB *sql.DB
-	)
-
-	uDBConn := func() (err error) {
-		uDB, err = connectDB(userDSN)
-		return
+func serve(cfg *config) error {
+	us, uClose, err := openUserStore(cfg)
+	if err != nil {
+		return err
 	}
 
-	uDBClose := func() {
-		if err := uDB.Close(); err != nil {
-			log.Println("user-db close fail:", err)
-		}
-	}
+	defer uClose()
 
-	sDBConn := func() (err error) {
-		sDB, err = connectDB(settingDSN)
-		return
+	ss, sClose, err := openSettingStore(cfg)
+	if err != nil {
+		return err
 	}
 
-	sDBClose := func() {
-		if err := sDB.Close(); err != nil {
-			log.Println("setting-db close fail:", err)
-		}
+	defer sClose()
+
+	if cfg.Retention.Horizon > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		go runRetention(ctx, traceUserStore(us), &cfg.Retention)
 	}
 
-	if err = retry(retryAttempts, uDBConn); err != nil {
-		return fmt.Errorf("user-db connect fail: %w", err)
+	if is := idempotencyOf(us); is != nil && cfg.Idempotency.TTL > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		go runIdempotencyPurge(ctx, is, cfg.Idempotency.TTL)
 	}
 
-	defer uDBClose()
+	if cfg.Outbox.Broker != "" && cfg.Outbox.Relay {
+		rClose, err := startRelay(us, &cfg.Outbox)
+		if err != nil {
+			return err
+		}
 
-	if err = retry(retryAttempts, sDBConn); err != nil {
-		return fmt.Errorf("setting-db connect fail: %w", err)
+		defer rClose()
 	}
 
-	defer sDBClose()
+	sc, cClose := openSettingsCache(&cfg.Cache.Settings, traceSettingStore(ss))
+	defer cClose()
 
-	srv := newService(addr, uDB, sDB)
+	srv := newService(cfg, us, ss, sc)
 
-	log.Println("serving at:", addr)
+	slog.Info("serving", "addr", cfg.HTTP.Addr)
 
 	return srv.Serve()
 }
 
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
+}
+
 func main() {
-	userDSN := mustGetEnv(envDBUsers)
-	settingDSN := mustGetEnv(envDBSettings)
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			if err := cmd(os.Args[2:], os.Getenv, os.Stdout); err != nil {
+				fatal(os.Args[1], err)
+			}
+
+			return
+		}
+	}
+
+	cfg, printOnly, err := loadConfig(os.Args[1:], os.Getenv)
+	if err != nil {
+		fatal("config", err)
+	}
+
+	if printOnly {
+		if err = cfg.Print(os.Stdout); err != nil {
+			fatal("print config", err)
+		}
 
-	var addr string
+		if err = cfg.Validate(); err != nil {
+			fatal("config", err)
+		}
+
+		return
+	}
 
-	if addr = os.Getenv(envAddr); addr == "" {
-		addr = "0.0.0.0:8080"
+	if err = setupLogger(os.Stderr, cfg.Log.Level); err != nil {
+		fatal("logger", err)
 	}
 
-	if err := serve(addr, userDSN, settingDSN); err != nil {
-		log.Fatal(err)
+	shutdown, err := setupTracing(context.Background(), &cfg.Tracing)
+	if err != nil {
+		fatal("tracing", err)
+	}
+
+	err = serve(&cfg)
+
+	if serr := shutdown(context.Background()); serr != nil {
+		slog.Error("tracing shutdown", "err", serr)
+	}
+
+	if err != nil {
+		fatal("serve", err)
 	}
 }
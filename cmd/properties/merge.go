@@ -1,44 +1,162 @@
 package main
 
-// MergeBundles merges two bundles together, takes care of parent-child relations,
-// returns list of bundle ids.
-func MergeBundles(curb, newb []Bundle) (merged []int) {
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// errBundleHierarchy reports ancestor and its descendant, requested together.
+var errBundleHierarchy = errors.New("bundles hierarchy conflict")
+
+// bundleTree holds parent of every known bundle.
+type bundleTree map[int]int
+
+// newBundleTree builds tree from bundles lists, usually - from the whole catalog
+// and bundles in question (to not miss their own parents).
+func newBundleTree(lists ...[]Bundle) bundleTree {
+	t := bundleTree{}
+
+	for _, l := range lists {
+		for i := 0; i < len(l); i++ {
+			t[l[i].ID] = l[i].ParentID
+		}
+	}
+
+	return t
+}
+
+// walkUp calls `fn` for every ancestor of bundle `id`, nearest first, until it returns false.
+// Depth is limited by tree size, so cycles in broken catalog end the walk.
+func (t bundleTree) walkUp(id int, fn func(pid int) bool) {
+	for pid, depth := t[id], 0; pid != 0 && depth < len(t); pid, depth = t[pid], depth+1 {
+		if !fn(pid) {
+			return
+		}
+	}
+}
+
+// isAncestor reports whenever `a` is an ancestor of `b`.
+func (t bundleTree) isAncestor(a, b int) (ok bool) {
+	t.walkUp(b, func(pid int) bool {
+		ok = pid == a
+
+		return !ok
+	})
+
+	return ok
+}
+
+// rooted reports whenever walk up from bundle reaches root, instead of running into cycle.
+func (t bundleTree) rooted(id int) bool {
+	pid := t[id]
+
+	for depth := 0; pid != 0 && depth < len(t); depth++ {
+		pid = t[pid]
+	}
+
+	return pid == 0
+}
+
+// related reports whenever one of bundles is an ancestor of another.
+func (t bundleTree) related(a, b int) bool {
+	return t.isAncestor(a, b) || t.isAncestor(b, a)
+}
+
+// normalize drops bundles, that are ancestors of other ones in set, so every branch
+// is represented by its deepest bundle only.
+func (t bundleTree) normalize(set map[int]struct{}) {
+	for id := range set {
+		t.walkUp(id, func(pid int) bool {
+			delete(set, pid)
+
+			return true
+		})
+	}
+}
+
+// MergeBundles merges new bundles into current ones over the bundle tree (`catalog` holds all
+// known bundles), returns sorted list of bundle ids, none of which is an ancestor of another:
+//
+//   - new bundle replaces any current one on its branch: its ancestors (upgrade) and
+//     descendants (downgrade);
+//   - siblings (and other bundles without ancestry relation) are independent, they are kept
+//     along with each other;
+//   - when new (or current) bundles hold both ancestor and descendant, the deepest one wins.
+func MergeBundles(curb, newb, catalog []Bundle) []int {
 	var (
-		childs = map[int]int{}
-		set    = map[int]struct{}{}
+		tree = newBundleTree(catalog, curb, newb)
+		set  = make(map[int]struct{}, len(curb)+len(newb))
 	)
 
-	// step 1: iterate new ones, collecting id's
-	// and parent-child connections (if any)
-	for i := 0; i < len(newb); i++ {
-		var (
-			b        = &newb[i]
-			bid, pid = b.ID, b.ParentID
-		)
+	for i := 0; i < len(curb); i++ {
+		cid, keep := curb[i].ID, true
 
-		set[bid] = struct{}{}
+		for j := 0; j < len(newb) && keep; j++ {
+			keep = cid != newb[j].ID && !tree.related(cid, newb[j].ID)
+		}
 
-		if pid != 0 {
-			childs[pid] = bid
+		if keep {
+			set[cid] = struct{}{}
 		}
 	}
 
-	// step 2: iterate current state
+	for i := 0; i < len(newb); i++ {
+		set[newb[i].ID] = struct{}{}
+	}
+
+	tree.normalize(set)
+
+	return sortedIDs(set)
+}
+
+// DropBundles removes elements of `cutb` from `curb` over the bundle tree (`catalog` holds all
+// known bundles), returns sorted list of bundle ids, none of which is an ancestor of another.
+//
+// Removed bundle is replaced by its nearest ancestor, that is not removed as well (if any), in
+// `chain` mode whole branch is dropped instead: removed bundle, along with held descendants of
+// removed ones, leaves no replacement.
+func DropBundles(curb, cutb, catalog []Bundle, chain bool) []int {
+	var (
+		tree = newBundleTree(catalog, curb, cutb)
+		cut  = make(map[int]struct{}, len(cutb))
+		set  = make(map[int]struct{}, len(curb))
+	)
+
+	for i := 0; i < len(cutb); i++ {
+		cut[cutb[i].ID] = struct{}{}
+	}
+
 	for i := 0; i < len(curb); i++ {
-		var (
-			b        = &curb[i]
-			bid, pid = b.ID, b.ParentID
-			ok       bool
-		)
-
-		if _, ok = childs[bid]; ok {
-			// if our child already in set - downgrade mode, skip self
-			continue
-		}
+		bid := curb[i].ID
+
+		_, drop := cut[bid]
+
+		switch {
+		case chain:
+			if !drop {
+				tree.walkUp(bid, func(pid int) bool {
+					_, drop = cut[pid]
 
-		if pid != 0 {
-			if _, ok = set[pid]; ok {
-				// if our parent already in set - upgrade mode, skip self
+					return !drop
+				})
+			}
+
+			if drop {
+				continue
+			}
+		case drop:
+			bid = 0
+
+			tree.walkUp(curb[i].ID, func(pid int) bool {
+				if _, ok := cut[pid]; !ok {
+					bid = pid
+				}
+
+				return bid == 0
+			})
+
+			if bid == 0 {
 				continue
 			}
 		}
@@ -46,42 +164,94 @@ func MergeBundles(curb, newb []Bundle) (merged []int) {
 		set[bid] = struct{}{}
 	}
 
-	for k := range set {
-		merged = append(merged, k)
+	tree.normalize(set)
+
+	return sortedIDs(set)
+}
+
+// sortedIDs returns sorted ids of set.
+func sortedIDs(set map[int]struct{}) []int {
+	rv := make([]int, 0, len(set))
+
+	for id := range set {
+		rv = append(rv, id)
 	}
 
-	return merged
+	sort.Ints(rv)
+
+	return rv
 }
 
-// DropBundles removes elements of `cutb` from `curb`, takes care of parent-child relations,
-// returns list of bundle ids.
-func DropBundles(curb, cutb []Bundle) (merged []int) {
-	var set = map[int]struct{}{}
+// BundleNode is a bundle with its setting values and children.
+type BundleNode struct {
+	Bundle
+	Values   []Setting     `json:"values"`
+	Children []*BundleNode `json:"children,omitempty"`
+}
 
-	// step 1: iterate cut set, collecting id's
-	for i := 0; i < len(cutb); i++ {
-		var (
-			b   = &cutb[i]
-			bid = b.ID
-		)
+// buildBundleNodes arranges bundles into forest, returning roots (bundles without known parent)
+// and nodes index by bundle id, children keep order of `bundles`. Bundles, that do not lead to
+// root (caught in, or hanging from, parent cycle of broken catalog), are roots without children,
+// so every node is reachable once.
+func buildBundleNodes(bundles []Bundle) (roots []*BundleNode, index map[int]*BundleNode) {
+	var tree = newBundleTree(bundles)
 
-		set[bid] = struct{}{}
+	index = make(map[int]*BundleNode, len(bundles))
+
+	for i := 0; i < len(bundles); i++ {
+		index[bundles[i].ID] = &BundleNode{Bundle: bundles[i], Values: []Setting{}}
 	}
 
-	// step 2: iterate current state
-	for i := 0; i < len(curb); i++ {
-		var (
-			b   = &curb[i]
-			bid = b.ID
-		)
-
-		// replace bundle id with parent upon deletion
-		if _, ok := set[bid]; ok {
-			bid = b.ParentID
+	for i := 0; i < len(bundles); i++ {
+		n := index[bundles[i].ID]
+
+		if p, ok := index[n.ParentID]; ok && tree.rooted(n.ID) {
+			p.Children = append(p.Children, n)
+		} else {
+			roots = append(roots, n)
 		}
+	}
+
+	return roots, index
+}
+
+// walk calls `fn` for node and all its descendants, depth first.
+func (n *BundleNode) walk(fn func(*BundleNode)) {
+	fn(n)
+
+	for _, c := range n.Children {
+		c.walk(fn)
+	}
+}
+
+// CheckHierarchy checks, that none of `bundles` is an ancestor of another, ancestry is resolved
+// through `catalog`.
+func CheckHierarchy(bundles, catalog []Bundle) (err error) {
+	var (
+		tree  = newBundleTree(catalog, bundles)
+		names = make(map[int]string, len(catalog))
+		set   = make(map[int]struct{}, len(bundles))
+	)
+
+	for i := 0; i < len(catalog); i++ {
+		names[catalog[i].ID] = catalog[i].Name
+	}
+
+	for i := 0; i < len(bundles); i++ {
+		set[bundles[i].ID] = struct{}{}
+	}
+
+	for i := 0; i < len(bundles) && err == nil; i++ {
+		b := &bundles[i]
+
+		tree.walkUp(b.ID, func(pid int) bool {
+			if _, ok := set[pid]; ok {
+				err = fmt.Errorf("%w: '%s' is an ancestor of '%s'", errBundleHierarchy, names[pid], b.Name)
+			}
 
-		merged = append(merged, bid)
+			return err == nil
+		})
 	}
 
-	return merged
+	return err
 }
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"errors"
+	"math/rand/v2"
+	"slices"
 	"testing"
 )
 
@@ -10,7 +13,7 @@ func TestMergeBundles(t *testing.T) {
 		c    []int
 	)
 
-	c = MergeBundles(a, b)
+	c = MergeBundles(a, b, nil)
 	if len(c) != 0 {
 		t.Fatal("step 1 fail")
 	}
@@ -19,7 +22,7 @@ func TestMergeBundles(t *testing.T) {
 		{ID: 1, Name: "a1"},
 	}
 
-	c = MergeBundles(a, b)
+	c = MergeBundles(a, b, nil)
 	if len(c) != 1 || c[0] != 1 {
 		t.Fatal("step 2 fail")
 	}
@@ -28,33 +31,156 @@ func TestMergeBundles(t *testing.T) {
 		{ID: 2, Name: "b1", ParentID: 1},
 	}
 
-	c = MergeBundles(a, b)
+	c = MergeBundles(a, b, nil)
 	if len(c) != 1 || c[0] != 2 {
 		t.Fatal("step 3 fail")
 	}
 
 	a = append(a, Bundle{ID: 3, Name: "a2", ParentID: 4})
 
-	c = MergeBundles(a, b)
+	c = MergeBundles(a, b, nil)
 	if len(c) != 2 {
 		t.Fatal("step 4 fail")
 	}
 
 	b = append(b, Bundle{ID: 4, Name: "b2"})
 
-	c = MergeBundles(a, b)
+	c = MergeBundles(a, b, nil)
 	if len(c) != 2 {
 		t.Fatal("step 5 fail")
 	}
 }
 
+func TestMergeBundlesTree(t *testing.T) {
+	all := demoCatalog().Bundles
+
+	byID := func(ids ...int) (rv []Bundle) {
+		for _, id := range ids {
+			rv = append(rv, all[id-1])
+		}
+
+		return rv
+	}
+
+	for i, c := range []struct {
+		cur, add, want []int
+	}{
+		{[]int{1}, []int{3}, []int{3}},                // grand-child upgrade
+		{[]int{3}, []int{1}, []int{1}},                // grand-parent downgrade
+		{[]int{1, 3}, []int{5}, []int{3, 5}},          // broken state is normalized
+		{[]int{1, 5}, []int{2, 3}, []int{3, 5}},       // deepest new one wins
+		{[]int{2, 6}, []int{3}, []int{3, 6}},          // other branches are kept
+		{[]int{2}, []int{2}, []int{2}},                // same one
+		{[]int{4, 7}, []int{1, 5, 8}, []int{1, 5, 8}}, // several downgrades
+	} {
+		if got := MergeBundles(byID(c.cur...), byID(c.add...), all); !slices.Equal(got, c.want) {
+			t.Fatalf("step %d fail: want %v got %v", i+1, c.want, got)
+		}
+	}
+
+	// siblings
+	tree := []Bundle{{ID: 1}, {ID: 2, ParentID: 1}, {ID: 3, ParentID: 1}, {ID: 4, ParentID: 2}}
+
+	if got := MergeBundles(tree[3:4], tree[2:3], tree); !slices.Equal(got, []int{3, 4}) {
+		t.Fatal("siblings fail:", got)
+	}
+}
+
+// randomForest returns bundles forest of up to `n` bundles, parent always precedes child.
+func randomForest(r *rand.Rand, n int) []Bundle {
+	rv := make([]Bundle, 1+r.IntN(n))
+
+	for i := range rv {
+		rv[i].ID = i + 1
+
+		if i > 0 && r.IntN(4) > 0 {
+			rv[i].ParentID = 1 + r.IntN(i)
+		}
+	}
+
+	return rv
+}
+
+// randomSubset returns random (possibly empty) subset of bundles.
+func randomSubset(r *rand.Rand, all []Bundle) (rv []Bundle) {
+	for _, b := range all {
+		if r.IntN(4) == 0 {
+			rv = append(rv, b)
+		}
+	}
+
+	return rv
+}
+
+func TestMergeBundlesProperties(t *testing.T) {
+	r := rand.New(rand.NewPCG(1, 2))
+
+	for i := 0; i < 2000; i++ {
+		var (
+			all  = randomForest(r, 30)
+			cur  = randomSubset(r, all)
+			add  = randomSubset(r, all)
+			tree = newBundleTree(all)
+			got  = MergeBundles(cur, add, all)
+			set  = intSet(got)
+			res  = make([]Bundle, len(got))
+		)
+
+		for j, id := range got {
+			res[j] = all[id-1]
+		}
+
+		hasDescendant := func(id int, in []Bundle) bool {
+			return slices.ContainsFunc(in, func(b Bundle) bool { return tree.isAncestor(id, b.ID) })
+		}
+
+		if !slices.IsSorted(got) || len(set) != len(got) {
+			t.Fatalf("round %d: not sorted or has duplicates: %v", i, got)
+		}
+
+		// no ancestor along with its descendant.
+		if err := CheckHierarchy(res, all); err != nil {
+			t.Fatalf("round %d: %v (cur %v add %v got %v)", i, err, cur, add, got)
+		}
+
+		for _, id := range got {
+			if !slices.ContainsFunc(cur, func(b Bundle) bool { return b.ID == id }) &&
+				!slices.ContainsFunc(add, func(b Bundle) bool { return b.ID == id }) {
+				t.Fatalf("round %d: %d came from nowhere", i, id)
+			}
+		}
+
+		// new bundles are all kept, but replaced by their new descendants.
+		for _, b := range add {
+			if _, ok := set[b.ID]; ok == hasDescendant(b.ID, add) {
+				t.Fatalf("round %d: new %d kept %v (cur %v add %v got %v)", i, b.ID, ok, cur, add, got)
+			}
+		}
+
+		// current bundles are kept, unless related to new ones, or replaced by their descendants.
+		for _, b := range cur {
+			related := slices.ContainsFunc(add, func(n Bundle) bool { return n.ID == b.ID || tree.related(n.ID, b.ID) })
+			want := !related && !hasDescendant(b.ID, cur)
+
+			if _, ok := set[b.ID]; ok != want && !slices.ContainsFunc(add, func(n Bundle) bool { return n.ID == b.ID }) {
+				t.Fatalf("round %d: current %d kept %v (cur %v add %v got %v)", i, b.ID, ok, cur, add, got)
+			}
+		}
+
+		// merging the same again changes nothing.
+		if again := MergeBundles(res, add, all); !slices.Equal(again, got) {
+			t.Fatalf("round %d: not idempotent: %v then %v", i, got, again)
+		}
+	}
+}
+
 func TestDropBundles(t *testing.T) {
 	var (
 		a, b []Bundle
 		c    []int
 	)
 
-	c = DropBundles(a, b)
+	c = DropBundles(a, b, nil, false)
 	if len(c) != 0 {
 		t.Fatal("step 1 fail")
 	}
@@ -63,12 +189,12 @@ func TestDropBundles(t *testing.T) {
 		{ID: 1, Name: "a1"},
 	}
 
-	c = DropBundles(a, b)
+	c = DropBundles(a, b, nil, false)
 	if len(c) != 1 || c[0] != 1 {
 		t.Fatal("step 2 fail")
 	}
 
-	c = DropBundles(b, a)
+	c = DropBundles(b, a, nil, false)
 	if len(c) != 0 {
 		t.Fatal("step 3 fail")
 	}
@@ -77,13 +203,113 @@ func TestDropBundles(t *testing.T) {
 		{ID: 2, Name: "b1", ParentID: 1},
 	}
 
-	c = DropBundles(a, b)
+	c = DropBundles(a, b, nil, false)
 	if len(c) != 1 || c[0] != 1 {
 		t.Fatal("step 4 fail")
 	}
 
-	c = DropBundles(b, b)
+	c = DropBundles(b, b, nil, false)
 	if len(c) != 1 || c[0] != 1 {
 		t.Fatal("step 5 fail")
 	}
 }
+
+// TestDropBundlesChain checks every held bundle of `profit-*` chain against every cut set,
+// in both modes.
+func TestDropBundlesChain(t *testing.T) {
+	var (
+		all   = demoCatalog().Bundles
+		chain = all[:4] // profit-jun <- profit-mid <- profit-sen <- profit-god
+	)
+
+	for held := 0; held <= len(chain); held++ {
+		for mask := 0; mask < 1<<len(chain); mask++ {
+			var cur, cut []Bundle
+
+			if held > 0 {
+				cur = chain[held-1 : held]
+			}
+
+			for i := range chain {
+				if mask&(1<<i) != 0 {
+					cut = append(cut, chain[i])
+				}
+			}
+
+			// downgrade: nearest not removed ancestor (or self, if not removed).
+			var down []int
+
+			for i := held; i > 0; i-- {
+				if mask&(1<<(i-1)) == 0 {
+					down = []int{i}
+
+					break
+				}
+			}
+
+			// chain: removed self or any ancestor (lower bits) drops branch.
+			var whole []int
+
+			if held > 0 && mask&((1<<held)-1) == 0 {
+				whole = []int{held}
+			}
+
+			if got := DropBundles(cur, cut, all, false); !slices.Equal(got, down) {
+				t.Fatalf("downgrade: held %d cut %04b: want %v got %v", held, mask, down, got)
+			}
+
+			if got := DropBundles(cur, cut, all, true); !slices.Equal(got, whole) {
+				t.Fatalf("chain: held %d cut %04b: want %v got %v", held, mask, whole, got)
+			}
+		}
+	}
+
+	// broken state, holding several bundles of chain, is deduplicated and normalized.
+	if got := DropBundles(all[1:4], all[1:4], all, false); !slices.Equal(got, []int{1}) {
+		t.Fatal("dedupe fail:", got)
+	}
+
+	if got := DropBundles([]Bundle{all[0], all[2], all[6]}, all[2:3], all, false); !slices.Equal(got, []int{2, 7}) {
+		t.Fatal("normalize fail:", got)
+	}
+
+	if got := DropBundles([]Bundle{all[2], all[6]}, all[4:5], all, true); !slices.Equal(got, []int{3}) {
+		t.Fatal("chain ancestor fail:", got)
+	}
+}
+
+func TestCheckHierarchy(t *testing.T) {
+	all := demoCatalog().Bundles
+
+	byID := func(ids ...int) (rv []Bundle) {
+		for _, id := range ids {
+			rv = append(rv, all[id-1])
+		}
+
+		return rv
+	}
+
+	if err := CheckHierarchy(nil, all); err != nil {
+		t.Fatal("step 1 fail", err)
+	}
+
+	if err := CheckHierarchy(byID(3, 5, 9, 12), all); err != nil {
+		t.Fatal("step 2 fail", err)
+	}
+
+	if err := CheckHierarchy(byID(1, 2), all); !errors.Is(err, errBundleHierarchy) {
+		t.Fatal("step 3 fail", err)
+	}
+
+	// grand-parent
+	if err := CheckHierarchy(byID(5, 7), all); !errors.Is(err, errBundleHierarchy) {
+		t.Fatal("step 4 fail", err)
+	}
+
+	// broken catalog with cycle
+	loop := []Bundle{{ID: 1, ParentID: 2}, {ID: 2, ParentID: 1}, {ID: 3, ParentID: 1}}
+
+	if err := CheckHierarchy(loop[2:], loop); err != nil {
+		t.Fatal("step 5 fail", err)
+	}
+}
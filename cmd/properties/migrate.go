@@ -0,0 +1,445 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// migrations are laid out as `migrations/<backend>/<schema>/NNNN_name.(up|down).sql`.
+//
+//go:embed migrations
+var migrationsFS embed.FS
+
+// schemas, each one is a separate set of migrations.
+const (
+	schemaUsers    = "users"
+	schemaSettings = "settings"
+)
+
+const migrationsTable = "schema_migrations"
+
+var (
+	reMigrationFile = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+	reStatementEnd  = regexp.MustCompile(`;[ \t]*(\r?\n|$)`)
+
+	errSchemaMismatch = errors.New("schema version mismatch")
+)
+
+// migration is a single versioned schema change.
+type migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// loadMigrations reads migrations from `dir`, they must be numbered from 1 without gaps
+// and have both up and down steps.
+func loadMigrations(fsys fs.FS, dir string) (rv []migration, err error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*migration)
+
+	for _, e := range entries {
+		m := reMigrationFile.FindStringSubmatch(e.Name())
+		if e.IsDir() || m == nil {
+			return nil, fmt.Errorf("%s: unexpected entry '%s'", dir, e.Name())
+		}
+
+		ver, _ := strconv.Atoi(m[1])
+
+		mg, ok := byVersion[ver]
+		if !ok {
+			mg = &migration{Version: ver, Name: m[2]}
+			byVersion[ver] = mg
+		}
+
+		if mg.Name != m[2] {
+			return nil, fmt.Errorf("%s: version %d has different names: '%s' and '%s'", dir, ver, mg.Name, m[2])
+		}
+
+		buf, err := fs.ReadFile(fsys, path.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		if m[3] == "up" {
+			mg.Up = string(buf)
+		} else {
+			mg.Down = string(buf)
+		}
+	}
+
+	for _, mg := range byVersion {
+		if strings.TrimSpace(mg.Up) == "" || strings.TrimSpace(mg.Down) == "" {
+			return nil, fmt.Errorf("%s: version %d lacks up or down step", dir, mg.Version)
+		}
+
+		rv = append(rv, *mg)
+	}
+
+	sort.Slice(rv, func(i, j int) bool { return rv[i].Version < rv[j].Version })
+
+	for i := range rv {
+		if rv[i].Version != i+1 {
+			return nil, fmt.Errorf("%s: version %d is missing", dir, i+1)
+		}
+	}
+
+	return rv, nil
+}
+
+// splitStatements splits sql script to separate statements, dropping comment-only ones.
+func splitStatements(script string) (rv []string) {
+	for _, stmt := range reStatementEnd.Split(script, -1) {
+		var code bool
+
+		for _, line := range strings.Split(stmt, "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "--") {
+				code = true
+
+				break
+			}
+		}
+
+		if code {
+			rv = append(rv, strings.TrimSpace(stmt))
+		}
+	}
+
+	return rv
+}
+
+// migrator applies migrations of single schema to database.
+type migrator struct {
+	db      *sql.DB
+	backend string
+	steps   []migration
+}
+
+func newMigrator(db *sql.DB, backend, schema string) (*migrator, error) {
+	steps, err := loadMigrations(migrationsFS, path.Join("migrations", backend, schema))
+	if err != nil {
+		return nil, err
+	}
+
+	return &migrator{db: db, backend: backend, steps: steps}, nil
+}
+
+// Latest returns version, this build expects.
+func (m *migrator) Latest() int {
+	return len(m.steps)
+}
+
+// Version returns current database schema version, 0 - for empty database.
+func (m *migrator) Version(ctx context.Context) (ver int, err error) {
+	var query string
+
+	switch m.backend {
+	case backendSQLite:
+		query = `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`
+	case backendPostgres:
+		query = `SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = $1`
+	default:
+		query = `SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = ?`
+	}
+
+	var n int
+
+	if err = m.db.QueryRowContext(ctx, query, migrationsTable).Scan(&n); err != nil || n == 0 {
+		return 0, err
+	}
+
+	err = m.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM `+migrationsTable).Scan(&ver)
+
+	return ver, err
+}
+
+// Check reports errSchemaMismatch, if database schema version differs from expected one.
+func (m *migrator) Check(ctx context.Context) error {
+	ver, err := m.Version(ctx)
+	if err != nil {
+		return err
+	}
+
+	if ver != m.Latest() {
+		return fmt.Errorf("%w: database has %d, want %d", errSchemaMismatch, ver, m.Latest())
+	}
+
+	return nil
+}
+
+// Up applies pending migrations up to `target` version, each one in its own transaction
+// (note: MySQL commits DDL implicitly, so failed step may be applied partially).
+func (m *migrator) Up(ctx context.Context, target int) error {
+	if target < 0 || target > m.Latest() {
+		return fmt.Errorf("up: target version %d out of range [0, %d]", target, m.Latest())
+	}
+
+	if err := m.ensureTable(ctx); err != nil {
+		return err
+	}
+
+	ver, err := m.Version(ctx)
+	if err != nil {
+		return err
+	}
+
+	if ver > m.Latest() {
+		return fmt.Errorf("up: database version %d is newer than known %d", ver, m.Latest())
+	}
+
+	if ver >= target {
+		return nil
+	}
+
+	for _, s := range m.steps[ver:target] {
+		slog.Info("migrate up", "version", s.Version, "name", s.Name)
+
+		err = m.apply(ctx, s.Up, `INSERT INTO `+migrationsTable+` (version, name) VALUES (?, ?)`, s.Version, s.Name)
+		if err != nil {
+			return fmt.Errorf("up %04d_%s: %w", s.Version, s.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Down reverts applied migrations down to `target` version (0 - reverts all of them).
+func (m *migrator) Down(ctx context.Context, target int) error {
+	ver, err := m.Version(ctx)
+	if err != nil {
+		return err
+	}
+
+	if target < 0 || target > ver {
+		return fmt.Errorf("down: target version %d out of range [0, %d]", target, ver)
+	}
+
+	if ver > m.Latest() {
+		return fmt.Errorf("down: database version %d is newer than known %d", ver, m.Latest())
+	}
+
+	for i := ver - 1; i >= target; i-- {
+		s := m.steps[i]
+
+		slog.Info("migrate down", "version", s.Version, "name", s.Name)
+
+		err = m.apply(ctx, s.Down, `DELETE FROM `+migrationsTable+` WHERE version = ?`, s.Version)
+		if err != nil {
+			return fmt.Errorf("down %04d_%s: %w", s.Version, s.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Status writes applied and pending migrations to `w`.
+func (m *migrator) Status(ctx context.Context, w io.Writer) error {
+	ver, err := m.Version(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range m.steps {
+		state := "pending"
+		if s.Version <= ver {
+			state = "applied"
+		}
+
+		if _, err = fmt.Fprintf(w, "%04d_%s\t%s\n", s.Version, s.Name, state); err != nil {
+			return err
+		}
+	}
+
+	if ver > m.Latest() {
+		_, err = fmt.Fprintf(w, "database version %d is newer than known %d\n", ver, m.Latest())
+	}
+
+	return err
+}
+
+func (m *migrator) ensureTable(ctx context.Context) error {
+	const query = `
+CREATE TABLE IF NOT EXISTS ` + migrationsTable + `(
+    version    INT NOT NULL PRIMARY KEY,
+    name       VARCHAR(255) NOT NULL,
+    applied_at %s NOT NULL DEFAULT CURRENT_TIMESTAMP
+)`
+
+	ts := "DATETIME"
+	if m.backend == backendPostgres {
+		ts = "TIMESTAMPTZ"
+	}
+
+	_, err := m.db.ExecContext(ctx, fmt.Sprintf(query, ts))
+
+	return err
+}
+
+// apply runs script and version bookkeeping query in single transaction.
+func (m *migrator) apply(ctx context.Context, script, query string, args ...interface{}) (err error) {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	for _, stmt := range splitStatements(script) {
+		if _, err = tx.ExecContext(ctx, stmt); err != nil {
+			return
+		}
+	}
+
+	if m.backend == backendPostgres {
+		query = rebind(query)
+	}
+
+	if _, err = tx.ExecContext(ctx, query, args...); err != nil {
+		return
+	}
+
+	return tx.Commit()
+}
+
+// migrateCommand implements `migrate [flags] up [N] | down [N] | status` command, by default
+// `up` applies all pending migrations, `down` reverts the last applied one.
+func migrateCommand(args []string, getenv func(string) string, w io.Writer) error {
+	var (
+		fs     = flag.NewFlagSet("migrate", flag.ContinueOnError)
+		path   = fs.String("config", getenv(envConfig), "path to yaml config file")
+		schema = fs.String("db", "", "database to migrate: users or settings (default both)")
+	)
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	cmd, target, err := parseMigrateArgs(fs.Args())
+	if err != nil {
+		return err
+	}
+
+	cfg, err := readConfig(*path, getenv)
+	if err != nil {
+		return err
+	}
+
+	if err = cfg.Validate(); err != nil {
+		return err
+	}
+
+	for _, d := range []struct {
+		schema string
+		cfg    *dbConfig
+	}{
+		{schemaUsers, &cfg.DB.Users},
+		{schemaSettings, &cfg.DB.Settings},
+	} {
+		if *schema != "" && *schema != d.schema {
+			continue
+		}
+
+		if err = migrateDB(&cfg, d.cfg, d.schema, cmd, target, w); err != nil {
+			return fmt.Errorf("%s: %w", d.schema, err)
+		}
+	}
+
+	return nil
+}
+
+// parseMigrateArgs parses command and its optional target version, -1 - default target.
+func parseMigrateArgs(args []string) (cmd string, target int, err error) {
+	target = -1
+
+	if len(args) == 0 || len(args) > 2 {
+		return "", 0, errors.New("usage: migrate [flags] up [N] | down [N] | status")
+	}
+
+	switch cmd = args[0]; cmd {
+	case "up", "down":
+	case "status":
+		if len(args) > 1 {
+			return "", 0, errors.New("status: unexpected argument")
+		}
+	default:
+		return "", 0, fmt.Errorf("unknown command '%s'", cmd)
+	}
+
+	if len(args) > 1 {
+		if target, err = strconv.Atoi(args[1]); err != nil || target < 0 {
+			return "", 0, fmt.Errorf("%s: bad version '%s'", cmd, args[1])
+		}
+	}
+
+	return cmd, target, nil
+}
+
+func migrateDB(cfg *config, dbc *dbConfig, schema, cmd string, target int, w io.Writer) error {
+	ctx := context.Background()
+
+	backend := backendOf(dbc.DSN)
+	if backend == backendMemory {
+		slog.Warn("in-memory store has no schema, skipping", "db", schema)
+
+		return nil
+	}
+
+	db, closeFn, err := openDB(cfg, dbc, backend, schema+"-db")
+	if err != nil {
+		return err
+	}
+
+	defer closeFn()
+
+	m, err := newMigrator(db, backend, schema)
+	if err != nil {
+		return err
+	}
+
+	switch cmd {
+	case "up":
+		if target < 0 {
+			target = m.Latest()
+		}
+
+		return m.Up(ctx, target)
+	case "down":
+		if target < 0 {
+			ver, err := m.Version(ctx)
+			if err != nil || ver == 0 {
+				return err
+			}
+
+			target = ver - 1
+		}
+
+		return m.Down(ctx, target)
+	}
+
+	if _, err = fmt.Fprintf(w, "# %s\n", schema); err != nil {
+		return err
+	}
+
+	return m.Status(ctx, w)
+}
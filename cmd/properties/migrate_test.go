@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestEmbeddedMigrations(t *testing.T) {
+	// only sqlite ones can be run here, others must at least be valid and in sync with them.
+	for _, schema := range []string{schemaUsers, schemaSettings} {
+		latest := -1
+
+		for _, backend := range []string{backendSQLite, backendMySQL, backendPostgres} {
+			steps, err := loadMigrations(migrationsFS, path.Join("migrations", backend, schema))
+			if err != nil || len(steps) == 0 {
+				t.Fatal(backend, schema, "fail:", err)
+			}
+
+			if latest < 0 {
+				latest = len(steps)
+			}
+
+			if len(steps) != latest {
+				t.Fatalf("%s/%s: %d migrations, want %d", backend, schema, len(steps), latest)
+			}
+		}
+	}
+}
+
+func TestLoadMigrations(t *testing.T) {
+	fsys := fstest.MapFS{
+		"ok/0001_init.up.sql":     {Data: []byte("CREATE TABLE a(id INT);")},
+		"ok/0001_init.down.sql":   {Data: []byte("DROP TABLE a;")},
+		"ok/0002_more.up.sql":     {Data: []byte("CREATE TABLE b(id INT);")},
+		"ok/0002_more.down.sql":   {Data: []byte("DROP TABLE b;")},
+		"gap/0001_init.up.sql":    {Data: []byte("CREATE TABLE a(id INT);")},
+		"gap/0001_init.down.sql":  {Data: []byte("DROP TABLE a;")},
+		"gap/0003_more.up.sql":    {Data: []byte("CREATE TABLE b(id INT);")},
+		"gap/0003_more.down.sql":  {Data: []byte("DROP TABLE b;")},
+		"nodown/0001_init.up.sql": {Data: []byte("CREATE TABLE a(id INT);")},
+		"names/0001_init.up.sql":  {Data: []byte("CREATE TABLE a(id INT);")},
+		"names/0001_foo.down.sql": {Data: []byte("DROP TABLE a;")},
+		"junk/readme.txt":         {Data: []byte("hello")},
+	}
+
+	steps, err := loadMigrations(fsys, "ok")
+	if err != nil || len(steps) != 2 || steps[1].Version != 2 || steps[1].Name != "more" {
+		t.Fatal("step 1 fail:", steps, err)
+	}
+
+	for i, dir := range []string{"gap", "nodown", "names", "junk", "none"} {
+		if _, err = loadMigrations(fsys, dir); err == nil {
+			t.Fatalf("step %d fail: '%s' accepted", i+2, dir)
+		}
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	const script = `
+-- settings
+
+CREATE TABLE a(
+    v VARCHAR(10) DEFAULT 'x;y'
+);
+
+CREATE INDEX a_idx ON a(v);
+-- trailing comment
+`
+
+	rv := splitStatements(script)
+
+	want := []string{
+		"-- settings\n\nCREATE TABLE a(\n    v VARCHAR(10) DEFAULT 'x;y'\n)",
+		"CREATE INDEX a_idx ON a(v)",
+	}
+
+	if !reflect.DeepEqual(rv, want) {
+		t.Fatalf("unexpected: %q", rv)
+	}
+}
+
+func TestMigratorSQLite(t *testing.T) {
+	ctx := context.Background()
+	db := openTestSQLite(t, "")
+
+	m, err := newMigrator(db, backendSQLite, schemaUsers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ver, err := m.Version(ctx); err != nil || ver != 0 {
+		t.Fatal("step 1 fail:", ver, err)
+	}
+
+	if err = m.Check(ctx); !errors.Is(err, errSchemaMismatch) {
+		t.Fatal("step 2 fail:", err)
+	}
+
+	if err = m.Up(ctx, m.Latest()); err != nil {
+		t.Fatal("step 3 fail:", err)
+	}
+
+	if err = m.Check(ctx); err != nil {
+		t.Fatal("step 4 fail:", err)
+	}
+
+	// up is idempotent
+	if err = m.Up(ctx, m.Latest()); err != nil {
+		t.Fatal("step 5 fail:", err)
+	}
+
+	if err = m.Up(ctx, m.Latest()+1); err == nil {
+		t.Fatal("step 6 fail: unknown version accepted")
+	}
+
+	var buf bytes.Buffer
+
+	if err = m.Status(ctx, &buf); err != nil || !strings.Contains(buf.String(), "0001_init\tapplied") {
+		t.Fatal("step 7 fail:", buf.String(), err)
+	}
+
+	if err = m.Down(ctx, 0); err != nil {
+		t.Fatal("step 8 fail:", err)
+	}
+
+	if ver, err := m.Version(ctx); err != nil || ver != 0 {
+		t.Fatal("step 9 fail:", ver, err)
+	}
+
+	var n int
+
+	if err = db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE name = 'user_settings'`).Scan(&n); err != nil || n != 0 {
+		t.Fatal("step 10 fail: table not dropped", n, err)
+	}
+
+	if err = m.Down(ctx, 1); err == nil {
+		t.Fatal("step 11 fail: down to higher version accepted")
+	}
+}
+
+func TestMigrateCommand(t *testing.T) {
+	dir := t.TempDir()
+
+	env := map[string]string{
+		envDBUsers:    sqlitePrefix + filepath.Join(dir, "users.db"),
+		envDBSettings: sqlitePrefix + filepath.Join(dir, "settings.db"),
+	}
+	getenv := func(k string) string { return env[k] }
+
+	var buf bytes.Buffer
+
+	for i, args := range [][]string{nil, {"sideways"}, {"up", "x"}, {"status", "1"}, {"up", "1", "2"}} {
+		if err := migrateCommand(args, getenv, &buf); err == nil {
+			t.Fatalf("step 1.%d fail: %v accepted", i, args)
+		}
+	}
+
+	if err := migrateCommand([]string{"-db", schemaUsers, "up"}, getenv, &buf); err != nil {
+		t.Fatal("step 2 fail:", err)
+	}
+
+	if err := migrateCommand([]string{"status"}, getenv, &buf); err != nil {
+		t.Fatal("step 3 fail:", err)
+	}
+
+	users, settings, _ := strings.Cut(buf.String(), "# settings\n")
+	if strings.Contains(users, "pending") || settings != "0001_init\tpending\n" {
+		t.Fatalf("step 4 fail: %q", buf.String())
+	}
+
+	cfg, _, err := loadConfig(nil, getenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// sqlite schema is brought up to date on start, even without auto_migrate.
+	_, closeFn, err := openSettingStore(&cfg)
+	if err != nil {
+		t.Fatal("step 5 fail:", err)
+	}
+
+	closeFn()
+
+	buf.Reset()
+
+	if err = migrateCommand([]string{"-db", schemaSettings, "status"}, getenv, &buf); err != nil || buf.String() != "# settings\n0001_init\tapplied\n" {
+		t.Fatalf("step 6 fail: %q %v", buf.String(), err)
+	}
+
+	if err = migrateCommand([]string{"-db", schemaUsers, "down"}, getenv, &buf); err != nil {
+		t.Fatal("step 7 fail:", err)
+	}
+
+	buf.Reset()
+
+	// only the last one is reverted
+	if err = migrateCommand([]string{"-db", schemaUsers, "status"}, getenv, &buf); err != nil ||
+		strings.Count(buf.String(), "pending") != 1 || !strings.HasSuffix(buf.String(), "\tpending\n") {
+		t.Fatalf("step 8 fail: %q %v", buf.String(), err)
+	}
+
+	if err = migrateCommand([]string{"down", "0"}, getenv, &buf); err != nil {
+		t.Fatal("step 9 fail:", err)
+	}
+
+	buf.Reset()
+
+	if err = migrateCommand([]string{"status"}, getenv, &buf); err != nil || strings.Contains(buf.String(), "applied") {
+		t.Fatal("step 10 fail:", buf.String(), err)
+	}
+}
@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS `bundles_values`;
+
+DROP TABLE IF EXISTS `bundles`;
+
+DROP TABLE IF EXISTS `settings_values`;
+
+DROP TABLE IF EXISTS `settings`;
@@ -0,0 +1,41 @@
+-- settings
+
+CREATE TABLE IF NOT EXISTS `settings`(
+    id        INT AUTO_INCREMENT PRIMARY KEY,
+    name      VARCHAR(255) NOT NULL UNIQUE,
+    notify    BIT(1) NOT NULL
+);
+
+-- settings_values
+
+CREATE TABLE IF NOT EXISTS `settings_values`(
+    id         INT AUTO_INCREMENT PRIMARY KEY,
+    setting_id INT NOT NULL,
+    name       VARCHAR(255) NOT NULL,
+    value      VARCHAR(255) NOT NULL,
+
+    INDEX `settings_values_setting_id`(setting_id)
+);
+
+-- bundles
+
+CREATE TABLE IF NOT EXISTS `bundles`(
+    id         INT AUTO_INCREMENT PRIMARY KEY,
+    parent_id  INT NOT NULL DEFAULT 0,
+    tag        VARCHAR(255),
+    name       VARCHAR(255) NOT NULL,
+
+    UNIQUE INDEX `bundles_enabled_idx`(tag, name)
+);
+
+-- bundles_values
+
+CREATE TABLE IF NOT EXISTS `bundles_values`(
+    id         INT AUTO_INCREMENT PRIMARY KEY,
+    bundle_id  INT NOT NULL,
+    value_id   INT NOT NULL,
+    created_at DATETIME NOT NULL DEFAULT NOW(),
+    expired_at DATETIME,
+
+    INDEX `bundles_values_idx`(bundle_id, created_at, expired_at)
+);
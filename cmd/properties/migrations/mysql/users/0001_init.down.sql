@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS `user_settings_audit`;
+
+DROP TABLE IF EXISTS `user_settings`;
@@ -0,0 +1,29 @@
+-- user_settings
+
+CREATE TABLE IF NOT EXISTS `user_settings`(
+    id         INT AUTO_INCREMENT PRIMARY KEY,
+    user_id    INT NOT NULL,
+    settings   VARBINARY(8192) NOT NULL,
+    created_at DATETIME NOT NULL DEFAULT NOW(),
+    expires_at DATETIME,
+
+    UNIQUE INDEX `user_settings_idx`(user_id, created_at, expires_at)
+);
+
+-- user_settings_audit
+
+CREATE TABLE IF NOT EXISTS `user_settings_audit`(
+    id         INT AUTO_INCREMENT PRIMARY KEY,
+    user_id    INT NOT NULL,
+    action     VARCHAR(32) NOT NULL,
+    items      VARBINARY(8192) NOT NULL,
+    tag        VARCHAR(255),
+    actor      VARCHAR(255) NOT NULL DEFAULT '',
+    caller     VARCHAR(255) NOT NULL DEFAULT '',
+    reason     VARCHAR(1024) NOT NULL DEFAULT '',
+    created_at DATETIME NOT NULL DEFAULT NOW(),
+
+    INDEX `user_settings_audit_user_idx`(user_id, created_at),
+    INDEX `user_settings_audit_actor_idx`(actor, created_at),
+    INDEX `user_settings_audit_tag_idx`(tag, created_at)
+);
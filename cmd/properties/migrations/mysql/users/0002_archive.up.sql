@@ -0,0 +1,12 @@
+-- user_settings_archive holds revisions, moved out of user_settings by retention job.
+
+CREATE TABLE `user_settings_archive`(
+    id          INT NOT NULL PRIMARY KEY,
+    user_id     INT NOT NULL,
+    settings    VARBINARY(8192) NOT NULL,
+    created_at  DATETIME NOT NULL,
+    expires_at  DATETIME,
+    archived_at DATETIME NOT NULL DEFAULT NOW(),
+
+    INDEX `user_settings_archive_idx`(user_id, created_at)
+);
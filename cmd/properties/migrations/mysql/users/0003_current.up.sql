@@ -0,0 +1,9 @@
+-- user_settings_current holds the latest revision of every user, it is filled by Set,
+-- existing history is projected by `properties backfill-current`.
+
+CREATE TABLE `user_settings_current`(
+    user_id    INT NOT NULL PRIMARY KEY,
+    settings   VARBINARY(8192) NOT NULL,
+    created_at DATETIME NOT NULL,
+    expires_at DATETIME
+);
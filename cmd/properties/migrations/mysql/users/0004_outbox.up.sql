@@ -0,0 +1,7 @@
+-- user_settings_outbox holds change events, recorded along with changes, until relay publishes them.
+
+CREATE TABLE `user_settings_outbox`(
+    id      BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    payload TEXT NOT NULL
+);
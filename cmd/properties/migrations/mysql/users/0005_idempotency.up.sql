@@ -0,0 +1,11 @@
+-- user_settings_idempotency holds outcomes of requests, made with Idempotency-Key header,
+-- id_key is a digest of caller and key, status is zero while request is in progress.
+
+CREATE TABLE `user_settings_idempotency`(
+    id_key       CHAR(64) NOT NULL PRIMARY KEY,
+    request_hash CHAR(64) NOT NULL,
+    status       INT NOT NULL DEFAULT 0,
+    body         BLOB,
+    created_at   DATETIME NOT NULL,
+    INDEX `user_settings_idempotency_idx`(created_at)
+);
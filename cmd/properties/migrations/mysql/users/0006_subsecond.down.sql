@@ -0,0 +1,18 @@
+-- fractions are rounded off, revisions, that collide after that, must be removed first.
+
+ALTER TABLE `user_settings_audit`
+    MODIFY created_at DATETIME NOT NULL DEFAULT NOW();
+
+ALTER TABLE `user_settings_archive`
+    MODIFY created_at DATETIME NOT NULL,
+    MODIFY expires_at DATETIME;
+
+ALTER TABLE `user_settings_current`
+    MODIFY created_at DATETIME NOT NULL,
+    MODIFY expires_at DATETIME;
+
+ALTER TABLE `user_settings`
+    DROP INDEX `user_settings_idx`,
+    MODIFY created_at DATETIME NOT NULL DEFAULT NOW(),
+    MODIFY expires_at DATETIME,
+    ADD UNIQUE INDEX `user_settings_idx`(user_id, created_at, expires_at);
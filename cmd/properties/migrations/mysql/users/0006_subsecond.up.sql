@@ -0,0 +1,20 @@
+-- revisions timestamps get microsecond resolution, so quick successive changes of user do not
+-- collide, revisions with equal timestamps are ordered by id, so index is not unique anymore.
+-- existing values are kept as is (with zero fraction).
+
+ALTER TABLE `user_settings`
+    MODIFY created_at DATETIME(6) NOT NULL DEFAULT NOW(6),
+    MODIFY expires_at DATETIME(6),
+    DROP INDEX `user_settings_idx`,
+    ADD INDEX `user_settings_idx`(user_id, created_at);
+
+ALTER TABLE `user_settings_current`
+    MODIFY created_at DATETIME(6) NOT NULL,
+    MODIFY expires_at DATETIME(6);
+
+ALTER TABLE `user_settings_archive`
+    MODIFY created_at DATETIME(6) NOT NULL,
+    MODIFY expires_at DATETIME(6);
+
+ALTER TABLE `user_settings_audit`
+    MODIFY created_at DATETIME(6) NOT NULL DEFAULT NOW(6);
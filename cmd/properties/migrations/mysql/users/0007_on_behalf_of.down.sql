@@ -0,0 +1,2 @@
+ALTER TABLE `user_settings_audit`
+    DROP COLUMN on_behalf_of;
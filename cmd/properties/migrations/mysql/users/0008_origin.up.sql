@@ -0,0 +1,6 @@
+-- origin tells what made revision: empty - request itself, `expire` - set-expire, that scheduled
+-- reversion to the state after former expiration; earlier reversions can't be told apart from
+-- explicitly scheduled changes, so they are left as the latter.
+
+ALTER TABLE `user_settings`
+    ADD origin VARCHAR(32) NOT NULL DEFAULT '';
@@ -0,0 +1,3 @@
+ALTER TABLE `user_settings_outbox`
+    DROP COLUMN attempts,
+    DROP COLUMN dead;
@@ -0,0 +1,3 @@
+ALTER TABLE `user_settings_idempotency`
+    DROP INDEX `user_settings_idempotency_user_idx`,
+    DROP COLUMN user_id;
@@ -0,0 +1,6 @@
+-- idempotency keys are bound to user, they were claimed for, so reshard moves them along with
+-- user; keys, claimed before, have zero user and are left to expire where they are.
+
+ALTER TABLE `user_settings_idempotency`
+    ADD user_id INT NOT NULL DEFAULT 0,
+    ADD INDEX `user_settings_idempotency_user_idx`(user_id);
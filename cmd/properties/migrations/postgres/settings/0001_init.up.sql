@@ -0,0 +1,44 @@
+-- settings
+
+CREATE TABLE IF NOT EXISTS settings(
+    id        SERIAL PRIMARY KEY,
+    name      VARCHAR(255) NOT NULL UNIQUE,
+    notify    BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+-- settings_values
+
+CREATE TABLE IF NOT EXISTS settings_values(
+    id         SERIAL PRIMARY KEY,
+    setting_id INT NOT NULL,
+    name       VARCHAR(255) NOT NULL,
+    value      VARCHAR(255) NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS settings_values_setting_id
+    ON settings_values(setting_id);
+
+-- bundles
+
+CREATE TABLE IF NOT EXISTS bundles(
+    id         SERIAL PRIMARY KEY,
+    parent_id  INT NOT NULL DEFAULT 0,
+    tag        VARCHAR(255),
+    name       VARCHAR(255) NOT NULL
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS bundles_enabled_idx
+    ON bundles(tag, name);
+
+-- bundles_values
+
+CREATE TABLE IF NOT EXISTS bundles_values(
+    id         SERIAL PRIMARY KEY,
+    bundle_id  INT NOT NULL,
+    value_id   INT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expired_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS bundles_values_idx
+    ON bundles_values(bundle_id, created_at, expired_at);
@@ -0,0 +1,35 @@
+-- user_settings
+
+CREATE TABLE IF NOT EXISTS user_settings(
+    id         SERIAL PRIMARY KEY,
+    user_id    INT NOT NULL,
+    settings   BYTEA NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMPTZ
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS user_settings_idx
+    ON user_settings(user_id, created_at, expires_at);
+
+-- user_settings_audit
+
+CREATE TABLE IF NOT EXISTS user_settings_audit(
+    id         SERIAL PRIMARY KEY,
+    user_id    INT NOT NULL,
+    action     VARCHAR(32) NOT NULL,
+    items      JSONB NOT NULL,
+    tag        VARCHAR(255),
+    actor      VARCHAR(255) NOT NULL DEFAULT '',
+    caller     VARCHAR(255) NOT NULL DEFAULT '',
+    reason     VARCHAR(1024) NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS user_settings_audit_user_idx
+    ON user_settings_audit(user_id, created_at);
+
+CREATE INDEX IF NOT EXISTS user_settings_audit_actor_idx
+    ON user_settings_audit(actor, created_at);
+
+CREATE INDEX IF NOT EXISTS user_settings_audit_tag_idx
+    ON user_settings_audit(tag, created_at);
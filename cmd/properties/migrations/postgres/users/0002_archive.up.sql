@@ -0,0 +1,13 @@
+-- user_settings_archive holds revisions, moved out of user_settings by retention job.
+
+CREATE TABLE user_settings_archive(
+    id          INT NOT NULL PRIMARY KEY,
+    user_id     INT NOT NULL,
+    settings    BYTEA NOT NULL,
+    created_at  TIMESTAMPTZ NOT NULL,
+    expires_at  TIMESTAMPTZ,
+    archived_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX user_settings_archive_idx
+    ON user_settings_archive(user_id, created_at);
@@ -0,0 +1,9 @@
+-- user_settings_current holds the latest revision of every user, it is filled by Set,
+-- existing history is projected by `properties backfill-current`.
+
+CREATE TABLE user_settings_current(
+    user_id    INT NOT NULL PRIMARY KEY,
+    settings   BYTEA NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    expires_at TIMESTAMPTZ
+);
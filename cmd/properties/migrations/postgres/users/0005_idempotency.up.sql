@@ -0,0 +1,12 @@
+-- user_settings_idempotency holds outcomes of requests, made with Idempotency-Key header,
+-- id_key is a digest of caller and key, status is zero while request is in progress.
+
+CREATE TABLE user_settings_idempotency(
+    id_key       CHAR(64) NOT NULL PRIMARY KEY,
+    request_hash CHAR(64) NOT NULL,
+    status       INT NOT NULL DEFAULT 0,
+    body         BYTEA,
+    created_at   TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX user_settings_idempotency_idx ON user_settings_idempotency (created_at);
@@ -0,0 +1,4 @@
+DROP INDEX user_settings_idempotency_user_idx;
+
+ALTER TABLE user_settings_idempotency
+    DROP COLUMN user_id;
@@ -0,0 +1,46 @@
+-- all timestamps are stored as unix microseconds.
+
+-- settings
+
+CREATE TABLE IF NOT EXISTS settings(
+    id        INTEGER PRIMARY KEY,
+    name      TEXT NOT NULL UNIQUE,
+    notify    INTEGER NOT NULL DEFAULT 0
+);
+
+-- settings_values
+
+CREATE TABLE IF NOT EXISTS settings_values(
+    id         INTEGER PRIMARY KEY,
+    setting_id INTEGER NOT NULL,
+    name       TEXT NOT NULL,
+    value      TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS settings_values_setting_id
+    ON settings_values(setting_id);
+
+-- bundles
+
+CREATE TABLE IF NOT EXISTS bundles(
+    id         INTEGER PRIMARY KEY,
+    parent_id  INTEGER NOT NULL DEFAULT 0,
+    tag        TEXT,
+    name       TEXT NOT NULL
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS bundles_enabled_idx
+    ON bundles(tag, name);
+
+-- bundles_values
+
+CREATE TABLE IF NOT EXISTS bundles_values(
+    id         INTEGER PRIMARY KEY AUTOINCREMENT,
+    bundle_id  INTEGER NOT NULL,
+    value_id   INTEGER NOT NULL,
+    created_at INTEGER NOT NULL DEFAULT 0,
+    expired_at INTEGER
+);
+
+CREATE INDEX IF NOT EXISTS bundles_values_idx
+    ON bundles_values(bundle_id, created_at, expired_at);
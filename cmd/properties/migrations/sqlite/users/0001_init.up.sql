@@ -0,0 +1,37 @@
+-- all timestamps are stored as unix microseconds.
+
+-- user_settings
+
+CREATE TABLE IF NOT EXISTS user_settings(
+    id         INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id    INTEGER NOT NULL,
+    settings   BLOB NOT NULL,
+    created_at INTEGER NOT NULL,
+    expires_at INTEGER
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS user_settings_idx
+    ON user_settings(user_id, created_at, expires_at);
+
+-- user_settings_audit
+
+CREATE TABLE IF NOT EXISTS user_settings_audit(
+    id         INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id    INTEGER NOT NULL,
+    action     TEXT NOT NULL,
+    items      TEXT NOT NULL,
+    tag        TEXT,
+    actor      TEXT NOT NULL DEFAULT '',
+    caller     TEXT NOT NULL DEFAULT '',
+    reason     TEXT NOT NULL DEFAULT '',
+    created_at INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS user_settings_audit_user_idx
+    ON user_settings_audit(user_id, created_at);
+
+CREATE INDEX IF NOT EXISTS user_settings_audit_actor_idx
+    ON user_settings_audit(actor, created_at);
+
+CREATE INDEX IF NOT EXISTS user_settings_audit_tag_idx
+    ON user_settings_audit(tag, created_at);
@@ -0,0 +1,13 @@
+-- user_settings_archive holds revisions, moved out of user_settings by retention job.
+
+CREATE TABLE user_settings_archive(
+    id          INTEGER NOT NULL PRIMARY KEY,
+    user_id     INTEGER NOT NULL,
+    settings    BLOB NOT NULL,
+    created_at  INTEGER NOT NULL,
+    expires_at  INTEGER,
+    archived_at INTEGER NOT NULL DEFAULT (CAST(strftime('%s', 'now') AS INTEGER) * 1000000)
+);
+
+CREATE INDEX user_settings_archive_idx
+    ON user_settings_archive(user_id, created_at);
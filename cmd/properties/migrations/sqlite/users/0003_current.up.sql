@@ -0,0 +1,9 @@
+-- user_settings_current holds the latest revision of every user, it is filled by Set,
+-- existing history is projected by `properties backfill-current`.
+
+CREATE TABLE user_settings_current(
+    user_id    INTEGER NOT NULL PRIMARY KEY,
+    settings   BLOB NOT NULL,
+    created_at INTEGER NOT NULL,
+    expires_at INTEGER
+);
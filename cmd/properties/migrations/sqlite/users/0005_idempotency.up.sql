@@ -0,0 +1,12 @@
+-- user_settings_idempotency holds outcomes of requests, made with Idempotency-Key header,
+-- id_key is a digest of caller and key, status is zero while request is in progress.
+
+CREATE TABLE user_settings_idempotency(
+    id_key       TEXT NOT NULL PRIMARY KEY,
+    request_hash TEXT NOT NULL,
+    status       INTEGER NOT NULL DEFAULT 0,
+    body         BLOB,
+    created_at   INTEGER NOT NULL
+);
+
+CREATE INDEX user_settings_idempotency_idx ON user_settings_idempotency (created_at);
@@ -0,0 +1,6 @@
+-- revisions with equal timestamps must be removed first.
+
+DROP INDEX user_settings_idx;
+
+CREATE UNIQUE INDEX user_settings_idx
+    ON user_settings(user_id, created_at, expires_at);
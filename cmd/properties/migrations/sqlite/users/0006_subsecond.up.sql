@@ -0,0 +1,7 @@
+-- revisions timestamps already have microsecond resolution, but revisions with equal ones
+-- still collide, they are ordered by id now, so index is not unique anymore.
+
+DROP INDEX user_settings_idx;
+
+CREATE INDEX user_settings_idx
+    ON user_settings(user_id, created_at);
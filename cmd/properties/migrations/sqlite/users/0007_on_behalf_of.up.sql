@@ -0,0 +1,12 @@
+-- `actor` holds trusted identity (authenticated caller), client-supplied one goes to
+-- `on_behalf_of`, existing records, attributed to someone else by caller, are moved there.
+
+ALTER TABLE user_settings_audit
+    ADD COLUMN on_behalf_of TEXT NOT NULL DEFAULT '';
+
+UPDATE user_settings_audit
+SET
+    on_behalf_of = actor,
+    actor = caller
+WHERE
+    caller <> '' AND actor <> caller;
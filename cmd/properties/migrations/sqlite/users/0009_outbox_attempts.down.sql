@@ -0,0 +1,5 @@
+ALTER TABLE user_settings_outbox
+    DROP COLUMN attempts;
+
+ALTER TABLE user_settings_outbox
+    DROP COLUMN dead;
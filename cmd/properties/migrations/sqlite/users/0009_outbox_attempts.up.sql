@@ -0,0 +1,8 @@
+-- failed publishes of event are counted, dead ones (undecodable, or failed too many times) are
+-- kept in outbox for inspection, but skipped by relay, so they don't block ones after them.
+
+ALTER TABLE user_settings_outbox
+    ADD COLUMN attempts INTEGER NOT NULL DEFAULT 0;
+
+ALTER TABLE user_settings_outbox
+    ADD COLUMN dead INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ChangeEvent is published for every change of user settings.
+type ChangeEvent struct {
+	// ID is unique for every change, events can be delivered more than once, so
+	// consumers should use it as idempotency key.
+	ID         string     `json:"id"`
+	UserID     int        `json:"user_id"`
+	Bundles    []int      `json:"bundles"`
+	Expire     *time.Time `json:"expire,omitempty"`
+	Start      *time.Time `json:"start,omitempty"`
+	Action     string     `json:"action"`
+	Items      []string   `json:"items"`
+	Tag        string     `json:"tag,omitempty"`
+	Actor      string     `json:"actor,omitempty"`
+	Caller     string     `json:"caller,omitempty"`
+	OnBehalfOf string     `json:"on_behalf_of,omitempty"`
+	Reason     string     `json:"reason,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// newChangeEvent builds encoded event for given change.
+func newChangeEvent(userID int, s *UserSettings, ch *Change, now time.Time) ([]byte, error) {
+	var id [16]byte
+
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(&ChangeEvent{
+		ID:         hex.EncodeToString(id[:]),
+		UserID:     userID,
+		Bundles:    s.Bundles,
+		Expire:     s.Expire,
+		Start:      ch.Start,
+		Action:     ch.Action,
+		Items:      ch.Items,
+		Tag:        ch.Tag,
+		Actor:      ch.Actor,
+		Caller:     ch.Caller,
+		OnBehalfOf: ch.OnBehalfOf,
+		Reason:     ch.Reason,
+		CreatedAt:  now.UTC(),
+	})
+}
+
+// OutboxEvent is a recorded, but not yet published, change event.
+type OutboxEvent struct {
+	ID      int64
+	UserID  int
+	Payload []byte
+	// Attempts is a number of failed publishes of event.
+	Attempts int
+}
+
+// Outbox holds change events, recorded along with changes, until they are published.
+type Outbox interface {
+	// Pending returns up to `limit` oldest events, except dead ones.
+	Pending(ctx context.Context, limit int) ([]OutboxEvent, error)
+	// Ack removes published events.
+	Ack(ctx context.Context, ids []int64) error
+	// Fail counts failed publish of event, dead one is kept, but not returned by Pending anymore.
+	Fail(ctx context.Context, id int64, dead bool) error
+}
+
+// errBadEvent is returned for event, that can't be published ever.
+var errBadEvent = errors.New("bad event")
+
+// outboxSource is implemented by user stores, that record change events.
+type outboxSource interface {
+	Outboxes() []Outbox
+}
+
+// outboxesOf returns change events outboxes of user store, if any.
+func outboxesOf(us UserStore) []Outbox {
+	if src, ok := us.(outboxSource); ok {
+		return src.Outboxes()
+	}
+
+	return nil
+}
+
+// userStoreOptions holds optional behaviour of user stores.
+type userStoreOptions struct {
+	// Codec encodes payloads of new revisions.
+	Codec payloadCodec
+	// Outbox enables change events recording into `user_settings_outbox`.
+	Outbox bool
+}
+
+const queryOutboxInsert = `
+INSERT INTO user_settings_outbox
+	(user_id, payload)
+VALUES
+	(?, ?)`
+
+// sqlOutbox is an Outbox over `user_settings_outbox` table.
+type sqlOutbox struct {
+	db   sqlDB
+	bind func(string) string
+}
+
+// record writes change event within transaction of change.
+func (o *sqlOutbox) record(ctx context.Context, tx *sql.Tx, userID int, s *UserSettings, ch *Change, now time.Time) error {
+	buf, err := newChangeEvent(userID, s, ch, now)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, o.bind(queryOutboxInsert), userID, string(buf))
+
+	return err
+}
+
+// Pending returns up to `limit` oldest events, they are always read from primary.
+func (o *sqlOutbox) Pending(ctx context.Context, limit int) (rv []OutboxEvent, err error) {
+	const query = `
+SELECT
+	id,
+	user_id,
+	payload,
+	attempts
+FROM
+	user_settings_outbox
+WHERE
+	dead = 0
+ORDER BY
+	id
+LIMIT ?`
+
+	rows, err := o.db.QueryContext(withPrimary(ctx), o.bind(query), limit)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var e OutboxEvent
+
+		if err = rows.Scan(&e.ID, &e.UserID, &e.Payload, &e.Attempts); err != nil {
+			return nil, err
+		}
+
+		rv = append(rv, e)
+	}
+
+	return rv, rows.Err()
+}
+
+// Ack removes published events.
+func (o *sqlOutbox) Ack(ctx context.Context, ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	s := make([]string, len(ids))
+
+	for i, id := range ids {
+		s[i] = strconv.FormatInt(id, 10)
+	}
+
+	_, err := o.db.ExecContext(ctx, `DELETE FROM user_settings_outbox WHERE id IN (`+strings.Join(s, ",")+`)`)
+
+	return err
+}
+
+// Fail counts failed publish of event, marking it dead, if asked to.
+func (o *sqlOutbox) Fail(ctx context.Context, id int64, dead bool) error {
+	const query = `
+UPDATE
+	user_settings_outbox
+SET
+	attempts = attempts + 1,
+	dead = ?
+WHERE
+	id = ?`
+
+	var flag int
+
+	if dead {
+		flag = 1
+	}
+
+	_, err := o.db.ExecContext(ctx, o.bind(query), flag, id)
+
+	return err
+}
+
+// relay publishes recorded change events to broker. Events leave outbox only after
+// they are published, so delivery is at-least-once: failure between publish and ack,
+// or several relays running over the same outbox, lead to duplicates.
+type relay struct {
+	boxes  []Outbox
+	broker Broker
+	batch  int
+	// attempts is a number of failed publishes, after which event is dead.
+	attempts int
+}
+
+// Flush publishes all pending events, it reports number of published ones. Publishing from
+// outbox stops at first failure, so events of every user are published in order, unless
+// failed event is dead: undecodable, or failed `attempts` times - it is skipped then.
+func (r *relay) Flush(ctx context.Context) (n int, err error) {
+	var errs []error
+
+	for _, ob := range r.boxes {
+		c, err := r.drain(ctx, ob)
+		if err != nil {
+			errs = append(errs, err)
+		}
+
+		n += c
+	}
+
+	return n, errors.Join(errs...)
+}
+
+func (r *relay) drain(ctx context.Context, ob Outbox) (n int, err error) {
+	for {
+		evs, err := ob.Pending(ctx, r.batch)
+		if err != nil {
+			return n, err
+		}
+
+		done, failed, perr := r.publish(ctx, evs)
+
+		if err = ob.Ack(ctx, done); err != nil {
+			return n, err
+		}
+
+		n += len(done)
+
+		if perr != nil {
+			dead := errors.Is(perr, errBadEvent) || failed.Attempts+1 >= r.attempts
+
+			if err = ob.Fail(ctx, failed.ID, dead); err != nil {
+				return n, errors.Join(perr, err)
+			}
+
+			if !dead {
+				return n, perr
+			}
+
+			slog.ErrorContext(ctx, "outbox event is dead", "id", failed.ID, "user_id", failed.UserID,
+				"attempts", failed.Attempts+1, "err", perr)
+
+			continue
+		}
+
+		if len(evs) < r.batch {
+			return n, nil
+		}
+	}
+}
+
+// publish publishes events in order, until first failure, returning ids of published ones
+// and failed event (if any).
+func (r *relay) publish(ctx context.Context, evs []OutboxEvent) (done []int64, failed *OutboxEvent, err error) {
+	for i := range evs {
+		e := &evs[i]
+
+		var ev struct {
+			ID string `json:"id"`
+		}
+
+		if err = json.Unmarshal(e.Payload, &ev); err == nil && ev.ID == "" {
+			err = errors.New("no id")
+		}
+
+		if err != nil {
+			return done, e, fmt.Errorf("%w: %v", errBadEvent, err)
+		}
+
+		m := Message{ID: ev.ID, Key: strconv.Itoa(e.UserID), Payload: e.Payload}
+
+		if err = r.broker.Publish(ctx, &m); err != nil {
+			return done, e, err
+		}
+
+		done = append(done, e.ID)
+	}
+
+	return done, nil, nil
+}
+
+// startRelay opens configured broker and starts relay over outboxes of user store, returned
+// function stops it and closes broker.
+func startRelay(us UserStore, cfg *outboxConfig) (func(), error) {
+	b, err := openBroker(cfg.Broker)
+	if err != nil {
+		return nil, fmt.Errorf("outbox broker: %w", err)
+	}
+
+	var (
+		r           = relay{boxes: outboxesOf(us), broker: b, batch: cfg.Batch, attempts: cfg.MaxAttempts}
+		ctx, cancel = context.WithCancel(context.Background())
+		done        = make(chan struct{})
+	)
+
+	go func() {
+		defer close(done)
+
+		r.Run(ctx, cfg.Interval)
+	}()
+
+	slog.Info("outbox relay started", "broker", brokerScheme(cfg.Broker), "outboxes", len(r.boxes))
+
+	return func() {
+		cancel()
+		<-done
+
+		if err := b.Close(); err != nil {
+			slog.Error("outbox broker close", "err", err)
+		}
+	}, nil
+}
+
+// Run flushes outboxes every `every`, until `ctx` is done.
+func (r *relay) Run(ctx context.Context, every time.Duration) {
+	tick := time.NewTicker(every)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			n, err := r.Flush(ctx)
+			if err != nil {
+				slog.ErrorContext(ctx, "outbox relay", "published", n, "err", err)
+			} else if n > 0 {
+				slog.DebugContext(ctx, "outbox relay", "published", n)
+			}
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// flakyBroker fails publishes after `left` successful ones, negative `left` - never.
+type flakyBroker struct {
+	memBroker
+	left int
+}
+
+func (fb *flakyBroker) Publish(ctx context.Context, m *Message) error {
+	if fb.left == 0 {
+		return errors.New("broker is down")
+	}
+
+	fb.left--
+
+	return fb.memBroker.Publish(ctx, m)
+}
+
+func setUsers(t *testing.T, us UserStore, uids ...int) {
+	t.Helper()
+
+	for _, uid := range uids {
+		if err := us.Set(context.Background(), uid, UserSettings{Bundles: []int{uid}}, Change{Action: "set-bundles"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMemoryOutboxDisabled(t *testing.T) {
+	us := NewMemoryUserStore(userStoreOptions{})
+
+	setUsers(t, us, 1, 2)
+
+	if boxes := outboxesOf(us); len(boxes) != 0 {
+		t.Fatal("step 1 fail: outbox exposed", boxes)
+	}
+
+	if evs, _ := us.(Outbox).Pending(context.Background(), 10); len(evs) != 0 {
+		t.Fatal("step 2 fail: events recorded", evs)
+	}
+}
+
+func TestRelay(t *testing.T) {
+	var (
+		ctx = context.Background()
+		us  = NewMemoryUserStore(userStoreOptions{Outbox: true})
+		fb  = &flakyBroker{left: 2}
+		r   = relay{boxes: outboxesOf(us), broker: fb, batch: 2, attempts: 10}
+	)
+
+	setUsers(t, us, 1, 2, 3, 1, 2)
+
+	if n, err := r.Flush(ctx); err == nil || n != 2 {
+		t.Fatal("step 1 fail:", n, err)
+	}
+
+	// events after failed one stay in outbox, so order is kept.
+	if evs, _ := us.(Outbox).Pending(ctx, 10); len(evs) != 3 || evs[0].UserID != 3 {
+		t.Fatal("step 2 fail:", evs)
+	}
+
+	fb.left = -1
+
+	if n, err := r.Flush(ctx); err != nil || n != 3 {
+		t.Fatal("step 3 fail:", n, err)
+	}
+
+	msgs := fb.Messages()
+	if len(msgs) != 5 {
+		t.Fatal("step 4 fail:", msgs)
+	}
+
+	for i, uid := range []string{"1", "2", "3", "1", "2"} {
+		var ev ChangeEvent
+
+		if err := json.Unmarshal(msgs[i].Payload, &ev); err != nil || msgs[i].Key != uid || msgs[i].ID != ev.ID {
+			t.Fatal("step 5 fail:", i, msgs[i], err)
+		}
+	}
+
+	if n, err := r.Flush(ctx); err != nil || n != 0 {
+		t.Fatal("step 6 fail:", n, err)
+	}
+}
+
+// pickyBroker rejects messages with given key.
+type pickyBroker struct {
+	memBroker
+	reject string
+}
+
+func (pb *pickyBroker) Publish(ctx context.Context, m *Message) error {
+	if m.Key == pb.reject {
+		return errors.New("rejected")
+	}
+
+	return pb.memBroker.Publish(ctx, m)
+}
+
+func TestRelayDeadEvents(t *testing.T) {
+	var (
+		ctx = context.Background()
+		db  = openTestSQLite(t, schemaUsers)
+		us  = NewSQLiteUserStore(db, userStoreOptions{Codec: cborCodec{}, Outbox: true})
+		pb  = &pickyBroker{reject: "4"}
+		r   = relay{boxes: outboxesOf(us), broker: pb, batch: 10, attempts: 3}
+	)
+
+	setUsers(t, us, 1)
+	execSQL(t, db, `INSERT INTO user_settings_outbox (user_id, payload) VALUES (2, 'garbage')`)
+	setUsers(t, us, 3)
+
+	// undecodable event is dead at once, and does not block ones after it.
+	if n, err := r.Flush(ctx); err != nil || n != 2 {
+		t.Fatal("step 1 fail:", n, err)
+	}
+
+	var attempts, dead int
+
+	if err := db.QueryRow(`SELECT attempts, dead FROM user_settings_outbox WHERE user_id = 2`).Scan(&attempts, &dead); err != nil ||
+		attempts != 1 || dead != 1 {
+		t.Fatal("step 2 fail: dead event not kept", attempts, dead, err)
+	}
+
+	setUsers(t, us, 4, 5)
+
+	// rejected event blocks ones after it, until it fails `attempts` times.
+	for i := 0; i < 2; i++ {
+		if n, err := r.Flush(ctx); err == nil || n != 0 {
+			t.Fatal("step 3 fail:", i, n, err)
+		}
+	}
+
+	if n, err := r.Flush(ctx); err != nil || n != 1 {
+		t.Fatal("step 4 fail:", n, err)
+	}
+
+	msgs := pb.Messages()
+	if len(msgs) != 3 || msgs[0].Key != "1" || msgs[1].Key != "3" || msgs[2].Key != "5" {
+		t.Fatal("step 5 fail:", msgs)
+	}
+
+	if evs, err := us.(outboxSource).Outboxes()[0].Pending(ctx, 10); err != nil || len(evs) != 0 {
+		t.Fatal("step 6 fail: dead events pending", evs, err)
+	}
+}
+
+func TestRelaySharded(t *testing.T) {
+	var (
+		ctx = context.Background()
+		us  = NewShardedUserStore(moduloMap(2), []UserStore{NewMemoryUserStore(userStoreOptions{Outbox: true}), NewMemoryUserStore(userStoreOptions{Outbox: true})})
+		mb  = newMemBroker()
+		r   = relay{boxes: outboxesOf(us), broker: mb, batch: 10, attempts: 10}
+	)
+
+	if len(r.boxes) != 2 {
+		t.Fatal("step 1 fail:", len(r.boxes))
+	}
+
+	setUsers(t, us, 1, 2, 3, 4)
+
+	if n, err := r.Flush(ctx); err != nil || n != 4 || len(mb.Messages()) != 4 {
+		t.Fatal("step 2 fail:", n, err)
+	}
+}
+
+func TestFileBroker(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		path = filepath.Join(t.TempDir(), "events.jsonl")
+	)
+
+	for i := 0; i < 2; i++ { // reopened broker appends.
+		b, err := openBroker("file:" + path)
+		if err != nil {
+			t.Fatal("step 1 fail:", err)
+		}
+
+		if err = b.Publish(ctx, &Message{ID: "e1", Key: "1", Payload: []byte(`{"id":"e1"}`)}); err != nil {
+			t.Fatal("step 2 fail:", err)
+		}
+
+		if err = b.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fd, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer fd.Close()
+
+	var (
+		lines int
+		sc    = bufio.NewScanner(fd)
+	)
+
+	for ; sc.Scan(); lines++ {
+		var m fileMessage
+
+		if err = json.Unmarshal(sc.Bytes(), &m); err != nil || m.ID != "e1" || m.Key != "1" || string(m.Payload) != `{"id":"e1"}` {
+			t.Fatal("step 3 fail:", sc.Text(), err)
+		}
+	}
+
+	if lines != 2 {
+		t.Fatal("step 4 fail:", lines)
+	}
+
+	if _, err = openBroker("kafka://broker:9092"); err == nil {
+		t.Fatal("step 5 fail: unknown broker accepted")
+	}
+}
+
+// busStub records calls of kafkaProducer and natsPublisher.
+type busStub struct {
+	dst, key string
+	headers  map[string]string
+}
+
+func (bs *busStub) Produce(_ context.Context, topic string, key, _ []byte, headers map[string]string) error {
+	bs.dst, bs.key, bs.headers = topic, string(key), headers
+
+	return nil
+}
+
+func (bs *busStub) Publish(_ context.Context, subject string, _ []byte, headers map[string]string) error {
+	bs.dst, bs.headers = subject, headers
+
+	return nil
+}
+
+func (bs *busStub) Close() error {
+	return nil
+}
+
+func TestBusBrokers(t *testing.T) {
+	var (
+		ctx = context.Background()
+		m   = Message{ID: "e1", Key: "42", Payload: []byte("{}")}
+		bs  busStub
+	)
+
+	if err := newKafkaBroker(&bs, "user-settings").Publish(ctx, &m); err != nil ||
+		bs.dst != "user-settings" || bs.key != "42" || bs.headers[headerIdempotencyKey] != "e1" {
+		t.Fatal("step 1 fail:", bs, err)
+	}
+
+	if err := newNATSBroker(&bs, "user-settings").Publish(ctx, &m); err != nil ||
+		bs.dst != "user-settings.42" || bs.headers[headerNatsMsgID] != "e1" {
+		t.Fatal("step 2 fail:", bs, err)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisPoolSize is a maximum number of connections, kept by redis client.
+const redisPoolSize = 16
+
+// redisCache is a cacheBackend over redis, client keeps connections pooled, broken ones
+// are replaced on demand, and failed commands are not retried: cache failures fall back to
+// database anyway.
+type redisCache struct {
+	rdb *redis.Client
+}
+
+func newRedisCache(addr, password string, db int, timeout time.Duration) *redisCache {
+	return &redisCache{rdb: redis.NewClient(&redis.Options{
+		Addr:         addr,
+		Password:     password,
+		DB:           db,
+		DialTimeout:  timeout,
+		ReadTimeout:  timeout,
+		WriteTimeout: timeout,
+		PoolSize:     redisPoolSize,
+		MaxRetries:   -1,
+	})}
+}
+
+// MGet returns values for given keys, nil - for missing ones.
+func (rc *redisCache) MGet(ctx context.Context, keys ...string) ([][]byte, error) {
+	vals, err := rc.rdb.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(vals) != len(keys) {
+		return nil, fmt.Errorf("redis: unexpected MGET reply: %v", vals)
+	}
+
+	rv := make([][]byte, len(vals))
+
+	for i, v := range vals {
+		if s, ok := v.(string); ok {
+			rv[i] = []byte(s)
+		}
+	}
+
+	return rv, nil
+}
+
+// Set stores value for given time.
+func (rc *redisCache) Set(ctx context.Context, key string, val []byte, ttl time.Duration) error {
+	// zero ttl means no expiration for redis.
+	if ttl < time.Millisecond {
+		ttl = time.Millisecond
+	}
+
+	return rc.rdb.Set(ctx, key, val, ttl).Err()
+}
+
+// Close closes client connections.
+func (rc *redisCache) Close() error {
+	return rc.rdb.Close()
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// newTestRedis starts in-process redis server, requiring `password` (if any).
+func newTestRedis(t *testing.T, password string) *miniredis.Miniredis {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+
+	if password != "" {
+		mr.RequireAuth(password)
+	}
+
+	return mr
+}
+
+func TestRedisCache(t *testing.T) {
+	var (
+		ctx = context.Background()
+		mr  = newTestRedis(t, "secret")
+		rc  = newRedisCache(mr.Addr(), "secret", 1, time.Second)
+	)
+
+	t.Cleanup(func() { rc.Close() })
+
+	if err := rc.Set(ctx, "a", []byte("1\r\n2"), time.Minute); err != nil {
+		t.Fatal("step 1 fail:", err)
+	}
+
+	rv, err := rc.MGet(ctx, "a", "b")
+	if err != nil || string(rv[0]) != "1\r\n2" || rv[1] != nil {
+		t.Fatal("step 2 fail:", rv, err)
+	}
+
+	mr.Select(1)
+
+	if ttl := mr.TTL("a"); ttl != time.Minute {
+		t.Fatal("step 3 fail:", ttl)
+	}
+
+	// broken connections are replaced.
+	mr.Restart()
+
+	if rv, err = rc.MGet(ctx, "a"); err != nil || string(rv[0]) != "1\r\n2" {
+		t.Fatal("step 4 fail:", rv, err)
+	}
+
+	bad := newRedisCache(mr.Addr(), "wrong", 0, time.Second)
+	t.Cleanup(func() { bad.Close() })
+
+	if _, err = bad.MGet(ctx, "a"); err == nil {
+		t.Fatal("step 5 fail: no error for wrong password")
+	}
+
+	down := newRedisCache("127.0.0.1:1", "", 0, 100*time.Millisecond)
+	t.Cleanup(func() { down.Close() })
+
+	if err = down.Set(ctx, "a", nil, time.Second); err == nil {
+		t.Fatal("step 6 fail: no error for unreachable server")
+	}
+}
+
+func TestSettingsCacheRedis(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		mr    = newTestRedis(t, "")
+		c     = newTestSettingsCache(newRedisCache(mr.Addr(), "", 0, time.Second))
+		loads int
+	)
+
+	c.checkCatalog(ctx, &digestStore{digest: "v1"})
+
+	load := func(context.Context) ([]Setting, *time.Time, error) {
+		loads++
+
+		return []Setting{{Name: "profit", Value: "85"}}, nil, nil
+	}
+
+	for i := 0; i < 3; i++ {
+		if i == 2 {
+			if err := c.Invalidate(ctx, 1); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if rv, err := c.Get(ctx, 1, load); err != nil || len(rv) != 1 {
+			t.Fatal("get fail:", rv, err)
+		}
+	}
+
+	if loads != 2 {
+		t.Fatal("want 2 loads, got", loads)
+	}
+
+	// unreachable cache does not break reads.
+	down := newTestSettingsCache(newRedisCache("127.0.0.1:1", "", 0, 100*time.Millisecond))
+	down.checkCatalog(ctx, &digestStore{digest: "v1"})
+
+	if rv, err := down.Get(ctx, 1, load); err != nil || len(rv) != 1 {
+		t.Fatal("get fail for unreachable cache:", rv, err)
+	}
+}
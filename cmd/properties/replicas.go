@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// replicaCheckInterval is a period of replicas lag checks.
+const replicaCheckInterval = 2 * time.Second
+
+// sqlDB is a subset of *sql.DB, used by sql stores.
+type sqlDB interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+type primaryKey struct{}
+
+// withPrimary marks context, so all reads made with it go to primary database,
+// mutations use it to read state they are based on.
+func withPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryKey{}, true)
+}
+
+func usePrimary(ctx context.Context) bool {
+	v, _ := ctx.Value(primaryKey{}).(bool)
+
+	return v
+}
+
+// lagFunc reports replication lag of given database.
+type lagFunc func(ctx context.Context, db *sql.DB) (time.Duration, error)
+
+type replica struct {
+	name    string
+	db      *sql.DB
+	healthy atomic.Bool
+}
+
+// routedDB sends writes, transactions and reads marked by withPrimary to primary database,
+// other reads are spread among replicas, that lag no more than allowed; with none of them
+// available reads fall back to primary.
+type routedDB struct {
+	primary  *sql.DB
+	replicas []*replica
+	lag      lagFunc
+	maxLag   time.Duration
+	next     atomic.Uint32
+}
+
+func newRoutedDB(primary *sql.DB, replicas []*replica, lag lagFunc, maxLag time.Duration) *routedDB {
+	return &routedDB{
+		primary:  primary,
+		replicas: replicas,
+		lag:      lag,
+		maxLag:   maxLag,
+	}
+}
+
+// reader picks database for read query, it returns nil replica for primary.
+func (r *routedDB) reader(ctx context.Context) (*sql.DB, *replica) {
+	if usePrimary(ctx) {
+		return r.primary, nil
+	}
+
+	n := len(r.replicas)
+	start := int(r.next.Add(1))
+
+	for i := 0; i < n; i++ {
+		if rep := r.replicas[(start+i)%n]; rep.healthy.Load() {
+			return rep.db, rep
+		}
+	}
+
+	return r.primary, nil
+}
+
+// QueryContext runs query on replica, retrying it on primary in case of failure.
+func (r *routedDB) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	db, rep := r.reader(ctx)
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err == nil || rep == nil || ctx.Err() != nil {
+		return rows, err
+	}
+
+	r.demote(ctx, rep, err)
+
+	return r.primary.QueryContext(ctx, query, args...)
+}
+
+// QueryRowContext runs query on replica, its errors are deferred to Scan, so no retries are made,
+// use queryRow for reads, that should survive replica failure.
+func (r *routedDB) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	db, _ := r.reader(ctx)
+
+	return db.QueryRowContext(ctx, query, args...)
+}
+
+// scanRow runs single-row query on replica and scans its result to `dest`, retrying it on primary
+// in case of failure (missing row is not one).
+func (r *routedDB) scanRow(ctx context.Context, query string, args []interface{}, dest ...interface{}) error {
+	db, rep := r.reader(ctx)
+
+	err := db.QueryRowContext(ctx, query, args...).Scan(dest...)
+	if err == nil || errors.Is(err, sql.ErrNoRows) || rep == nil || ctx.Err() != nil {
+		return err
+	}
+
+	r.demote(ctx, rep, err)
+
+	return r.primary.QueryRowContext(ctx, query, args...).Scan(dest...)
+}
+
+// queryRow runs single-row query on `db` and scans its result to `dest`,
+// reads, routed to replica, fall back to primary (see routedDB.scanRow).
+func queryRow(ctx context.Context, db sqlDB, query string, args []interface{}, dest ...interface{}) error {
+	if r, ok := db.(*routedDB); ok {
+		return r.scanRow(ctx, query, args, dest...)
+	}
+
+	return db.QueryRowContext(ctx, query, args...).Scan(dest...)
+}
+
+// ExecContext runs query on primary.
+func (r *routedDB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return r.primary.ExecContext(ctx, query, args...)
+}
+
+// BeginTx starts transaction on primary.
+func (r *routedDB) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	return r.primary.BeginTx(ctx, opts)
+}
+
+// demote excludes replica from routing, until next successful check.
+func (r *routedDB) demote(ctx context.Context, rep *replica, err error) {
+	if rep.healthy.CompareAndSwap(true, false) {
+		slog.WarnContext(ctx, "replica demoted", "replica", rep.name, "err", err)
+	}
+}
+
+// check updates replicas health by their lag.
+func (r *routedDB) check(ctx context.Context) {
+	var wg sync.WaitGroup
+
+	for _, rep := range r.replicas {
+		wg.Add(1)
+
+		go func(rep *replica) {
+			defer wg.Done()
+
+			lag, err := r.lag(ctx, rep.db)
+			if err == nil && lag > r.maxLag {
+				err = fmt.Errorf("lag %s exceeds %s", lag, r.maxLag)
+			}
+
+			if err != nil {
+				r.demote(ctx, rep, err)
+
+				return
+			}
+
+			if !rep.healthy.Swap(true) {
+				slog.InfoContext(ctx, "replica promoted", "replica", rep.name, "lag", lag)
+			}
+		}(rep)
+	}
+
+	wg.Wait()
+}
+
+// watch checks replicas, until `ctx` is done.
+func (r *routedDB) watch(ctx context.Context, every time.Duration) {
+	tick := time.NewTicker(every)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			r.check(ctx)
+		}
+	}
+}
+
+// lagFor returns lag function for given backend.
+func lagFor(backend string) lagFunc {
+	if backend == backendPostgres {
+		return pgLag
+	}
+
+	return mysqlLag
+}
+
+// pgLag reports time since last replayed transaction, zero - for caught up replica (or primary).
+func pgLag(ctx context.Context, db *sql.DB) (time.Duration, error) {
+	const query = `
+SELECT
+	CASE
+		WHEN NOT pg_is_in_recovery() OR pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+		ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0)
+	END`
+
+	var sec float64
+
+	if err := db.QueryRowContext(ctx, query).Scan(&sec); err != nil {
+		return 0, err
+	}
+
+	return time.Duration(sec * float64(time.Second)), nil
+}
+
+// mysqlLag reports `Seconds_Behind_Source` of replica, zero - for primary, servers older than
+// 8.0.22 (that have no `SHOW REPLICA STATUS`) are asked with pre-8.0.22 names.
+func mysqlLag(ctx context.Context, db *sql.DB) (time.Duration, error) {
+	lag, err := mysqlStatusLag(ctx, db, `SHOW REPLICA STATUS`, "Seconds_Behind_Source")
+	if err == nil {
+		return lag, nil
+	}
+
+	if lag, oerr := mysqlStatusLag(ctx, db, `SHOW SLAVE STATUS`, "Seconds_Behind_Master"); oerr == nil {
+		return lag, nil
+	}
+
+	return 0, err
+}
+
+// mysqlStatusLag reads lag from column `col` of replication status, returned by `query`.
+func mysqlStatusLag(ctx context.Context, db *sql.DB, query, col string) (time.Duration, error) {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+
+	if !rows.Next() {
+		return 0, rows.Err()
+	}
+
+	vals := make([]sql.NullInt64, len(cols))
+	ptrs := make([]interface{}, len(cols))
+
+	for i := range cols {
+		if cols[i] == col {
+			ptrs[i] = &vals[i]
+		} else {
+			ptrs[i] = new(sql.RawBytes)
+		}
+	}
+
+	if err = rows.Scan(ptrs...); err != nil {
+		return 0, err
+	}
+
+	for i := range cols {
+		if cols[i] != col {
+			continue
+		}
+
+		if !vals[i].Valid {
+			return 0, errors.New("replication is not running")
+		}
+
+		return time.Duration(vals[i].Int64) * time.Second, nil
+	}
+
+	return 0, fmt.Errorf("no %s in replication status", col)
+}
+
+// openReplicas connects to configured replicas of database, returned function stops
+// lag checks and closes connections, unreachable replicas are not an error: they are
+// excluded from routing, until they catch up.
+func openReplicas(primary *sql.DB, dbc *dbConfig, backend, name string) (*routedDB, func(), error) {
+	reps := make([]*replica, 0, len(dbc.Replicas))
+
+	closeAll := func() {
+		for _, rep := range reps {
+			if err := rep.db.Close(); err != nil {
+				slog.Error(rep.name+" close", "err", err)
+			}
+		}
+	}
+
+	for i, dsn := range dbc.Replicas {
+		rc := *dbc
+		rc.DSN = dsn
+
+		db, err := connectDB(backend, &rc)
+		if db == nil {
+			closeAll()
+
+			return nil, nil, fmt.Errorf("%s replica %d: %w", name, i, err)
+		}
+
+		rep := &replica{name: fmt.Sprintf("%s-replica-%d", name, i), db: db}
+		if err != nil {
+			slog.Warn("replica unavailable", "replica", rep.name, "err", err)
+		}
+
+		reps = append(reps, rep)
+	}
+
+	r := newRoutedDB(primary, reps, lagFor(backend), dbc.MaxLag)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	r.check(ctx)
+
+	go r.watch(ctx, replicaCheckInterval)
+
+	return r, func() {
+		cancel()
+		closeAll()
+	}, nil
+}
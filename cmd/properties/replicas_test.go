@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRoutedDB(t *testing.T) {
+	ctx := context.Background()
+
+	open := func(name string) *sql.DB {
+		db := openTestSQLite(t, "")
+
+		execSQL(t, db, `CREATE TABLE node(name TEXT)`)
+		execSQL(t, db, `INSERT INTO node VALUES ('`+name+`')`)
+
+		return db
+	}
+
+	primary := open("primary")
+	reps := []*replica{
+		{name: "r0", db: open("r0")},
+		{name: "r1", db: open("r1")},
+	}
+
+	var (
+		mu  sync.Mutex
+		lag = map[*sql.DB]time.Duration{}
+	)
+
+	lagFn := func(_ context.Context, db *sql.DB) (time.Duration, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if l := lag[db]; l >= 0 {
+			return l, nil
+		}
+
+		return 0, errors.New("down")
+	}
+
+	setLag := func(i int, d time.Duration) {
+		mu.Lock()
+		lag[reps[i].db] = d
+		mu.Unlock()
+	}
+
+	r := newRoutedDB(primary, reps, lagFn, time.Second)
+
+	node := func(ctx context.Context) (name string) {
+		if err := r.QueryRowContext(ctx, `SELECT name FROM node`).Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+
+		return name
+	}
+
+	nodes := func(ctx context.Context) map[string]bool {
+		seen := map[string]bool{}
+
+		for i := 0; i < 4; i++ {
+			seen[node(ctx)] = true
+		}
+
+		return seen
+	}
+
+	if seen := nodes(ctx); len(seen) != 1 || !seen["primary"] {
+		t.Fatal("step 1 fail: unchecked replicas used:", seen)
+	}
+
+	r.check(ctx)
+
+	if seen := nodes(ctx); len(seen) != 2 || !seen["r0"] || !seen["r1"] {
+		t.Fatal("step 2 fail: reads not spread:", seen)
+	}
+
+	if seen := nodes(withPrimary(ctx)); len(seen) != 1 || !seen["primary"] {
+		t.Fatal("step 3 fail: marked read not on primary:", seen)
+	}
+
+	setLag(0, 2*time.Second)
+	r.check(ctx)
+
+	if seen := nodes(ctx); len(seen) != 1 || !seen["r1"] {
+		t.Fatal("step 4 fail: lagging replica used:", seen)
+	}
+
+	setLag(1, -1)
+	r.check(ctx)
+
+	if seen := nodes(ctx); len(seen) != 1 || !seen["primary"] {
+		t.Fatal("step 5 fail: no fallback to primary:", seen)
+	}
+
+	setLag(0, 0)
+	setLag(1, 0)
+	r.check(ctx)
+
+	// broken replica is demoted, query is retried on primary
+	execSQL(t, reps[0].db, `DROP TABLE node`)
+
+	for i := 0; i < 4; i++ {
+		rows, err := r.QueryContext(ctx, `SELECT name FROM node`)
+		if err != nil {
+			t.Fatal("step 6 fail:", err)
+		}
+
+		rows.Close()
+	}
+
+	if reps[0].healthy.Load() || !reps[1].healthy.Load() {
+		t.Fatal("step 7 fail: broken replica not demoted")
+	}
+
+	if _, err := r.ExecContext(ctx, `INSERT INTO node VALUES ('w')`); err != nil {
+		t.Fatal(err)
+	}
+
+	var n int
+
+	if err := primary.QueryRow(`SELECT COUNT(*) FROM node`).Scan(&n); err != nil || n != 2 {
+		t.Fatal("step 8 fail: write not on primary:", n, err)
+	}
+
+	var name string
+
+	if err := queryRow(ctx, r, `SELECT name FROM node WHERE name = ?`, []interface{}{"none"}, &name); !errors.Is(err, sql.ErrNoRows) ||
+		!reps[1].healthy.Load() {
+		t.Fatal("step 9 fail: replica demoted for missing row:", err)
+	}
+
+	// single-row read on broken replica is retried on primary as well
+	execSQL(t, reps[1].db, `DROP TABLE node`)
+
+	if err := queryRow(ctx, r, `SELECT name FROM node WHERE name <> ?`, []interface{}{"w"}, &name); err != nil || name != "primary" {
+		t.Fatal("step 10 fail: no fallback to primary:", name, err)
+	}
+
+	if reps[1].healthy.Load() {
+		t.Fatal("step 11 fail: broken replica not demoted")
+	}
+}
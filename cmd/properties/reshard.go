@@ -0,0 +1,632 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// reshard modes.
+const (
+	reshardCopy    = "copy"
+	reshardCleanup = "cleanup"
+)
+
+const (
+	queryReshardUsers = `
+SELECT user_id FROM user_settings WHERE user_id > ?
+UNION
+SELECT user_id FROM user_settings_audit WHERE user_id > ?
+ORDER BY
+	user_id
+LIMIT ?`
+
+	queryReshardRevisions = `
+SELECT
+	settings,
+	created_at,
+	expires_at,
+	origin
+FROM
+	user_settings
+WHERE
+	user_id = ?`
+
+	queryReshardRevisionAdd = `
+INSERT INTO user_settings
+	(user_id, settings, created_at, expires_at, origin)
+VALUES
+	(?, ?, ?, ?, ?)`
+
+	queryReshardAudit = `
+SELECT
+	action,
+	items,
+	tag,
+	actor,
+	caller,
+	on_behalf_of,
+	reason,
+	created_at
+FROM
+	user_settings_audit
+WHERE
+	user_id = ?`
+
+	queryReshardAuditAdd = `
+INSERT INTO user_settings_audit
+	(user_id, action, items, tag, actor, caller, on_behalf_of, reason, created_at)
+VALUES
+	(?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	queryReshardKeys = `
+SELECT
+	id_key,
+	request_hash,
+	status,
+	body,
+	created_at
+FROM
+	user_settings_idempotency
+WHERE
+	user_id = ?`
+
+	queryReshardKeyAdd = `
+INSERT INTO user_settings_idempotency
+	(user_id, id_key, request_hash, status, body, created_at)
+VALUES
+	(?, ?, ?, ?, ?, ?)`
+
+	// target keeps its own outcome of key, unless it is older, than copied one.
+	queryReshardKeyStale = `DELETE FROM user_settings_idempotency WHERE id_key = ? AND created_at <= ?`
+	queryReshardKeyHave  = `SELECT COUNT(*) FROM user_settings_idempotency WHERE id_key = ?`
+
+	queryReshardEvents = `
+SELECT
+	payload,
+	attempts,
+	dead
+FROM
+	user_settings_outbox
+WHERE
+	user_id = ?
+ORDER BY
+	id`
+
+	queryReshardEventAdd = `
+INSERT INTO user_settings_outbox
+	(user_id, payload, attempts, dead)
+VALUES
+	(?, ?, ?, ?)`
+)
+
+// reshardAttempts limits copies of user, that changes on source, while it is removed from there.
+const reshardAttempts = 3
+
+// errReshardChanged is returned, when user rows on source changed since they were copied.
+var errReshardChanged = errors.New("user changed on source since copy")
+
+// reshardTable describes user rows of table, moved by resharder.
+type reshardTable struct {
+	name string
+	// query selects user rows, insert adds one of them (with user_id prepended).
+	query, insert string
+	// stale and have are set for keyed tables (key goes first in rows, creation time - last):
+	// stale removes older row with same key, have counts rows left with it.
+	stale, have string
+	// moved rows are copied only by cleanup, as source consumes them until user is removed from it
+	// (relay publishes outbox events), and copies would be consumed once more on target.
+	moved bool
+}
+
+// reshardTables lists tables, moved by resharder, in copy order; current state is rebuilt on target.
+var reshardTables = []reshardTable{
+	{name: "user_settings", query: queryReshardRevisions, insert: queryReshardRevisionAdd},
+	{name: "user_settings_audit", query: queryReshardAudit, insert: queryReshardAuditAdd},
+	{
+		name: "user_settings_idempotency", query: queryReshardKeys, insert: queryReshardKeyAdd,
+		stale: queryReshardKeyStale, have: queryReshardKeyHave,
+	},
+	{name: "user_settings_outbox", query: queryReshardEvents, insert: queryReshardEventAdd, moved: true},
+}
+
+// shardLayout describes placement of users among databases, unsharded config
+// is a layout with single shard.
+type shardLayout struct {
+	m    shardMap
+	dbcs []*dbConfig
+}
+
+func layoutOf(cfg *config) (l shardLayout) {
+	if len(cfg.DB.UserShards) == 0 {
+		return shardLayout{m: moduloMap(1), dbcs: []*dbConfig{&cfg.DB.Users}}
+	}
+
+	names := make([]string, len(cfg.DB.UserShards))
+
+	for i := range cfg.DB.UserShards {
+		names[i] = cfg.DB.UserShards[i].Name
+		l.dbcs = append(l.dbcs, &cfg.DB.UserShards[i].dbConfig)
+	}
+
+	l.m = newShardMap(cfg.DB.Sharding, names)
+
+	return l
+}
+
+// dsn returns dsn of database, that holds given user.
+func (l *shardLayout) dsn(userID int) string {
+	return l.dbcs[l.m.Shard(userID)].DSN
+}
+
+// ReshardStats holds resharding results.
+type ReshardStats struct {
+	Users     int
+	Revisions int
+	Audit     int
+	Keys      int
+	Events    int
+	Removed   int
+}
+
+// rowsQuerier is a common part of *sql.DB and *sql.Tx.
+type rowsQuerier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// resharder moves users between databases of two layouts, databases are identified by their dsn.
+//
+// Users rows are merged into target database (rows already present there are skipped), so copy can
+// be repeated any time: before layout switch (to move the bulk of data), and after it (to catch up
+// changes, made meanwhile). Archived revisions are not moved, they stay on the original database.
+//
+// Cleanup removes user from source only if its rows there are exactly ones, that were copied,
+// otherwise user is copied again; writes to old layout must be stopped before cleanup anyway,
+// as ones, made after removal, stay on source unseen.
+type resharder struct {
+	bind     func(string) string
+	upsert   string
+	from, to shardLayout
+	dbs      map[string]*sql.DB
+}
+
+// Run copies users, whose database changes, from every database of old layout, with `cleanup`
+// copied users are removed from source database.
+func (rs *resharder) Run(ctx context.Context, cleanup bool) (st ReshardStats, err error) {
+	seen := make(map[string]bool)
+
+	for _, dbc := range rs.from.dbcs {
+		if seen[dbc.DSN] {
+			continue
+		}
+
+		seen[dbc.DSN] = true
+
+		if err = rs.moveFrom(ctx, dbc.DSN, cleanup, &st); err != nil {
+			return st, err
+		}
+	}
+
+	return st, nil
+}
+
+func (rs *resharder) moveFrom(ctx context.Context, dsn string, cleanup bool, st *ReshardStats) error {
+	var (
+		src   = rs.dbs[dsn]
+		after int
+	)
+
+	for {
+		rows, err := src.QueryContext(ctx, rs.bind(queryReshardUsers), after, after, compactBatch)
+		if err != nil {
+			return err
+		}
+
+		users, err := readInts(rows)
+		if err != nil {
+			return err
+		}
+
+		for _, uid := range users {
+			dst := rs.to.dsn(uid)
+			if dst == dsn {
+				continue
+			}
+
+			if err = rs.moveUser(ctx, src, rs.dbs[dst], uid, cleanup, st); err != nil {
+				return fmt.Errorf("user %d: %w", uid, err)
+			}
+		}
+
+		if len(users) < compactBatch {
+			return nil
+		}
+
+		after = users[len(users)-1]
+	}
+}
+
+// moveUser copies user to `dst`, with `cleanup` user is removed from `src` then, copy is
+// repeated, if user changes on source meanwhile.
+func (rs *resharder) moveUser(ctx context.Context, src, dst *sql.DB, userID int, cleanup bool, st *ReshardStats) error {
+	for attempt := 1; ; attempt++ {
+		n, snap, err := rs.copyUser(ctx, src, dst, userID, cleanup)
+		if err != nil {
+			return err
+		}
+
+		st.Revisions += n[0]
+		st.Audit += n[1]
+		st.Keys += n[2]
+		st.Events += n[3]
+
+		if !cleanup {
+			break
+		}
+
+		switch err = rs.dropUser(ctx, src, userID, snap); {
+		case err == nil:
+			st.Removed++
+		case errors.Is(err, errReshardChanged) && attempt < reshardAttempts:
+			continue
+		default:
+			return err
+		}
+
+		break
+	}
+
+	st.Users++
+
+	return nil
+}
+
+// copyUser merges user rows of reshardTables (moved ones only with `all`) into `dst`, and refreshes
+// its projection, it returns count of rows copied per table, and snapshot of source rows.
+func (rs *resharder) copyUser(
+	ctx context.Context,
+	src, dst *sql.DB,
+	userID int,
+	all bool,
+) (n [4]int, snap string, err error) {
+	tx, err := dst.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	var sb strings.Builder
+
+	for i, t := range reshardTables {
+		if t.moved && !all {
+			continue
+		}
+
+		rows, err := userRows(ctx, src, rs.bind(t.query), userID)
+		if err != nil {
+			return n, "", err
+		}
+
+		sb.WriteString(rowsKey(t.name, rows))
+
+		if n[i], err = rs.merge(ctx, tx, t, userID, rows); err != nil {
+			return n, "", fmt.Errorf("%s: %w", t.name, err)
+		}
+	}
+
+	if n[0] > 0 {
+		var id int
+
+		if err = tx.QueryRowContext(ctx, rs.bind(queryLatestRevision), userID).Scan(&id); err != nil {
+			return
+		}
+
+		if _, err = tx.ExecContext(ctx, rs.upsert, id); err != nil {
+			return
+		}
+	}
+
+	return n, sb.String(), tx.Commit()
+}
+
+// merge inserts user `rows` of table, missing in `tx`, rows are counted as multiset: identical ones
+// (e.g. audit records of repeated request) are copied as many times, as they are missing.
+func (rs *resharder) merge(ctx context.Context, tx *sql.Tx, t reshardTable, userID int, rows [][]interface{}) (n int, err error) {
+	have, err := userRows(ctx, tx, rs.bind(t.query), userID)
+	if err != nil {
+		return
+	}
+
+	keys := make(map[string]int, len(have))
+
+	for _, row := range have {
+		keys[rowKey(row)]++
+	}
+
+	for _, row := range rows {
+		if k := rowKey(row); keys[k] > 0 {
+			keys[k]--
+
+			continue
+		}
+
+		if t.stale != "" {
+			var left int
+
+			if _, err = tx.ExecContext(ctx, rs.bind(t.stale), row[0], row[len(row)-1]); err != nil {
+				return
+			}
+
+			if err = tx.QueryRowContext(ctx, rs.bind(t.have), row[0]).Scan(&left); err != nil {
+				return
+			}
+
+			if left > 0 {
+				continue
+			}
+		}
+
+		if _, err = tx.ExecContext(ctx, rs.bind(t.insert), append([]interface{}{userID}, row...)...); err != nil {
+			return
+		}
+
+		n++
+	}
+
+	return n, nil
+}
+
+// dropUser removes user rows (except archived ones) from database, if they are same, as `snap`
+// taken by copy; errReshardChanged is returned otherwise, and nothing is removed.
+func (rs *resharder) dropUser(ctx context.Context, db *sql.DB, userID int, snap string) (err error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	var (
+		sb    strings.Builder
+		count int64
+	)
+
+	for _, t := range reshardTables {
+		rows, err := userRows(ctx, tx, rs.bind(t.query), userID)
+		if err != nil {
+			return err
+		}
+
+		sb.WriteString(rowsKey(t.name, rows))
+
+		count += int64(len(rows))
+	}
+
+	if sb.String() != snap {
+		return errReshardChanged
+	}
+
+	if _, err = tx.ExecContext(ctx, rs.bind("DELETE FROM user_settings_current WHERE user_id = ?"), userID); err != nil {
+		return
+	}
+
+	for _, t := range reshardTables {
+		res, err := tx.ExecContext(ctx, rs.bind("DELETE FROM "+t.name+" WHERE user_id = ?"), userID)
+		if err != nil {
+			return err
+		}
+
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		count -= n
+	}
+
+	// rows, written after check, would be removed uncopied.
+	if count != 0 {
+		return errReshardChanged
+	}
+
+	return tx.Commit()
+}
+
+// userRows reads rows of `query` for given user, column values are kept as driver returns them.
+func userRows(ctx context.Context, q rowsQuerier, query string, userID int) (rv [][]interface{}, err error) {
+	rows, err := q.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		row := make([]interface{}, len(cols))
+		ptrs := make([]interface{}, len(cols))
+
+		for i := range row {
+			ptrs[i] = &row[i]
+		}
+
+		if err = rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+
+		rv = append(rv, row)
+	}
+
+	return rv, rows.Err()
+}
+
+// rowsKey builds comparable key for rows of table, regardless of their order.
+func rowsKey(table string, rows [][]interface{}) string {
+	keys := make([]string, len(rows))
+
+	for i, row := range rows {
+		keys[i] = rowKey(row)
+	}
+
+	sort.Strings(keys)
+
+	return table + ":" + strings.Join(keys, ";") + "\n"
+}
+
+// rowKey builds comparable key for row values.
+func rowKey(row []interface{}) string {
+	var sb strings.Builder
+
+	for _, v := range row {
+		switch t := v.(type) {
+		case time.Time:
+			fmt.Fprintf(&sb, "t%d|", t.UnixNano())
+		case []byte:
+			fmt.Fprintf(&sb, "b%x|", t)
+		default:
+			fmt.Fprintf(&sb, "v%v|", t)
+		}
+	}
+
+	return sb.String()
+}
+
+// reshardCommand implements `reshard -from old.yaml [flags] copy|cleanup` command, new layout
+// is taken from config (with env overrides), old one - from file only.
+func reshardCommand(args []string, getenv func(string) string, w io.Writer) error {
+	var (
+		fs   = flag.NewFlagSet("reshard", flag.ContinueOnError)
+		path = fs.String("config", getenv(envConfig), "path to yaml config file with new layout")
+		from = fs.String("from", "", "path to yaml config file with old layout")
+	)
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	mode := fs.Arg(0)
+
+	if fs.NArg() != 1 || *from == "" || (mode != reshardCopy && mode != reshardCleanup) {
+		return errors.New("usage: reshard -from old.yaml [flags] copy|cleanup")
+	}
+
+	oldCfg, err := readConfig(*from, func(string) string { return "" })
+	if err != nil {
+		return err
+	}
+
+	newCfg, err := readConfig(*path, getenv)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range []*config{&oldCfg, &newCfg} {
+		if err = c.Validate(); err != nil {
+			return err
+		}
+	}
+
+	rs, closeFn, err := openResharder(&newCfg, layoutOf(&oldCfg), layoutOf(&newCfg))
+	if err != nil {
+		return err
+	}
+
+	defer closeFn()
+
+	st, err := rs.Run(context.Background(), mode == reshardCleanup)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "users moved: %d, revisions copied: %d, audit records copied: %d, "+
+		"idempotency keys copied: %d, events moved: %d, users removed: %d\n",
+		st.Users, st.Revisions, st.Audit, st.Keys, st.Events, st.Removed)
+
+	return err
+}
+
+// openResharder connects to every database of both layouts, they all must share one sql backend.
+func openResharder(cfg *config, from, to shardLayout) (rs *resharder, closeFn func(), err error) {
+	var (
+		backend string
+		closers []func()
+	)
+
+	closeFn = func() {
+		for _, fn := range closers {
+			fn()
+		}
+	}
+
+	rs = &resharder{from: from, to: to, dbs: make(map[string]*sql.DB)}
+
+	for _, dbc := range append(append([]*dbConfig{}, from.dbcs...), to.dbcs...) {
+		if _, ok := rs.dbs[dbc.DSN]; ok {
+			continue
+		}
+
+		b := backendOf(dbc.DSN)
+
+		switch {
+		case b == backendMemory:
+			err = errors.New("in-memory store can not be resharded")
+		case backend != "" && b != backend:
+			err = fmt.Errorf("mixed backends: %s and %s", backend, b)
+		}
+
+		if err != nil {
+			closeFn()
+
+			return nil, nil, err
+		}
+
+		backend = b
+
+		name := fmt.Sprintf("user-db-%d", len(rs.dbs))
+
+		db, dbClose, err := openDB(cfg, dbc, backend, name)
+		if err != nil {
+			closeFn()
+
+			return nil, nil, err
+		}
+
+		closers = append(closers, dbClose)
+
+		if err = prepareSchema(context.Background(), db, dbc, backend, schemaUsers); err != nil {
+			closeFn()
+
+			return nil, nil, fmt.Errorf("%s schema: %w", name, err)
+		}
+
+		rs.dbs[dbc.DSN] = db
+	}
+
+	rs.bind = func(q string) string { return q }
+	if backend == backendPostgres {
+		rs.bind = rebind
+	}
+
+	rs.upsert = rs.bind(currentUpsert(backend))
+
+	return rs, closeFn, nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReshard(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		dir  = t.TempDir()
+		dsnA = sqlitePrefix + filepath.Join(dir, "a.db")
+		dsnB = sqlitePrefix + filepath.Join(dir, "b.db")
+		from = filepath.Join(dir, "old.yaml")
+		to   = filepath.Join(dir, "new.yaml")
+	)
+
+	files := map[string]string{
+		from: `
+db:
+  settings:
+    dsn: "memory:"
+  users:
+    dsn: ` + dsnA + `
+`,
+		to: `
+db:
+  settings:
+    dsn: "memory:"
+  sharding: modulo
+  user_shards:
+    - name: a
+      dsn: ` + dsnA + `
+    - name: b
+      dsn: ` + dsnB + `
+      auto_migrate: true
+`,
+	}
+
+	for path, body := range files {
+		if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	open := func(dsn string) *sql.DB {
+		db, err := sql.Open(backendSQLite, sqliteDSN(dsn))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		t.Cleanup(func() { db.Close() })
+
+		return db
+	}
+
+	dbA := open(dsnA)
+	migrateTest(t, dbA, backendSQLite, schemaUsers)
+
+	old := NewSQLiteUserStore(dbA, userStoreOptions{Codec: cborCodec{}})
+
+	for uid := 1; uid <= 6; uid++ {
+		for _, b := range []int{uid, uid * 10} {
+			if err := old.Set(ctx, uid, UserSettings{Bundles: []int{b}}, Change{Action: "set-bundles"}); err != nil {
+				t.Fatal(err)
+			}
+
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// identical audit records (same request, repeated within one timestamp) must be copied all.
+	if _, err := dbA.Exec(`
+INSERT INTO user_settings_audit
+	(user_id, action, items, tag, actor, caller, on_behalf_of, reason, created_at)
+SELECT
+	user_id, action, items, tag, actor, caller, on_behalf_of, reason, created_at
+FROM
+	user_settings_audit
+WHERE
+	user_id = 1`); err != nil {
+		t.Fatal(err)
+	}
+
+	// idempotency keys move along with users, pending events - only by cleanup.
+	if _, err := idempotencyOf(old).Claim(ctx, 1, "k1", "h1", time.Now().Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	execSQL(t, dbA, `INSERT INTO user_settings_outbox (user_id, payload) VALUES (3, 'event')`)
+
+	reshard := func(mode string) string {
+		var buf bytes.Buffer
+
+		if err := reshardCommand([]string{"-config", to, "-from", from, mode}, func(string) string { return "" }, &buf); err != nil {
+			t.Fatal(mode, err)
+		}
+
+		return buf.String()
+	}
+
+	if out := reshard(reshardCopy); !strings.Contains(out, "users moved: 3, revisions copied: 6, audit records copied: 8, "+
+		"idempotency keys copied: 1, events moved: 0") {
+		t.Fatal("step 1 fail:", out)
+	}
+
+	dbB := open(dsnB)
+	us := NewShardedUserStore(moduloMap(2), []UserStore{old, NewSQLiteUserStore(dbB, userStoreOptions{Codec: cborCodec{}})})
+
+	rv, err := us.GetMany(ctx, []int{1, 2, 3, 4, 5, 6}, time.Now())
+	if err != nil {
+		t.Fatal("step 2 fail:", err)
+	}
+
+	for uid := 1; uid <= 6; uid++ {
+		if !sameInts(rv[uid].Bundles, []int{uid * 10}) {
+			t.Fatal("step 3 fail:", uid, rv[uid])
+		}
+	}
+
+	if recs, err := us.Audit(ctx, AuditFilter{UserID: 1}); err != nil || len(recs) != 4 {
+		t.Fatal("step 4 fail:", recs, err)
+	}
+
+	// change made after layout switch must survive repeated copy.
+	if err = us.Set(ctx, 1, UserSettings{Bundles: []int{100}}, Change{Action: "set-bundles"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if out := reshard(reshardCopy); !strings.Contains(out, "revisions copied: 0, audit records copied: 0, idempotency keys copied: 0") {
+		t.Fatal("step 5 fail:", out)
+	}
+
+	if out := reshard(reshardCleanup); !strings.Contains(out, "events moved: 1, users removed: 3") {
+		t.Fatal("step 6 fail:", out)
+	}
+
+	var n int
+
+	if err = dbA.QueryRow(`SELECT COUNT(*) FROM user_settings WHERE user_id % 2 = 1`).Scan(&n); err != nil || n != 0 {
+		t.Fatal("step 7 fail: moved users left on source", n, err)
+	}
+
+	for i, q := range []string{
+		`SELECT COUNT(*) FROM user_settings_idempotency WHERE user_id = 1 AND id_key = 'k1'`,
+		`SELECT COUNT(*) FROM user_settings_outbox WHERE user_id = 3 AND payload = 'event'`,
+	} {
+		if err = dbA.QueryRow(q).Scan(&n); err != nil || n != 0 {
+			t.Fatal("step 7.1 fail:", i, n, err)
+		}
+
+		if err = dbB.QueryRow(q).Scan(&n); err != nil || n != 1 {
+			t.Fatal("step 7.2 fail:", i, n, err)
+		}
+	}
+
+	if s, err := us.Get(ctx, 1, time.Now()); err != nil || !sameInts(s.Bundles, []int{100}) {
+		t.Fatal("step 8 fail:", s, err)
+	}
+
+	if out := reshard(reshardCopy); !strings.Contains(out, "users moved: 0") {
+		t.Fatal("step 9 fail:", out)
+	}
+
+	if err = reshardCommand([]string{"-config", to, "copy"}, func(string) string { return "" }, &bytes.Buffer{}); err == nil {
+		t.Fatal("step 10 fail: no old layout accepted")
+	}
+
+	// user, changed on source since copy, is kept there.
+	rs := &resharder{bind: func(q string) string { return q }}
+
+	if err = rs.dropUser(ctx, dbA, 2, "stale"); !errors.Is(err, errReshardChanged) {
+		t.Fatal("step 11 fail:", err)
+	}
+
+	if err = dbA.QueryRow(`SELECT COUNT(*) FROM user_settings WHERE user_id = 2`).Scan(&n); err != nil || n != 2 {
+		t.Fatal("step 12 fail:", n, err)
+	}
+}
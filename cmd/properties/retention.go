@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// compactBatch is a number of users, processed by single query.
+const compactBatch = 500
+
+// CompactStats holds results of single compaction run.
+type CompactStats struct {
+	// Users is a number of users, whose history was inspected.
+	Users int
+	// Archived is a number of revisions, moved to archive.
+	Archived int
+}
+
+// revisionSpan is a lifetime of single user settings revision.
+type revisionSpan struct {
+	CreatedAt time.Time
+	ExpiresAt *time.Time
+}
+
+// supersededRevisions takes user revisions created before `cutoff` (ordered newest first), and returns
+// indexes of ones, that can not be an answer to UserStore.Get for any moment since `cutoff`: revision is
+// needed only if it is alive at `cutoff` and outlives every newer one (which hides it otherwise).
+func supersededRevisions(revs []revisionSpan, cutoff time.Time) (rv []int) {
+	var (
+		last    *time.Time // longest expiration among kept ones
+		forever bool       // kept one never expires
+	)
+
+	for i := range revs {
+		r := &revs[i]
+
+		switch {
+		case forever,
+			r.ExpiresAt != nil && !r.ExpiresAt.After(cutoff),
+			r.ExpiresAt != nil && last != nil && !r.ExpiresAt.After(*last):
+			rv = append(rv, i)
+
+			continue
+		}
+
+		if r.ExpiresAt == nil {
+			forever = true
+		} else {
+			last = r.ExpiresAt
+		}
+	}
+
+	return rv
+}
+
+// sqlCompactor moves superseded revisions from `user_settings` to `user_settings_archive`,
+// its hooks adapt it to particular database.
+type sqlCompactor struct {
+	db sqlDB
+	// bind converts `?` placeholders to ones driver understands.
+	bind func(query string) string
+	// arg converts time to query argument.
+	arg func(t time.Time) interface{}
+	// scan reads revision id and span from row.
+	scan func(rows *sql.Rows) (id int, r revisionSpan, err error)
+	// lock is a row-locking clause for select, if database supports one.
+	lock string
+}
+
+// Run compacts history of every user, created before `cutoff`, one user per transaction.
+func (c *sqlCompactor) Run(ctx context.Context, cutoff time.Time) (st CompactStats, err error) {
+	ctx = withPrimary(ctx)
+
+	const query = `
+SELECT DISTINCT
+	user_id
+FROM
+	user_settings
+WHERE
+	user_id > ?
+	AND
+	created_at <= ?
+ORDER BY
+	user_id
+LIMIT ?`
+
+	var (
+		rows  *sql.Rows
+		users []int
+		after int
+	)
+
+	for {
+		if rows, err = c.db.QueryContext(ctx, c.bind(query), after, c.arg(cutoff), compactBatch); err != nil {
+			return
+		}
+
+		if users, err = readInts(rows); err != nil {
+			return
+		}
+
+		for _, uid := range users {
+			n, err := c.compactUser(ctx, uid, cutoff)
+			if err != nil {
+				return st, err
+			}
+
+			st.Users++
+			st.Archived += n
+		}
+
+		if len(users) < compactBatch {
+			return st, nil
+		}
+
+		after = users[len(users)-1]
+	}
+}
+
+func (c *sqlCompactor) compactUser(ctx context.Context, userID int, cutoff time.Time) (n int, err error) {
+	const (
+		querySelect = `
+SELECT
+	id,
+	created_at,
+	expires_at
+FROM
+	user_settings
+WHERE
+	user_id = ?
+	AND
+	created_at <= ?
+ORDER BY
+	created_at DESC, id DESC`
+
+		queryArchive = `
+INSERT INTO user_settings_archive
+	(id, user_id, settings, created_at, expires_at)
+SELECT
+	id, user_id, settings, created_at, expires_at
+FROM
+	user_settings
+WHERE
+	id IN (%s)`
+
+		queryDelete = `
+DELETE FROM
+	user_settings
+WHERE
+	id IN (%s)`
+	)
+
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	rows, err := tx.QueryContext(ctx, c.bind(querySelect+c.lock), userID, c.arg(cutoff))
+	if err != nil {
+		return
+	}
+
+	var (
+		ids   []int
+		spans []revisionSpan
+	)
+
+	for rows.Next() {
+		id, r, err := c.scan(rows)
+		if err != nil {
+			rows.Close()
+
+			return 0, err
+		}
+
+		ids = append(ids, id)
+		spans = append(spans, r)
+	}
+
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	drop := supersededRevisions(spans, cutoff)
+	if len(drop) == 0 {
+		return 0, tx.Commit()
+	}
+
+	args := make([]interface{}, len(drop))
+	for i, idx := range drop {
+		args[i] = ids[idx]
+	}
+
+	in := strings.TrimSuffix(strings.Repeat("?,", len(args)), ",")
+
+	if _, err = tx.ExecContext(ctx, c.bind(fmt.Sprintf(queryArchive, in)), args...); err != nil {
+		return
+	}
+
+	if _, err = tx.ExecContext(ctx, c.bind(fmt.Sprintf(queryDelete, in)), args...); err != nil {
+		return
+	}
+
+	return len(drop), tx.Commit()
+}
+
+// scanRevision reads revision from row, for databases with native time support.
+func scanRevision(rows *sql.Rows) (id int, r revisionSpan, err error) {
+	var exp sql.NullTime
+
+	if err = rows.Scan(&id, &r.CreatedAt, &exp); err != nil {
+		return
+	}
+
+	if exp.Valid {
+		r.ExpiresAt = &exp.Time
+	}
+
+	return id, r, nil
+}
+
+// runRetention compacts user settings history older than configured horizon, until `ctx` is done.
+func runRetention(ctx context.Context, us UserStore, cfg *retentionConfig) {
+	tick := time.NewTicker(cfg.Interval)
+	defer tick.Stop()
+
+	for {
+		start := time.Now()
+
+		st, err := us.Compact(ctx, start.Add(-cfg.Horizon))
+		if err != nil {
+			slog.ErrorContext(ctx, "retention", "err", err)
+		} else {
+			slog.InfoContext(ctx, "retention", "users", st.Users, "archived", st.Archived,
+				"duration", time.Since(start))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+	}
+}
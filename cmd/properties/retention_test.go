@@ -0,0 +1,43 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSupersededRevisions(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(h int) *time.Time {
+		v := base.Add(time.Duration(h) * time.Hour)
+
+		return &v
+	}
+
+	cutoff := *at(10)
+
+	for i, c := range []struct {
+		exps []*time.Time // newest first
+		want []int
+	}{
+		{nil, nil},
+		{[]*time.Time{nil}, nil},
+		{[]*time.Time{nil, nil, nil}, []int{1, 2}},
+		{[]*time.Time{at(5)}, []int{0}},
+		{[]*time.Time{at(10)}, []int{0}},
+		{[]*time.Time{at(11), at(12), nil, nil}, []int{3}},
+		{[]*time.Time{at(12), at(11), nil}, []int{1}},
+		{[]*time.Time{at(12), at(12), at(5), nil}, []int{1, 2}},
+		{[]*time.Time{nil, at(20)}, []int{1}},
+	} {
+		revs := make([]revisionSpan, len(c.exps))
+
+		for j, e := range c.exps {
+			revs[j] = revisionSpan{CreatedAt: base.Add(-time.Duration(j) * time.Minute), ExpiresAt: e}
+		}
+
+		if rv := supersededRevisions(revs, cutoff); !reflect.DeepEqual(rv, c.want) {
+			t.Fatalf("case %d fail: want %v got %v", i, c.want, rv)
+		}
+	}
+}
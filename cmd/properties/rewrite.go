@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+)
+
+// payloadTables lists tables, holding user settings payloads, with their key columns.
+var payloadTables = []struct {
+	name, key string
+}{
+	{"user_settings", "id"},
+	{"user_settings_current", "user_id"},
+	{"user_settings_archive", "id"},
+}
+
+// RewriteStats holds payload rewrite results of single table.
+type RewriteStats struct {
+	Table     string
+	Scanned   int
+	Rewritten int
+}
+
+// rewritePayloads re-encodes payloads, not encoded with `codec`, with it, rows changed meanwhile
+// are skipped (new ones are written with configured codec anyway), with `dryRun` rows are only counted.
+func rewritePayloads(
+	ctx context.Context,
+	db *sql.DB,
+	bind func(string) string,
+	codec payloadCodec,
+	dryRun bool,
+) (rv []RewriteStats, err error) {
+	for _, t := range payloadTables {
+		st := RewriteStats{Table: t.name}
+
+		var (
+			querySelect = bind(`SELECT ` + t.key + `, settings FROM ` + t.name + `
+WHERE ` + t.key + ` > ? ORDER BY ` + t.key + ` LIMIT ?`)
+			queryUpdate = bind(`UPDATE ` + t.name + ` SET settings = ?
+WHERE ` + t.key + ` = ? AND settings = ?`)
+			after int
+		)
+
+		for {
+			rows, err := db.QueryContext(ctx, querySelect, after, compactBatch)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", t.name, err)
+			}
+
+			keys, bufs, err := readPayloads(rows)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", t.name, err)
+			}
+
+			for i, buf := range bufs {
+				st.Scanned++
+
+				if payloadVersion(buf) == codec.Version() {
+					continue
+				}
+
+				if dryRun {
+					st.Rewritten++
+
+					continue
+				}
+
+				n, err := rewritePayload(ctx, db, queryUpdate, codec, keys[i], buf)
+				if err != nil {
+					return nil, fmt.Errorf("%s %s=%d: %w", t.name, t.key, keys[i], err)
+				}
+
+				st.Rewritten += n
+			}
+
+			if len(keys) < compactBatch {
+				break
+			}
+
+			after = keys[len(keys)-1]
+		}
+
+		rv = append(rv, st)
+	}
+
+	return rv, nil
+}
+
+// rewritePayload re-encodes single payload, it reports number of updated rows.
+func rewritePayload(ctx context.Context, db *sql.DB, query string, codec payloadCodec, key int, old []byte) (int, error) {
+	bundles, err := decodePayload(old)
+	if err != nil {
+		return 0, err
+	}
+
+	buf, err := encodePayload(codec, bundles)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := db.ExecContext(ctx, query, buf, key, old)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+
+	return int(n), err
+}
+
+// readPayloads reads key-payload pairs from rows, and closes them.
+func readPayloads(rows *sql.Rows) (keys []int, bufs [][]byte, err error) {
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			k   int
+			buf []byte
+		)
+
+		if err = rows.Scan(&k, &buf); err != nil {
+			return nil, nil, err
+		}
+
+		keys = append(keys, k)
+		bufs = append(bufs, buf)
+	}
+
+	return keys, bufs, rows.Err()
+}
+
+// rewriteCommand implements `rewrite-payloads [flags]` command.
+func rewriteCommand(args []string, getenv func(string) string, w io.Writer) error {
+	var (
+		fs     = flag.NewFlagSet("rewrite-payloads", flag.ContinueOnError)
+		path   = fs.String("config", getenv(envConfig), "path to yaml config file")
+		name   = fs.String("codec", "", "target codec: cbor, json or delta (default - from config)")
+		dryRun = fs.Bool("dry-run", false, "only count payloads to rewrite")
+	)
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() > 0 {
+		return errors.New("usage: rewrite-payloads [flags]")
+	}
+
+	cfg, err := readConfig(*path, getenv)
+	if err != nil {
+		return err
+	}
+
+	if *name != "" {
+		cfg.DB.Codec = *name
+	}
+
+	if err = cfg.Validate(); err != nil {
+		return err
+	}
+
+	var (
+		ctx    = context.Background()
+		codec  = codecByName(cfg.DB.Codec)
+		layout = layoutOf(&cfg)
+		seen   = make(map[string]bool)
+	)
+
+	for i, dbc := range layout.dbcs {
+		if seen[dbc.DSN] {
+			continue
+		}
+
+		seen[dbc.DSN] = true
+
+		if err = rewriteDB(ctx, &cfg, dbc, fmt.Sprintf("user-db-%d", i), codec, *dryRun, w); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rewriteDB rewrites payloads of single users database, reporting results to `w`.
+func rewriteDB(ctx context.Context, cfg *config, dbc *dbConfig, name string, codec payloadCodec, dryRun bool, w io.Writer) error {
+	backend := backendOf(dbc.DSN)
+	if backend == backendMemory {
+		return errors.New("in-memory store has no payloads")
+	}
+
+	db, closeFn, err := openDB(cfg, dbc, backend, name)
+	if err != nil {
+		return err
+	}
+
+	defer closeFn()
+
+	if err = prepareSchema(ctx, db, dbc, backend, schemaUsers); err != nil {
+		return fmt.Errorf("%s schema: %w", name, err)
+	}
+
+	bind := func(q string) string { return q }
+	if backend == backendPostgres {
+		bind = rebind
+	}
+
+	stats, err := rewritePayloads(ctx, db, bind, codec, dryRun)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+
+	for _, st := range stats {
+		if _, err = fmt.Fprintf(w, "%s %s: scanned %d, rewritten %d\n", name, st.Table, st.Scanned, st.Rewritten); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor"
+)
+
+func TestRewritePayloads(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		path = filepath.Join(t.TempDir(), "users.db")
+		env  = map[string]string{
+			envDBUsers:    sqlitePrefix + path,
+			envDBSettings: backendMemory + ":",
+		}
+		getenv = func(k string) string { return env[k] }
+		buf    bytes.Buffer
+	)
+
+	if err := migrateCommand([]string{"-db", schemaUsers, "up"}, getenv, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open(backendSQLite, sqliteDSN(sqlitePrefix+path))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	// legacy row, written before codecs were introduced
+	legacy, _ := cbor.Marshal([]int{1, 2}, cbor.EncOptions{Canonical: true})
+
+	if _, err = db.Exec(`INSERT INTO user_settings (user_id, settings, created_at) VALUES (?, ?, ?)`,
+		1, legacy, sqliteTime(time.Now().Add(-time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = NewSQLiteUserStore(db, userStoreOptions{Codec: jsonCodec{}}).Set(ctx, 2, UserSettings{Bundles: []int{3, 4}}, Change{}); err != nil {
+		t.Fatal(err)
+	}
+
+	rewrite := func(args ...string) string {
+		t.Helper()
+
+		buf.Reset()
+
+		if err := rewriteCommand(args, getenv, &buf); err != nil {
+			t.Fatal(err)
+		}
+
+		return buf.String()
+	}
+
+	if out := rewrite("-codec", codecDelta, "-dry-run"); !strings.Contains(out, "user_settings: scanned 2, rewritten 2") ||
+		!strings.Contains(out, "user_settings_current: scanned 1, rewritten 1") {
+		t.Fatal("step 1 fail:", out)
+	}
+
+	if out := rewrite("-codec", codecDelta); !strings.Contains(out, "user_settings: scanned 2, rewritten 2") {
+		t.Fatal("step 2 fail:", out)
+	}
+
+	rows, err := db.Query(`SELECT id, settings FROM user_settings UNION ALL SELECT user_id, settings FROM user_settings_current`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, bufs, err := readPayloads(rows)
+	if err != nil || len(bufs) != 3 {
+		t.Fatal("step 3 fail:", bufs, err)
+	}
+
+	for _, b := range bufs {
+		if payloadVersion(b) != codecVersionDelta {
+			t.Fatal("step 4 fail: payload not rewritten", b)
+		}
+	}
+
+	us := NewSQLiteUserStore(db, userStoreOptions{Codec: deltaCodec{}})
+
+	for uid, want := range map[int][]int{1: {1, 2}, 2: {3, 4}} {
+		if s, err := us.Get(ctx, uid, time.Now()); err != nil || !sameInts(s.Bundles, want) {
+			t.Fatal("step 5 fail:", uid, s, err)
+		}
+	}
+
+	if out := rewrite("-codec", codecDelta); strings.Count(out, "rewritten 0") != len(payloadTables) {
+		t.Fatal("step 6 fail: repeated rewrite changed rows", out)
+	}
+
+	if err = rewriteCommand([]string{"-codec", "zip"}, getenv, &buf); err == nil {
+		t.Fatal("step 7 fail: unknown codec accepted")
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// originExpire marks revision, scheduled by set-expire to restore state, user would have after
+// former expiration, only such revisions are moved along with later changes of expiration.
+const originExpire = "expire"
+
+// ScheduledChange is a revision of user settings, that takes effect in future.
+type ScheduledChange struct {
+	ID      int        `json:"id"`
+	UserID  int        `json:"user_id"`
+	Bundles []int      `json:"bundles"`
+	Start   time.Time  `json:"start"`
+	Expire  *time.Time `json:"expire,omitempty"`
+	Origin  string     `json:"origin,omitempty"`
+}
+
+// queryScheduled selects revisions of user, created after given time, soonest first.
+const queryScheduled = `
+SELECT
+	id,
+	settings,
+	created_at,
+	expires_at,
+	origin
+FROM
+	user_settings
+WHERE
+	user_id = ?
+	AND
+	created_at > ?
+ORDER BY
+	created_at, id`
+
+// queryCancelScheduled returns query, that deletes revisions with given ids, if they are
+// not effective yet, its arguments are user id and current time.
+func queryCancelScheduled(ids []int) string {
+	return `
+DELETE FROM
+	user_settings
+WHERE
+	user_id = ?
+	AND
+	created_at > ?
+	AND
+	id IN (` + intArray(ids) + `)`
+}
+
+// refreshCurrent rebuilds projection of user from history, after revisions removal.
+func refreshCurrent(ctx context.Context, tx *sql.Tx, bind func(string) string, upsert string, userID int) error {
+	if _, err := tx.ExecContext(ctx, bind(`DELETE FROM user_settings_current WHERE user_id = ?`), userID); err != nil {
+		return err
+	}
+
+	var id int
+
+	switch err := tx.QueryRowContext(ctx, bind(queryLatestRevision), userID).Scan(&id); {
+	case err == sql.ErrNoRows:
+		return nil
+	case err != nil:
+		return err
+	}
+
+	_, err := tx.ExecContext(ctx, bind(upsert), id)
+
+	return err
+}
+
+// scanScheduled reads revision id, span and origin to `sc`, it returns revision payload.
+func scanScheduled(rows *sql.Rows, sc *ScheduledChange) (buf []byte, err error) {
+	var exp sql.NullTime
+
+	if err = rows.Scan(&sc.ID, &buf, &sc.Start, &exp, &sc.Origin); err != nil {
+		return
+	}
+
+	if exp.Valid {
+		sc.Expire = &exp.Time
+	}
+
+	return buf, nil
+}
+
+// readScheduled reads scheduled revisions of user from rows with `scan`, and closes them.
+func readScheduled(
+	rows *sql.Rows,
+	userID int,
+	scan func(*sql.Rows, *ScheduledChange) ([]byte, error),
+) (rv []ScheduledChange, err error) {
+	defer rows.Close()
+
+	for rows.Next() {
+		sc := ScheduledChange{UserID: userID}
+
+		buf, err := scan(rows, &sc)
+		if err != nil {
+			return nil, err
+		}
+
+		if sc.Bundles, err = decodePayload(buf); err != nil {
+			return nil, err
+		}
+
+		rv = append(rv, sc)
+	}
+
+	return rv, rows.Err()
+}
+
+// rowsAffected returns number of rows, affected by query.
+func rowsAffected(res sql.Result) (int, error) {
+	n, err := res.RowsAffected()
+
+	return int(n), err
+}
+
+// nextStart returns start of the soonest scheduled change, if any.
+func nextStart(sc []ScheduledChange) *time.Time {
+	if len(sc) == 0 {
+		return nil
+	}
+
+	return &sc[0].Start
+}
@@ -3,31 +3,74 @@ package main
 import (
 	"bytes"
 	"context"
-	"database/sql"
 	"encoding/json"
+	"errors"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
-)
 
-const (
-	httpTimeout = 5 * time.Second
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type service struct {
-	addr      string
-	dbUser    *sql.DB
-	dbSetting *sql.DB
-	h         handler
+	cfg *config
+	h   handler
+	// idem keeps outcomes of requests with idempotency keys, nil - keys are ignored.
+	idem IdempotencyStore
 }
 
 type apiReq struct {
 	UserID int        `json:"user_id"`
 	Items  []string   `json:"items"`
 	Expire *time.Time `json:"expire,omitempty"`
+	Start  *time.Time `json:"start,omitempty"`
+	Actor  string     `json:"actor,omitempty"`
+	Reason string     `json:"reason,omitempty"`
+	// Revision is a time (RFC3339) of revision to revert to, or `revisionBaseline`.
+	Revision string `json:"revision,omitempty"`
+	DryRun   bool   `json:"dry_run,omitempty"`
+	// Mode tells how set-* requests apply bundles: merge (default) or replace, and how unset-*
+	// ones remove them: downgrade (default) or chain.
+	Mode assignMode `json:"mode,omitempty"`
+}
+
+// revisionBaseline reverts user to empty state.
+const revisionBaseline = "baseline"
+
+// change builds Change for request, it is attributed to authenticated identity (if any),
+// client-supplied actor is trusted only when authentication is disabled, and kept as
+// on-behalf-of when it differs from authenticated one.
+func (rq *apiReq) change(ctx context.Context, action string, tagged bool) (ch Change) {
+	ch = Change{
+		Action: action,
+		Items:  rq.Items,
+		Actor:  rq.Actor,
+		Reason: rq.Reason,
+		Start:  rq.Start,
+	}
+
+	if tagged {
+		ch.Tag = rq.Items[0]
+	}
+
+	if ri := reqInfoFrom(ctx); ri != nil && ri.Actor != "" {
+		ch.Caller = ri.Actor
+		ch.Actor = ri.Actor
+
+		if rq.Actor != ri.Actor {
+			ch.OnBehalfOf = rq.Actor
+		}
+	}
+
+	return ch
 }
 
 // apiHandler is a wrapper for http request handling, it takes any io.Writer
@@ -37,15 +80,60 @@ type apiReq struct {
 // otherwise, any content written to `w` goes to client with json mime as content-type in headers.
 type apiHandler func(w io.Writer, r *http.Request) int
 
+// reqHandler handles decoded `apiReq`, it follows apiHandler result conventions.
+type reqHandler func(ctx context.Context, w io.Writer, r *apiReq) int
+
 // mAPI takes method (GET, POST, etc...) and apiHandler,
 // and construct http.HandlerFunc for them.
+//
+// It also takes care of request id: incoming `X-Request-ID` (or a newly generated one)
+// is sent back to client and propagated via request context, and writes access log line.
 func mAPI(method string, handler apiHandler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var (
-			buf  bytes.Buffer
-			code int
+			buf   bytes.Buffer
+			code  int
+			start = time.Now()
+			ri    = &reqInfo{
+				ID:             requestID(r.Header.Get(hdrRequestID)),
+				Route:          r.Pattern,
+				IdempotencyKey: r.Header.Get(hdrIdempotencyKey),
+			}
+		)
+
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method+" "+r.Pattern,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.HTTPRoute(r.Pattern),
+				attribute.String("app.request_id", ri.ID),
+			),
 		)
 
+		w.Header().Set(hdrRequestID, ri.ID)
+		r = r.WithContext(withReqInfo(ctx, ri))
+
+		defer func() {
+			span.SetAttributes(semconv.HTTPResponseStatusCode(code), userAttr(ri.UserID))
+
+			if code >= http.StatusInternalServerError {
+				span.SetStatus(codes.Error, http.StatusText(code))
+			}
+
+			span.End()
+
+			slog.LogAttrs(r.Context(), slog.LevelInfo, "access",
+				slog.String("method", r.Method),
+				slog.String("route", r.Pattern),
+				slog.String("path", r.URL.Path),
+				slog.Int("user_id", ri.UserID),
+				slog.String("actor", ri.Actor),
+				slog.Int("status", code),
+				slog.Duration("duration", time.Since(start)),
+			)
+		}()
+
 		if r.Method != method {
 			code = http.StatusMethodNotAllowed
 			http.Error(w, http.StatusText(code), code)
@@ -59,16 +147,19 @@ func mAPI(method string, handler apiHandler) http.HandlerFunc {
 			return
 		}
 
+		code = http.StatusOK
+
 		w.Header().Set("Content-Type", "application/json")
 
 		if _, err := buf.WriteTo(w); err != nil {
-			log.Println("api response error:", err)
+			slog.ErrorContext(r.Context(), "api response", "err", err)
 		}
 	}
 }
 
-// mREQ builds apiHandler for `apiReq`-consuming handlers, taking care of request decoding and validation.
-func mREQ(next func(w io.Writer, r *apiReq) int) apiHandler {
+// mREQ builds apiHandler for `apiReq`-consuming handlers, taking care of request decoding and validation,
+// `items` tells whenever request must have non-empty items.
+func mREQ(next reqHandler, items bool) apiHandler {
 	return func(w io.Writer, r *http.Request) int {
 		var rq apiReq
 
@@ -76,29 +167,94 @@ func mREQ(next func(w io.Writer, r *apiReq) int) apiHandler {
 			return http.StatusBadRequest
 		}
 
-		if rq.UserID == 0 || len(rq.Items) == 0 {
+		// user id may come from path as well, it must match body one, if both given.
+		if v := r.PathValue("id"); v != "" {
+			uid, err := strconv.Atoi(v)
+			if err != nil || (rq.UserID != 0 && rq.UserID != uid) {
+				return http.StatusBadRequest
+			}
+
+			rq.UserID = uid
+		}
+
+		if rq.UserID == 0 || (items && len(rq.Items) == 0) {
+			return http.StatusBadRequest
+		}
+
+		if !rq.Mode.valid() {
+			return http.StatusBadRequest
+		}
+
+		// changes can be scheduled only for future, and must not expire before they start.
+		if rq.Start != nil && (!rq.Start.After(time.Now()) || (rq.Expire != nil && !rq.Expire.After(*rq.Start))) {
 			return http.StatusBadRequest
 		}
 
-		return next(w, &rq)
+		ctx := r.Context()
+
+		setUserID(ctx, rq.UserID)
+
+		return next(ctx, w, &rq)
+	}
+}
+
+// getAPI is a shorthand for building GET-related api methods, guarded by `g`.
+func getAPI(g guard, h apiHandler) http.HandlerFunc {
+	return mAPI(http.MethodGet, g(h))
+}
+
+// cacheAPI sets `Cache-Control` header for responses of `next`, allowing
+// upstream proxies to cache them for given `ttl`, zero ttl leaves it to proxy defaults.
+func cacheAPI(ttl time.Duration, next http.HandlerFunc) http.HandlerFunc {
+	if ttl <= 0 {
+		return next
+	}
+
+	hdr := "max-age=" + strconv.Itoa(int(ttl/time.Second))
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", hdr)
+
+		next(w, r)
+	}
+}
+
+// noCacheAPI forbids upstream proxies to serve responses of `next` without revalidation,
+// as they hold per-user state, that changes with every write.
+func noCacheAPI(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-cache")
+
+		next(w, r)
 	}
 }
 
-// getAPI is a shorthand for building GET-related api methods.
-func getAPI(h apiHandler) http.HandlerFunc {
-	return mAPI(http.MethodGet, h)
+// reqAPI is a shorthand for building POST-related api methods, guarded by `g`.
+func reqAPI(g guard, h reqHandler) http.HandlerFunc {
+	return mAPI(http.MethodPost, g(mREQ(h, true)))
 }
 
-// reqAPI is a shorthand for building POST-related api methods.
-func reqAPI(h func(w io.Writer, r *apiReq) int) http.HandlerFunc {
-	return mAPI(http.MethodPost, mREQ(h))
+// userAPI is a shorthand for building POST-related api methods, that change user state without items.
+func userAPI(g guard, h reqHandler) http.HandlerFunc {
+	return mAPI(http.MethodPost, g(mREQ(h, false)))
 }
 
-func newService(addr string, dbu, dbs *sql.DB) *service {
+// newService creates service over given stores, `sc` (if any) caches actual user settings.
+func newService(cfg *config, us UserStore, ss SettingStore, sc *settingsCache) *service {
+	idem := idempotencyOf(us)
+
+	if sc != nil {
+		us = sc.Users(us)
+	}
+
 	return &service{
-		addr:      addr,
-		dbUser:    dbu,
-		dbSetting: dbs,
+		cfg:  cfg,
+		idem: idem,
+		h: handler{
+			user:    traceUserStore(us),
+			setting: traceSettingStore(ss),
+			cache:   sc,
+		},
 	}
 }
 
@@ -115,22 +271,73 @@ func (svc *service) handleGetSettings(w io.Writer, r *http.Request) int {
 		return http.StatusBadRequest
 	}
 
-	when := time.Now()
+	ctx := r.Context()
+
+	setUserID(ctx, uid)
+
+	var (
+		res  []Setting
+		when time.Time
+	)
 
 	if whs := r.URL.Query().Get("when"); whs != "" {
+		if when, err = time.Parse(time.RFC3339, whs); err != nil {
+			slog.WarnContext(ctx, "get-settings date parse", "err", err)
+
+			return http.StatusBadRequest
+		}
+
+		res, err = svc.h.GetSettings(ctx, uid, when)
+	} else {
+		res, err = svc.h.CurrentSettings(ctx, uid)
+	}
+
+	if err != nil {
+		slog.ErrorContext(ctx, "get-settings handler", "err", err)
+
+		return http.StatusInternalServerError
+	}
+
+	_ = json.NewEncoder(w).Encode(res)
+
+	return 0
+}
+
+// handleGetSettingsBatch handles GET '/settings/batch?user_id=int[&user_id=int...][&when=RFC3339]' requests.
+func (svc *service) handleGetSettingsBatch(w io.Writer, r *http.Request) int {
+	const maxUsers = 100
+
+	var (
+		err  error
+		ctx  = r.Context()
+		q    = r.URL.Query()
+		ids  = q["user_id"]
+		uids = make([]int, len(ids))
+		when = time.Now()
+	)
+
+	if len(ids) == 0 || len(ids) > maxUsers {
+		return http.StatusBadRequest
+	}
+
+	for i, v := range ids {
+		if uids[i], err = strconv.Atoi(v); err != nil {
+			return http.StatusBadRequest
+		}
+	}
+
+	if whs := q.Get("when"); whs != "" {
 		when, err = time.Parse(time.RFC3339, whs)
 		if err != nil {
-			log.Println("get-settings date parse error:", err)
+			slog.WarnContext(ctx, "get-settings-batch date parse", "err", err)
 
 			return http.StatusBadRequest
 		}
 	}
 
-	ctx := context.Background()
-
-	res, err := svc.h.GetSettings(ctx, uid, when)
+	res, err := svc.h.GetSettingsBatch(ctx, uids, when)
 	if err != nil {
-		log.Println("get-settings handler error:", err)
+		slog.ErrorContext(ctx, "get-settings-batch handler", "err", err)
 
 		return http.StatusInternalServerError
 	}
@@ -141,12 +348,12 @@ func (svc *service) handleGetSettings(w io.Writer, r *http.Request) int {
 }
 
 // handleListSettings handles GET '/settings' requests.
-func (svc *service) handleListSettings(w io.Writer, _ *http.Request) int {
-	ctx := context.Background()
+func (svc *service) handleListSettings(w io.Writer, r *http.Request) int {
+	ctx := r.Context()
 
 	res, err := svc.h.ListSettings(ctx)
 	if err != nil {
-		log.Println("list-settings handler error:", err)
+		slog.ErrorContext(ctx, "list-settings handler", "err", err)
 
 		return http.StatusInternalServerError
 	}
@@ -157,28 +364,112 @@ func (svc *service) handleListSettings(w io.Writer, _ *http.Request) int {
 }
 
 // handleListBundles handles GET '/bundles' requests.
-func (svc *service) handleListBundles(w io.Writer, _ *http.Request) int {
-	ctx := context.Background()
+func (svc *service) handleListBundles(w io.Writer, r *http.Request) int {
+	ctx := r.Context()
 
 	res, err := svc.h.ListBundles(ctx)
 	if err != nil {
-		log.Println("list-bundles handler error:", err)
+		slog.ErrorContext(ctx, "list-bundles handler", "err", err)
+
+		return http.StatusInternalServerError
+	}
+
+	_ = json.NewEncoder(w).Encode(res)
+
+	return 0
+}
+
+// bundlesWhen parses optional `when` query parameter of bundles requests, it defaults to now.
+func bundlesWhen(r *http.Request) (when time.Time, ok bool) {
+	whs := r.URL.Query().Get("when")
+	if whs == "" {
+		return time.Now(), true
+	}
+
+	when, err := time.Parse(time.RFC3339, whs)
+
+	return when, err == nil
+}
+
+// handleBundleTree handles GET '/bundle-tree[?when=RFC3339]' requests.
+func (svc *service) handleBundleTree(w io.Writer, r *http.Request) int {
+	ctx := r.Context()
+
+	when, ok := bundlesWhen(r)
+	if !ok {
+		return http.StatusBadRequest
+	}
+
+	res, err := svc.h.BundleTree(ctx, when)
+	if err != nil {
+		slog.ErrorContext(ctx, "bundle-tree handler", "err", err)
+
+		return http.StatusInternalServerError
+	}
+
+	_ = json.NewEncoder(w).Encode(res)
+
+	return 0
+}
+
+// handleBundle handles GET '/bundles/{name}[?tag=string&when=RFC3339]' requests.
+func (svc *service) handleBundle(w io.Writer, r *http.Request) int {
+	var (
+		ctx = r.Context()
+		tag *string
+	)
+
+	when, ok := bundlesWhen(r)
+	if !ok {
+		return http.StatusBadRequest
+	}
+
+	if q := r.URL.Query(); q.Has("tag") {
+		t := q.Get("tag")
+		tag = &t
+	}
+
+	res, err := svc.h.Bundle(ctx, r.PathValue("name"), tag, when)
+	if errors.Is(err, errAmbiguousBundle) {
+		return http.StatusConflict
+	}
+
+	if err != nil {
+		slog.ErrorContext(ctx, "bundle handler", "err", err)
 
 		return http.StatusInternalServerError
 	}
 
+	if res == nil {
+		return http.StatusNotFound
+	}
+
 	_ = json.NewEncoder(w).Encode(res)
 
 	return 0
 }
 
+// handleCatalogInvalidate handles POST '/catalog/invalidate' requests, catalog editors make them
+// after catalog changes, so cached settings are not served until next catalog check.
+func (svc *service) handleCatalogInvalidate(_ io.Writer, r *http.Request) int {
+	ctx := r.Context()
+
+	if err := svc.h.InvalidateCatalog(ctx); err != nil {
+		slog.ErrorContext(ctx, "catalog-invalidate handler", "err", err)
+
+		return http.StatusInternalServerError
+	}
+
+	return http.StatusNoContent
+}
+
 // handleListTags handles GET '/tags' requests.
-func (svc *service) handleListTags(w io.Writer, _ *http.Request) int {
-	ctx := context.Background()
+func (svc *service) handleListTags(w io.Writer, r *http.Request) int {
+	ctx := r.Context()
 
 	res, err := svc.h.ListTags(ctx)
 	if err != nil {
-		log.Println("list-tags handler error:", err)
+		slog.ErrorContext(ctx, "list-tags handler", "err", err)
 
 		return http.StatusInternalServerError
 	}
@@ -188,38 +479,219 @@ func (svc *service) handleListTags(w io.Writer, _ *http.Request) int {
 	return 0
 }
 
-// handleSetTag handles POST '/set-tag' requests.
-func (svc *service) handleSetTag(w io.Writer, req *apiReq) int {
-	ctx := context.Background()
+// handleAudit handles GET '/audit[?user_id=int&actor=string&tag=string&from=RFC3339&to=RFC3339&limit=int]' requests.
+func (svc *service) handleAudit(w io.Writer, r *http.Request) int {
+	const maxLimit = 1000
+
+	var (
+		f   AuditFilter
+		err error
+		ctx = r.Context()
+		q   = r.URL.Query()
+	)
+
+	if v := q.Get("user_id"); v != "" {
+		if f.UserID, err = strconv.Atoi(v); err != nil {
+			return http.StatusBadRequest
+		}
+	}
+
+	if v := q.Get("limit"); v != "" {
+		if f.Limit, err = strconv.Atoi(v); err != nil || f.Limit < 0 || f.Limit > maxLimit {
+			return http.StatusBadRequest
+		}
+	}
+
+	for _, t := range []struct {
+		key string
+		dst *time.Time
+	}{
+		{"from", &f.From},
+		{"to", &f.To},
+	} {
+		if v := q.Get(t.key); v != "" {
+			if *t.dst, err = time.Parse(time.RFC3339, v); err != nil {
+				return http.StatusBadRequest
+			}
+		}
+	}
+
+	f.Actor = q.Get("actor")
+	f.Tag = q.Get("tag")
+
+	setUserID(ctx, f.UserID)
+
+	res, err := svc.h.Audit(ctx, f)
+	if err != nil {
+		slog.ErrorContext(ctx, "audit handler", "err", err)
+
+		return http.StatusInternalServerError
+	}
+
+	_ = json.NewEncoder(w).Encode(res)
+
+	return 0
+}
+
+// handleScheduled handles GET '/scheduled?user_id=int' requests.
+func (svc *service) handleScheduled(w io.Writer, r *http.Request) int {
+	ctx := r.Context()
 
-	if err := svc.h.SetTag(ctx, req.UserID, req.Items[0], req.Expire); err != nil {
-		log.Println("set-tag handler error:", err)
+	uid, err := strconv.Atoi(r.URL.Query().Get("user_id"))
+	if err != nil {
+		return http.StatusBadRequest
+	}
+
+	setUserID(ctx, uid)
+
+	res, err := svc.h.Scheduled(ctx, uid)
+	if err != nil {
+		slog.ErrorContext(ctx, "scheduled handler", "err", err)
+
+		return http.StatusInternalServerError
+	}
+
+	if res == nil {
+		res = []ScheduledChange{}
+	}
+
+	_ = json.NewEncoder(w).Encode(res)
+
+	return 0
+}
+
+// handleCancelScheduled handles POST '/cancel-scheduled' requests, items are ids of scheduled changes.
+func (svc *service) handleCancelScheduled(ctx context.Context, w io.Writer, req *apiReq) int {
+	ids := make([]int, len(req.Items))
+
+	for i, v := range req.Items {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			return http.StatusBadRequest
+		}
+
+		ids[i] = id
+	}
+
+	n, err := svc.h.CancelScheduled(ctx, req.UserID, ids, req.change(ctx, "cancel-scheduled", false))
+	if err != nil {
+		slog.ErrorContext(ctx, "cancel-scheduled handler", "err", err)
 
 		return http.StatusInternalServerError
 	}
 
+	if n == 0 {
+		return http.StatusNotFound
+	}
+
 	return http.StatusCreated
 }
 
-// handleSetBundle handles POST '/set-bundles' requests.
-func (svc *service) handleSetBundle(w io.Writer, req *apiReq) int {
-	ctx := context.Background()
+// handleSetExpire handles POST '/set-expire' requests, it extends or shortens expiration of actual user
+// state, or clears it, if no `expire` given.
+func (svc *service) handleSetExpire(ctx context.Context, w io.Writer, req *apiReq) int {
+	if req.Start != nil || (req.Expire != nil && !req.Expire.After(time.Now())) {
+		return http.StatusBadRequest
+	}
 
-	if err := svc.h.SetBundles(ctx, req.UserID, req.Items, req.Expire); err != nil {
-		log.Println("set-bundle handler error:", err)
+	ok, err := svc.h.SetExpire(ctx, req.UserID, req.Expire, req.change(ctx, "set-expire", false))
+	if err != nil {
+		slog.ErrorContext(ctx, "set-expire handler", "err", err)
 
 		return http.StatusInternalServerError
 	}
 
+	if !ok {
+		return http.StatusNotFound
+	}
+
 	return http.StatusCreated
 }
 
+// handleRevert handles POST '/users/{id}/revert' requests, it copies bundles of user revision, actual
+// at `revision` time (none for baseline), forward as a new revision, dry run only reports them.
+func (svc *service) handleRevert(ctx context.Context, w io.Writer, req *apiReq) int {
+	var at *time.Time
+
+	switch req.Revision {
+	case "":
+		return http.StatusBadRequest
+	case revisionBaseline:
+	default:
+		t, err := time.Parse(time.RFC3339, req.Revision)
+		if err != nil || t.After(time.Now()) {
+			return http.StatusBadRequest
+		}
+
+		at = &t
+	}
+
+	ch := req.change(ctx, "revert", false)
+	ch.Items = []string{req.Revision}
+
+	res, err := svc.h.Revert(ctx, req.UserID, at, req.DryRun, ch)
+	if err != nil {
+		slog.ErrorContext(ctx, "revert handler", "err", err)
+
+		return http.StatusInternalServerError
+	}
+
+	if !req.DryRun {
+		return http.StatusCreated
+	}
+
+	_ = json.NewEncoder(w).Encode(res)
+
+	return 0
+}
+
+// handleSetTag handles POST '/set-tag' requests.
+func (svc *service) handleSetTag(ctx context.Context, w io.Writer, req *apiReq) int {
+	if !req.Mode.forSet() {
+		return http.StatusBadRequest
+	}
+
+	if err := svc.h.SetTag(ctx, req.UserID, req.Items[0], req.Expire, req.Mode, req.change(ctx, "set-tag", true)); err != nil {
+		return assignFailed(ctx, "set-tag handler", err)
+	}
+
+	return http.StatusCreated
+}
+
+// handleSetBundle handles POST '/set-bundles' requests.
+func (svc *service) handleSetBundle(ctx context.Context, w io.Writer, req *apiReq) int {
+	if !req.Mode.forSet() {
+		return http.StatusBadRequest
+	}
+
+	if err := svc.h.SetBundles(ctx, req.UserID, req.Items, req.Expire, req.Mode, req.change(ctx, "set-bundles", false)); err != nil {
+		return assignFailed(ctx, "set-bundle handler", err)
+	}
+
+	return http.StatusCreated
+}
+
+// assignFailed maps bundles assignment error to http status.
+func assignFailed(ctx context.Context, msg string, err error) int {
+	if errors.Is(err, errBundleHierarchy) || errors.Is(err, errUnknownBundle) {
+		slog.WarnContext(ctx, msg, "err", err)
+
+		return http.StatusBadRequest
+	}
+
+	slog.ErrorContext(ctx, msg, "err", err)
+
+	return http.StatusInternalServerError
+}
+
 // handleUnSetTag handles POST '/unset-tag' requests.
-func (svc *service) handleUnSetTag(w io.Writer, req *apiReq) int {
-	ctx := context.Background()
+func (svc *service) handleUnSetTag(ctx context.Context, w io.Writer, req *apiReq) int {
+	if !req.Mode.forUnset() {
+		return http.StatusBadRequest
+	}
 
-	if err := svc.h.UnSetTag(ctx, req.UserID, req.Items[0]); err != nil {
-		log.Println("unset-tag handler error:", err)
+	if err := svc.h.UnSetTag(ctx, req.UserID, req.Items[0], req.Mode, req.change(ctx, "unset-tag", true)); err != nil {
+		slog.ErrorContext(ctx, "unset-tag handler", "err", err)
 
 		return http.StatusInternalServerError
 	}
@@ -228,11 +700,13 @@ func (svc *service) handleUnSetTag(w io.Writer, req *apiReq) int {
 }
 
 // handleUnSetBundle handles POST '/unset-bundles' requests.
-func (svc *service) handleUnSetBundle(w io.Writer, req *apiReq) int {
-	ctx := context.Background()
+func (svc *service) handleUnSetBundle(ctx context.Context, w io.Writer, req *apiReq) int {
+	if !req.Mode.forUnset() {
+		return http.StatusBadRequest
+	}
 
-	if err := svc.h.UnSetBundles(ctx, req.UserID, req.Items); err != nil {
-		log.Println("unset-bundle handler error:", err)
+	if err := svc.h.UnSetBundles(ctx, req.UserID, req.Items, req.Mode, req.change(ctx, "unset-bundles", false)); err != nil {
+		slog.ErrorContext(ctx, "unset-bundle handler", "err", err)
 
 		return http.StatusInternalServerError
 	}
@@ -240,25 +714,60 @@ func (svc *service) handleUnSetBundle(w io.Writer, req *apiReq) int {
 	return http.StatusCreated
 }
 
-func (svc *service) Serve() error {
-	svc.h.user = NewUserStore(svc.dbUser)
-	svc.h.setting = NewSettingStore(svc.dbSetting)
+// routes builds mux, with all api methods registered.
+func (svc *service) routes() *http.ServeMux {
+	var (
+		mux   = http.NewServeMux()
+		ttl   = svc.cfg.Cache.TTL
+		auth  = newAuth(&svc.cfg.Auth)
+		read  = allowAll
+		write = require(auth, scopeSettingsWrite)
+		// audit trail (who changed what and why) and pending changes are never public.
+		audit = require(auth, scopeAuditRead)
+		admin = require(auth, scopeCatalogAdmin)
+	)
+
+	if auth == nil {
+		slog.Warn("no authentication configured, all endpoints are open")
+	}
 
-	http.HandleFunc("/tags", getAPI(svc.handleListTags))
-	http.HandleFunc("/bundles", getAPI(svc.handleListBundles))
-	http.HandleFunc("/settings", getAPI(svc.handleListSettings))
-	http.HandleFunc("/settings/", getAPI(svc.handleGetSettings))
+	if svc.cfg.Auth.ProtectReads {
+		read = require(auth, scopeSettingsRead)
+	}
 
-	http.HandleFunc("/set-tag", reqAPI(svc.handleSetTag))
-	http.HandleFunc("/unset-tag", reqAPI(svc.handleUnSetTag))
-	http.HandleFunc("/set-bundles", reqAPI(svc.handleSetBundle))
-	http.HandleFunc("/unset-bundles", reqAPI(svc.handleUnSetBundle))
+	mux.HandleFunc("/tags", cacheAPI(ttl, getAPI(read, svc.handleListTags)))
+	mux.HandleFunc("/bundles", cacheAPI(ttl, getAPI(read, svc.handleListBundles)))
+	mux.HandleFunc("/bundle-tree", cacheAPI(ttl, getAPI(read, svc.handleBundleTree)))
+	mux.HandleFunc("/bundles/{name}", cacheAPI(ttl, getAPI(read, svc.handleBundle)))
+	mux.HandleFunc("/settings", cacheAPI(ttl, getAPI(read, svc.handleListSettings)))
+	mux.HandleFunc("/settings/", noCacheAPI(getAPI(read, svc.handleGetSettings)))
+	mux.HandleFunc("/settings/batch", noCacheAPI(getAPI(read, svc.handleGetSettingsBatch)))
+	mux.HandleFunc("/audit", noCacheAPI(getAPI(audit, svc.handleAudit)))
+	mux.HandleFunc("/scheduled", noCacheAPI(getAPI(audit, svc.handleScheduled)))
+	mux.HandleFunc("/catalog/invalidate", mAPI(http.MethodPost, admin(svc.handleCatalogInvalidate)))
+
+	if svc.cfg.Features.ReadOnly {
+		slog.Info("read-only mode, mutating endpoints disabled")
+	} else {
+		mux.HandleFunc("/set-tag", reqAPI(write, svc.idempotent(svc.handleSetTag)))
+		mux.HandleFunc("/unset-tag", reqAPI(write, svc.idempotent(svc.handleUnSetTag)))
+		mux.HandleFunc("/set-bundles", reqAPI(write, svc.idempotent(svc.handleSetBundle)))
+		mux.HandleFunc("/unset-bundles", reqAPI(write, svc.idempotent(svc.handleUnSetBundle)))
+		mux.HandleFunc("/cancel-scheduled", reqAPI(write, svc.idempotent(svc.handleCancelScheduled)))
+		mux.HandleFunc("/set-expire", userAPI(write, svc.idempotent(svc.handleSetExpire)))
+		mux.HandleFunc("/users/{id}/revert", userAPI(write, svc.idempotent(svc.handleRevert)))
+	}
 
+	return mux
+}
+
+func (svc *service) Serve() error {
 	srv := http.Server{
-		Addr:         svc.addr,
-		Handler:      http.DefaultServeMux,
-		ReadTimeout:  httpTimeout,
-		WriteTimeout: httpTimeout,
+		Addr:         svc.cfg.HTTP.Addr,
+		Handler:      svc.routes(),
+		ReadTimeout:  svc.cfg.HTTP.ReadTimeout,
+		WriteTimeout: svc.cfg.HTTP.WriteTimeout,
+		IdleTimeout:  svc.cfg.HTTP.IdleTimeout,
 	}
 
 	return srv.ListenAndServe()
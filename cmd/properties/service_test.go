@@ -0,0 +1,693 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestService(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	cfg := defaultConfig()
+	svc := newService(&cfg, NewMemoryUserStore(userStoreOptions{}), NewMemorySettingStore(demoCatalog()), nil)
+
+	ts := httptest.NewServer(svc.routes())
+	t.Cleanup(ts.Close)
+
+	return ts
+}
+
+func apiCall(t *testing.T, ts *httptest.Server, method, path, body string, rv interface{}) int {
+	t.Helper()
+
+	return apiCallKey(t, ts, "", method, path, body, rv)
+}
+
+func apiCallKey(t *testing.T, ts *httptest.Server, key, method, path, body string, rv interface{}) int {
+	t.Helper()
+
+	req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if key != "" {
+		req.Header.Set(hdrAPIKey, key)
+	}
+
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer resp.Body.Close()
+
+	if rv != nil && resp.StatusCode == http.StatusOK {
+		if err = json.NewDecoder(resp.Body).Decode(rv); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return resp.StatusCode
+}
+
+func settingsMap(s []Setting) map[string]string {
+	m := make(map[string]string, len(s))
+
+	for _, v := range s {
+		m[v.Name] = v.Value
+	}
+
+	return m
+}
+
+func TestServiceSettings(t *testing.T) {
+	ts := newTestService(t)
+
+	var res []Setting
+
+	if code := apiCall(t, ts, http.MethodGet, "/settings/1", "", &res); code != http.StatusOK || len(res) != 0 {
+		t.Fatal("step 1 fail:", code, res)
+	}
+
+	if code := apiCall(t, ts, http.MethodPost, "/set-tag", `{"user_id": 1, "items": ["jun"]}`, nil); code != http.StatusCreated {
+		t.Fatal("step 2 fail:", code)
+	}
+
+	apiCall(t, ts, http.MethodGet, "/settings/1", "", &res)
+
+	if m := settingsMap(res); len(res) != 5 || m["profit"] != "85" || m["max-deals"] != "10" {
+		t.Fatal("step 3 fail:", res)
+	}
+
+	if code := apiCall(t, ts, http.MethodPost, "/set-tag", `{"user_id": 1, "items": ["mid"], "actor": "alice"}`, nil); code != http.StatusCreated {
+		t.Fatal("step 4 fail:", code)
+	}
+
+	apiCall(t, ts, http.MethodGet, "/settings/1", "", &res)
+
+	if m := settingsMap(res); len(res) != 5 || m["profit"] != "90" || m["extra-access"] != "courses" {
+		t.Fatal("step 5 fail:", res)
+	}
+
+	if code := apiCall(t, ts, http.MethodPost, "/unset-bundles", `{"user_id": 1, "items": ["profit-mid"]}`, nil); code != http.StatusCreated {
+		t.Fatal("step 6 fail:", code)
+	}
+
+	apiCall(t, ts, http.MethodGet, "/settings/1", "", &res)
+
+	if m := settingsMap(res); m["profit"] != "85" || m["max-deals"] != "15" {
+		t.Fatal("step 7 fail:", res)
+	}
+
+	var audit []AuditRecord
+
+	if code := apiCall(t, ts, http.MethodGet, "/audit?user_id=1&actor=alice", "", &audit); code != http.StatusOK {
+		t.Fatal("step 8 fail:", code)
+	}
+
+	if len(audit) != 1 || audit[0].Tag != "mid" {
+		t.Fatal("step 9 fail:", audit)
+	}
+
+	if r := audit[0]; r.Actor != "alice" || r.Caller != "" || r.OnBehalfOf != "" {
+		t.Fatal("step 10 fail:", r)
+	}
+}
+
+func TestServiceAuditActor(t *testing.T) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	cfg := defaultConfig()
+	cfg.Auth.APIKeys = []apiKeyConfig{
+		{Key: "k1", Subject: "crm", Scopes: []string{scopeSettingsWrite}},
+		{Key: "k2", Subject: "auditor", Scopes: []string{scopeAuditRead}},
+	}
+
+	svc := newService(&cfg, NewMemoryUserStore(userStoreOptions{}), NewMemorySettingStore(demoCatalog()), nil)
+
+	ts := httptest.NewServer(svc.routes())
+	t.Cleanup(ts.Close)
+
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/set-tag",
+		strings.NewReader(`{"user_id": 1, "items": ["jun"], "actor": "mallory"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set(hdrAPIKey, "k1")
+
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatal("step 1 fail:", resp.StatusCode)
+	}
+
+	var audit []AuditRecord
+
+	if code := apiCallKey(t, ts, "k2", http.MethodGet, "/audit?actor=mallory", "", &audit); code != http.StatusOK || len(audit) != 0 {
+		t.Fatal("step 2 fail:", code, audit)
+	}
+
+	if code := apiCallKey(t, ts, "k2", http.MethodGet, "/audit?actor=crm", "", &audit); code != http.StatusOK || len(audit) != 1 {
+		t.Fatal("step 3 fail:", code, audit)
+	}
+
+	if r := audit[0]; r.Actor != "crm" || r.Caller != "crm" || r.OnBehalfOf != "mallory" {
+		t.Fatal("step 4 fail:", r)
+	}
+
+	if code := apiCall(t, ts, http.MethodGet, "/audit?user_id=1", "", nil); code != http.StatusUnauthorized {
+		t.Fatal("step 5 fail:", code)
+	}
+
+	if code := apiCallKey(t, ts, "k1", http.MethodGet, "/audit?user_id=1", "", nil); code != http.StatusForbidden {
+		t.Fatal("step 6 fail:", code)
+	}
+
+	if code := apiCallKey(t, ts, "k1", http.MethodGet, "/scheduled?user_id=1", "", nil); code != http.StatusForbidden {
+		t.Fatal("step 7 fail:", code)
+	}
+
+	if code := apiCallKey(t, ts, "k2", http.MethodGet, "/scheduled?user_id=1", "", nil); code != http.StatusOK {
+		t.Fatal("step 8 fail:", code)
+	}
+
+	if code := apiCallKey(t, ts, "k1", http.MethodPost, "/set-tag", `{"user_id": 2, "items": ["jun"], "actor": "crm"}`, nil); code != http.StatusCreated {
+		t.Fatal("step 9 fail:", code)
+	}
+
+	audit = nil
+
+	if code := apiCallKey(t, ts, "k2", http.MethodGet, "/audit?user_id=2", "", &audit); code != http.StatusOK || len(audit) != 1 {
+		t.Fatal("step 10 fail:", code, audit)
+	}
+
+	if r := audit[0]; r.Actor != "crm" || r.Caller != "crm" || r.OnBehalfOf != "" {
+		t.Fatal("step 11 fail:", r)
+	}
+
+	if code := apiCallKey(t, ts, "k1", http.MethodPost, "/catalog/invalidate", "", nil); code != http.StatusForbidden {
+		t.Fatal("step 12 fail:", code)
+	}
+}
+
+func TestServiceCacheControl(t *testing.T) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	cfg := defaultConfig()
+	cfg.Cache.TTL = time.Minute
+
+	svc := newService(&cfg, NewMemoryUserStore(userStoreOptions{}), NewMemorySettingStore(demoCatalog()), nil)
+
+	ts := httptest.NewServer(svc.routes())
+	t.Cleanup(ts.Close)
+
+	for i, c := range []struct {
+		path string
+		want string
+	}{
+		{"/tags", "max-age=60"},
+		{"/bundles", "max-age=60"},
+		{"/settings", "max-age=60"},
+		{"/settings/1", "no-cache"},
+		{"/settings/batch?user_id=1", "no-cache"},
+		{"/audit?user_id=1", "no-cache"},
+	} {
+		resp, err := ts.Client().Get(ts.URL + c.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp.Body.Close()
+
+		if got := resp.Header.Get("Cache-Control"); resp.StatusCode != http.StatusOK || got != c.want {
+			t.Fatal("step", i+1, "fail:", c.path, resp.StatusCode, got)
+		}
+	}
+}
+
+func TestServiceSettingsCache(t *testing.T) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	cfg := defaultConfig()
+	cfg.Cache.Settings.Addr = cacheMemory
+
+	ss := NewMemorySettingStore(demoCatalog())
+
+	sc, closeFn := openSettingsCache(&cfg.Cache.Settings, ss)
+	t.Cleanup(closeFn)
+
+	ts := httptest.NewServer(newService(&cfg, NewMemoryUserStore(userStoreOptions{}), ss, sc).routes())
+	t.Cleanup(ts.Close)
+
+	var res []Setting
+
+	for i := 0; i < 2; i++ {
+		if code := apiCall(t, ts, http.MethodGet, "/settings/1", "", &res); code != http.StatusOK || len(res) != 0 {
+			t.Fatal("step 1 fail:", code, res)
+		}
+	}
+
+	if code := apiCall(t, ts, http.MethodPost, "/set-tag", `{"user_id": 1, "items": ["jun"]}`, nil); code != http.StatusCreated {
+		t.Fatal("step 2 fail:", code)
+	}
+
+	apiCall(t, ts, http.MethodGet, "/settings/1", "", &res)
+
+	if m := settingsMap(res); len(res) != 5 || m["profit"] != "85" {
+		t.Fatal("step 3 fail: stale settings", res)
+	}
+
+	if code := apiCall(t, ts, http.MethodPost, "/catalog/invalidate", "", nil); code != http.StatusNoContent {
+		t.Fatal("step 4 fail:", code)
+	}
+
+	if code := apiCall(t, ts, http.MethodGet, "/catalog/invalidate", "", nil); code != http.StatusMethodNotAllowed {
+		t.Fatal("step 5 fail:", code)
+	}
+}
+
+func TestServiceSettingsBatch(t *testing.T) {
+	ts := newTestService(t)
+
+	if code := apiCall(t, ts, http.MethodPost, "/set-tag", `{"user_id": 1, "items": ["jun"]}`, nil); code != http.StatusCreated {
+		t.Fatal("step 1 fail:", code)
+	}
+
+	var res map[string][]Setting
+
+	if code := apiCall(t, ts, http.MethodGet, "/settings/batch?user_id=1&user_id=2", "", &res); code != http.StatusOK {
+		t.Fatal("step 2 fail:", code)
+	}
+
+	if len(res) != 2 || len(res["2"]) != 0 {
+		t.Fatal("step 3 fail:", res)
+	}
+
+	if m := settingsMap(res["1"]); m["profit"] != "85" || m["max-deals"] != "10" {
+		t.Fatal("step 4 fail:", res)
+	}
+}
+
+func TestServiceScheduled(t *testing.T) {
+	ts := newTestService(t)
+
+	var (
+		res   []Setting
+		sc    []ScheduledChange
+		start = time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+		after = "/settings/1?when=" + time.Now().Add(2*time.Hour).UTC().Format(time.RFC3339)
+	)
+
+	if code := apiCall(t, ts, http.MethodPost, "/set-tag", `{"user_id": 1, "items": ["jun"]}`, nil); code != http.StatusCreated {
+		t.Fatal("step 1 fail:", code)
+	}
+
+	if code := apiCall(t, ts, http.MethodPost, "/set-tag", `{"user_id": 1, "items": ["mid"], "start": "`+start+`"}`, nil); code != http.StatusCreated {
+		t.Fatal("step 2 fail:", code)
+	}
+
+	if apiCall(t, ts, http.MethodGet, "/settings/1", "", &res); settingsMap(res)["profit"] != "85" {
+		t.Fatal("step 3 fail:", res)
+	}
+
+	if apiCall(t, ts, http.MethodGet, after, "", &res); settingsMap(res)["profit"] != "90" {
+		t.Fatal("step 4 fail:", res)
+	}
+
+	if code := apiCall(t, ts, http.MethodGet, "/scheduled?user_id=1", "", &sc); code != http.StatusOK || len(sc) != 1 {
+		t.Fatal("step 5 fail:", code, sc)
+	}
+
+	id := strconv.Itoa(sc[0].ID)
+
+	if code := apiCall(t, ts, http.MethodPost, "/cancel-scheduled", `{"user_id": 2, "items": ["`+id+`"]}`, nil); code != http.StatusNotFound {
+		t.Fatal("step 6 fail:", code)
+	}
+
+	if code := apiCall(t, ts, http.MethodPost, "/cancel-scheduled", `{"user_id": 1, "items": ["`+id+`"]}`, nil); code != http.StatusCreated {
+		t.Fatal("step 7 fail:", code)
+	}
+
+	if code := apiCall(t, ts, http.MethodGet, "/scheduled?user_id=1", "", &sc); code != http.StatusOK || len(sc) != 0 {
+		t.Fatal("step 8 fail:", code, sc)
+	}
+
+	if apiCall(t, ts, http.MethodGet, after, "", &res); settingsMap(res)["profit"] != "85" {
+		t.Fatal("step 9 fail:", res)
+	}
+}
+
+func TestServiceSetExpire(t *testing.T) {
+	ts := newTestService(t)
+
+	var (
+		res  []Setting
+		at   = func(d time.Duration) string { return time.Now().Add(d).UTC().Format(time.RFC3339) }
+		body = func(d time.Duration) string { return `{"user_id": 1, "expire": "` + at(d) + `"}` }
+	)
+
+	if code := apiCall(t, ts, http.MethodPost, "/set-expire", body(time.Hour), nil); code != http.StatusNotFound {
+		t.Fatal("step 1 fail:", code)
+	}
+
+	if code := apiCall(t, ts, http.MethodPost, "/set-tag", `{"user_id": 1, "items": ["jun"], "expire": "`+at(time.Hour)+`"}`, nil); code != http.StatusCreated {
+		t.Fatal("step 2 fail:", code)
+	}
+
+	for i, c := range []struct {
+		body string
+		when time.Duration
+		want string
+	}{
+		{body(3 * time.Hour), 2 * time.Hour, "85"},     // extend
+		{body(30 * time.Minute), 45 * time.Minute, ""}, // shorten
+		{body(2 * time.Hour), 150 * time.Minute, ""},   // extend, reversion moves along
+		{`{"user_id": 1}`, 24 * 365 * time.Hour, "85"}, // clear
+	} {
+		if code := apiCall(t, ts, http.MethodPost, "/set-expire", c.body, nil); code != http.StatusCreated {
+			t.Fatal("step 3 fail:", i, code)
+		}
+
+		if apiCall(t, ts, http.MethodGet, "/settings/1?when="+at(c.when), "", &res); settingsMap(res)["profit"] != c.want {
+			t.Fatal("step 4 fail:", i, res)
+		}
+	}
+
+	var audit []AuditRecord
+
+	if apiCall(t, ts, http.MethodGet, "/audit?user_id=1", "", &audit); len(audit) != 9 || audit[0].Action != "set-expire" {
+		t.Fatal("step 5 fail:", audit)
+	}
+
+	// explicit change, scheduled at expiration, is not a reversion: it survives expiration changes.
+	boundary := at(time.Hour)
+
+	if code := apiCall(t, ts, http.MethodPost, "/set-tag", `{"user_id": 2, "items": ["sen"], "expire": "`+boundary+`"}`, nil); code != http.StatusCreated {
+		t.Fatal("step 6 fail:", code)
+	}
+
+	if code := apiCall(t, ts, http.MethodPost, "/set-tag", `{"user_id": 2, "items": ["jun"], "start": "`+boundary+`"}`, nil); code != http.StatusCreated {
+		t.Fatal("step 7 fail:", code)
+	}
+
+	if code := apiCall(t, ts, http.MethodPost, "/set-expire", `{"user_id": 2}`, nil); code != http.StatusCreated {
+		t.Fatal("step 8 fail:", code)
+	}
+
+	var sc []ScheduledChange
+
+	if apiCall(t, ts, http.MethodGet, "/scheduled?user_id=2", "", &sc); len(sc) != 1 || sc[0].Origin != "" {
+		t.Fatal("step 9 fail: explicit change lost", sc)
+	}
+
+	if apiCall(t, ts, http.MethodGet, "/settings/2?when="+at(2*time.Hour), "", &res); settingsMap(res)["profit"] != "85" {
+		t.Fatal("step 10 fail:", res)
+	}
+
+	// reversion, scheduled by shortening, is the only one, that moves along with expiration.
+	last := at(2 * time.Hour)
+
+	for i, exp := range []string{at(3 * time.Hour), at(30 * time.Minute), last} {
+		if code := apiCall(t, ts, http.MethodPost, "/set-expire", `{"user_id": 2, "expire": "`+exp+`"}`, nil); code != http.StatusCreated {
+			t.Fatal("step 11 fail:", i, code)
+		}
+	}
+
+	if apiCall(t, ts, http.MethodGet, "/scheduled?user_id=2", "", &sc); len(sc) != 2 ||
+		sc[0].Origin != "" || sc[0].Start.Format(time.RFC3339) != boundary ||
+		sc[1].Origin != originExpire || sc[1].Start.Format(time.RFC3339) != last {
+		t.Fatal("step 12 fail:", sc)
+	}
+}
+
+func TestServiceRevert(t *testing.T) {
+	ts := newTestService(t)
+
+	var (
+		res     []Setting
+		bundles []Bundle
+	)
+
+	if code := apiCall(t, ts, http.MethodPost, "/set-tag", `{"user_id": 1, "items": ["jun"]}`, nil); code != http.StatusCreated {
+		t.Fatal("step 1 fail:", code)
+	}
+
+	rev := time.Now().UTC().Format(time.RFC3339Nano)
+
+	if code := apiCall(t, ts, http.MethodPost, "/set-tag", `{"user_id": 1, "items": ["mid"]}`, nil); code != http.StatusCreated {
+		t.Fatal("step 2 fail:", code)
+	}
+
+	body := `{"revision": "` + rev + `", "reason": "bad change", "dry_run": true}`
+
+	if code := apiCall(t, ts, http.MethodPost, "/users/1/revert", body, &bundles); code != http.StatusOK || len(bundles) != 4 || bundles[0].Tag != "jun" {
+		t.Fatal("step 3 fail:", code, bundles)
+	}
+
+	if apiCall(t, ts, http.MethodGet, "/settings/1", "", &res); settingsMap(res)["profit"] != "90" {
+		t.Fatal("step 4 fail: dry run made change", res)
+	}
+
+	body = `{"revision": "` + rev + `", "reason": "bad change"}`
+
+	if code := apiCall(t, ts, http.MethodPost, "/users/1/revert", body, nil); code != http.StatusCreated {
+		t.Fatal("step 5 fail:", code)
+	}
+
+	if apiCall(t, ts, http.MethodGet, "/settings/1", "", &res); settingsMap(res)["profit"] != "85" {
+		t.Fatal("step 6 fail:", res)
+	}
+
+	if code := apiCall(t, ts, http.MethodPost, "/users/1/revert", `{"revision": "baseline"}`, nil); code != http.StatusCreated {
+		t.Fatal("step 7 fail:", code)
+	}
+
+	if apiCall(t, ts, http.MethodGet, "/settings/1", "", &res); len(res) != 0 {
+		t.Fatal("step 8 fail:", res)
+	}
+
+	var audit []AuditRecord
+
+	if apiCall(t, ts, http.MethodGet, "/audit?user_id=1", "", &audit); len(audit) != 4 ||
+		audit[1].Action != "revert" || audit[1].Reason != "bad change" || audit[1].Items[0] != rev {
+		t.Fatal("step 9 fail:", audit)
+	}
+}
+
+func TestServiceReplaceMode(t *testing.T) {
+	ts := newTestService(t)
+
+	var res []Setting
+
+	if code := apiCall(t, ts, http.MethodPost, "/set-tag", `{"user_id": 1, "items": ["mid"]}`, nil); code != http.StatusCreated {
+		t.Fatal("step 1 fail:", code)
+	}
+
+	body := `{"user_id": 1, "items": ["profit-sen", "deals-jun"], "mode": "replace"}`
+
+	if code := apiCall(t, ts, http.MethodPost, "/set-bundles", body, nil); code != http.StatusCreated {
+		t.Fatal("step 2 fail:", code)
+	}
+
+	apiCall(t, ts, http.MethodGet, "/settings/1", "", &res)
+
+	if m := settingsMap(res); len(res) != 2 || m["profit"] != "92" || m["max-deals"] != "10" {
+		t.Fatal("step 3 fail:", res)
+	}
+
+	for i, body := range []string{
+		`{"user_id": 1, "items": ["profit-jun", "profit-sen"], "mode": "replace"}`,
+		`{"user_id": 1, "items": ["profit-jun", "no-such"], "mode": "replace"}`,
+		`{"user_id": 1, "items": ["profit-jun"], "mode": "swap"}`,
+	} {
+		if code := apiCall(t, ts, http.MethodPost, "/set-bundles", body, nil); code != http.StatusBadRequest {
+			t.Fatal("step 4 fail:", i, code)
+		}
+	}
+
+	if code := apiCall(t, ts, http.MethodPost, "/set-tag", `{"user_id": 1, "items": ["jun"], "mode": "replace"}`, nil); code != http.StatusCreated {
+		t.Fatal("step 5 fail:", code)
+	}
+
+	apiCall(t, ts, http.MethodGet, "/settings/1", "", &res)
+
+	if m := settingsMap(res); len(res) != 5 || m["profit"] != "85" || m["max-deals"] != "10" {
+		t.Fatal("step 6 fail:", res)
+	}
+}
+
+func TestServiceBundleTree(t *testing.T) {
+	ts := newTestService(t)
+
+	var tree []BundleNode
+
+	if code := apiCall(t, ts, http.MethodGet, "/bundle-tree", "", &tree); code != http.StatusOK || len(tree) != 4 {
+		t.Fatal("step 1 fail:", code, tree)
+	}
+
+	var names []string
+
+	for n := &tree[0]; n != nil; {
+		names = append(names, n.Name)
+
+		if len(n.Values) != 1 || n.Values[0].Name != "profit" {
+			t.Fatal("step 2 fail:", n.Name, n.Values)
+		}
+
+		if n.Children == nil {
+			break
+		}
+
+		n = n.Children[0]
+	}
+
+	if strings.Join(names, ",") != "profit-jun,profit-mid,profit-sen,profit-god" {
+		t.Fatal("step 3 fail:", names)
+	}
+
+	var node BundleNode
+
+	if code := apiCall(t, ts, http.MethodGet, "/bundles/extra-mid", "", &node); code != http.StatusOK {
+		t.Fatal("step 4 fail:", code)
+	}
+
+	if m := settingsMap(node.Values); node.ParentID != 11 || len(node.Children) != 1 ||
+		node.Children[0].Name != "extra-sen" || m["extra-access"] != "courses" || len(node.Children[0].Values) != 2 {
+		t.Fatal("step 5 fail:", node)
+	}
+
+	if code := apiCall(t, ts, http.MethodGet, "/bundles/no-such", "", nil); code != http.StatusNotFound {
+		t.Fatal("step 6 fail:", code)
+	}
+
+	if code := apiCall(t, ts, http.MethodGet, "/bundles/profit-jun?when=2001-01-01T00:00:00Z", "", &node); code != http.StatusOK || len(node.Values) != 0 {
+		t.Fatal("step 7 fail:", code, node)
+	}
+}
+
+func TestServiceBundleTreeCycle(t *testing.T) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	c := demoCatalog()
+	c.Bundles = append(c.Bundles,
+		Bundle{ID: 20, Name: "loop-a", ParentID: 21},
+		Bundle{ID: 21, Name: "loop-b", ParentID: 20},
+		Bundle{ID: 22, Name: "loop-c", ParentID: 21},
+		Bundle{ID: 23, Name: "loop-self", ParentID: 23},
+	)
+
+	cfg := defaultConfig()
+	ts := httptest.NewServer(newService(&cfg, NewMemoryUserStore(userStoreOptions{}), NewMemorySettingStore(c), nil).routes())
+
+	t.Cleanup(ts.Close)
+
+	var tree []BundleNode
+
+	if code := apiCall(t, ts, http.MethodGet, "/bundle-tree", "", &tree); code != http.StatusOK || len(tree) != 8 {
+		t.Fatal("step 1 fail:", code, len(tree))
+	}
+
+	for _, name := range []string{"loop-a", "loop-b", "loop-c", "loop-self"} {
+		var node BundleNode
+
+		if code := apiCall(t, ts, http.MethodGet, "/bundles/"+name, "", &node); code != http.StatusOK ||
+			node.Name != name || len(node.Children) != 0 {
+			t.Fatal("step 2 fail:", name, code, node)
+		}
+	}
+}
+
+func TestServiceBundleByTag(t *testing.T) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	c := demoCatalog()
+	c.Bundles = append(c.Bundles,
+		Bundle{ID: 30, Tag: "jun", Name: "tree"},
+		Bundle{ID: 31, Tag: "jun", Name: "twin"},
+		Bundle{ID: 32, Tag: "mid", Name: "twin"},
+	)
+
+	cfg := defaultConfig()
+	ts := httptest.NewServer(newService(&cfg, NewMemoryUserStore(userStoreOptions{}), NewMemorySettingStore(c), nil).routes())
+
+	t.Cleanup(ts.Close)
+
+	var node BundleNode
+
+	if code := apiCall(t, ts, http.MethodGet, "/bundles/tree", "", &node); code != http.StatusOK || node.ID != 30 {
+		t.Fatal("step 1 fail:", code, node)
+	}
+
+	if code := apiCall(t, ts, http.MethodGet, "/bundles/twin", "", nil); code != http.StatusConflict {
+		t.Fatal("step 2 fail:", code)
+	}
+
+	if code := apiCall(t, ts, http.MethodGet, "/bundles/twin?tag=mid", "", &node); code != http.StatusOK || node.ID != 32 {
+		t.Fatal("step 3 fail:", code, node)
+	}
+
+	if code := apiCall(t, ts, http.MethodGet, "/bundles/twin?tag=sen", "", nil); code != http.StatusNotFound {
+		t.Fatal("step 4 fail:", code)
+	}
+
+	if code := apiCall(t, ts, http.MethodGet, "/bundles/profit-god?tag=", "", &node); code != http.StatusOK || node.ID != 4 {
+		t.Fatal("step 5 fail:", code, node)
+	}
+}
+
+func TestServiceBadRequests(t *testing.T) {
+	ts := newTestService(t)
+
+	for _, c := range []struct {
+		method, path, body string
+		want               int
+	}{
+		{http.MethodPost, "/settings/1", "", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/settings/x", "", http.StatusBadRequest},
+		{http.MethodGet, "/settings/1?when=yesterday", "", http.StatusBadRequest},
+		{http.MethodGet, "/audit?limit=-1", "", http.StatusBadRequest},
+		{http.MethodGet, "/settings/batch", "", http.StatusBadRequest},
+		{http.MethodGet, "/settings/batch?user_id=x", "", http.StatusBadRequest},
+		{http.MethodGet, "/settings/batch?user_id=1&when=yesterday", "", http.StatusBadRequest},
+		{http.MethodPost, "/set-tag", `{"user_id": 1}`, http.StatusBadRequest},
+		{http.MethodPost, "/set-tag", `{"items": ["jun"]}`, http.StatusBadRequest},
+		{http.MethodPost, "/set-tag", `{`, http.StatusBadRequest},
+		{http.MethodPost, "/set-tag", `{"user_id": 1, "items": ["jun"], "start": "2001-01-01T00:00:00Z"}`, http.StatusBadRequest},
+		{http.MethodPost, "/set-tag", `{"user_id": 1, "items": ["jun"], "start": "2999-01-02T00:00:00Z", "expire": "2999-01-01T00:00:00Z"}`, http.StatusBadRequest},
+		{http.MethodGet, "/scheduled?user_id=x", "", http.StatusBadRequest},
+		{http.MethodPost, "/cancel-scheduled", `{"user_id": 1, "items": ["x"]}`, http.StatusBadRequest},
+		{http.MethodPost, "/set-expire", `{"user_id": 1, "expire": "2001-01-01T00:00:00Z"}`, http.StatusBadRequest},
+		{http.MethodPost, "/set-expire", `{"user_id": 1, "start": "2999-01-01T00:00:00Z"}`, http.StatusBadRequest},
+		{http.MethodPost, "/set-expire", `{"expire": "2999-01-01T00:00:00Z"}`, http.StatusBadRequest},
+		{http.MethodPost, "/set-tag", `{"user_id": 1, "items": ["jun"], "mode": "chain"}`, http.StatusBadRequest},
+		{http.MethodPost, "/unset-tag", `{"user_id": 1, "items": ["jun"], "mode": "replace"}`, http.StatusBadRequest},
+		{http.MethodGet, "/users/1/revert", "", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/bundle-tree?when=yesterday", "", http.StatusBadRequest},
+		{http.MethodGet, "/bundles/profit-jun?when=yesterday", "", http.StatusBadRequest},
+		{http.MethodPost, "/users/1/revert", `{}`, http.StatusBadRequest},
+		{http.MethodPost, "/users/1/revert", `{"revision": "yesterday"}`, http.StatusBadRequest},
+		{http.MethodPost, "/users/1/revert", `{"revision": "2999-01-01T00:00:00Z"}`, http.StatusBadRequest},
+		{http.MethodPost, "/users/x/revert", `{"revision": "baseline"}`, http.StatusBadRequest},
+		{http.MethodPost, "/users/1/revert", `{"user_id": 2, "revision": "baseline"}`, http.StatusBadRequest},
+	} {
+		if code := apiCall(t, ts, c.method, c.path, c.body, nil); code != c.want {
+			t.Fatalf("%s %s: want %d got %d", c.method, c.path, c.want, code)
+		}
+	}
+}
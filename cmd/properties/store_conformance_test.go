@@ -0,0 +1,709 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// userStoreFactory creates empty UserStore, `res` is a minimal time step,
+// that store can distinguish between two revisions.
+type userStoreFactory func(t *testing.T) (us UserStore, res time.Duration)
+
+// settingStoreFactory creates SettingStore, filled with given catalog.
+type settingStoreFactory func(t *testing.T, c catalog) SettingStore
+
+// testUserStoreConformance checks, that UserStore implementation follows
+// expected semantics, any implementation must pass it.
+func testUserStoreConformance(t *testing.T, newStore userStoreFactory) {
+	ctx := context.Background()
+
+	t.Run("empty", func(t *testing.T) {
+		us, _ := newStore(t)
+
+		s, err := us.Get(ctx, 1, time.Now())
+		if err != nil || len(s.Bundles) != 0 || s.Expire != nil {
+			t.Fatal("unexpected state for unknown user:", s, err)
+		}
+	})
+
+	t.Run("set-get", func(t *testing.T) {
+		us, res := newStore(t)
+
+		before := time.Now().Add(-time.Hour)
+		exp := time.Now().Add(time.Hour).Truncate(time.Second)
+
+		if err := us.Set(ctx, 1, UserSettings{Bundles: []int{3, 1, 2}, Expire: &exp}, Change{}); err != nil {
+			t.Fatal(err)
+		}
+
+		s, err := us.Get(ctx, 1, time.Now().Add(res))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !sameInts(s.Bundles, []int{1, 2, 3}) || s.Expire == nil || !s.Expire.Equal(exp) {
+			t.Fatal("unexpected state:", s)
+		}
+
+		if s, err = us.Get(ctx, 1, before); err != nil || len(s.Bundles) != 0 {
+			t.Fatal("state visible before creation:", s, err)
+		}
+
+		if s, err = us.Get(ctx, 1, exp.Add(time.Second)); err != nil || len(s.Bundles) != 0 {
+			t.Fatal("state visible after expiration:", s, err)
+		}
+
+		if s, err = us.Get(ctx, 2, time.Now().Add(res)); err != nil || len(s.Bundles) != 0 {
+			t.Fatal("state leaked to other user:", s, err)
+		}
+	})
+
+	t.Run("get-many", func(t *testing.T) {
+		us, res := newStore(t)
+
+		before := time.Now().Add(-time.Hour)
+
+		for uid := 1; uid <= 5; uid++ {
+			if err := us.Set(ctx, uid, UserSettings{Bundles: []int{uid, 10}}, Change{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		rv, err := us.GetMany(ctx, []int{1, 2, 3, 4, 5, 6, 3}, time.Now().Add(res))
+		if err != nil || len(rv) != 6 {
+			t.Fatal("bad batch:", rv, err)
+		}
+
+		for uid := 1; uid <= 5; uid++ {
+			if !sameInts(rv[uid].Bundles, []int{uid, 10}) {
+				t.Fatal("unexpected state:", uid, rv[uid])
+			}
+		}
+
+		if len(rv[6].Bundles) != 0 {
+			t.Fatal("state for unknown user:", rv[6])
+		}
+
+		if rv, err = us.GetMany(ctx, []int{1, 2}, before); err != nil || len(rv[1].Bundles)+len(rv[2].Bundles) != 0 {
+			t.Fatal("state visible before creation:", rv, err)
+		}
+	})
+
+	t.Run("burst", func(t *testing.T) {
+		us, res := newStore(t)
+
+		// quick successive changes must not collide, the last one wins.
+		for _, b := range []int{1, 2, 3} {
+			if err := us.Set(ctx, 1, UserSettings{Bundles: []int{b}}, Change{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if s, err := us.Get(ctx, 1, time.Now().Add(res)); err != nil || !sameInts(s.Bundles, []int{3}) {
+			t.Fatal("bad state after burst:", s, err)
+		}
+	})
+
+	t.Run("revisions", func(t *testing.T) {
+		us, res := newStore(t)
+
+		if err := us.Set(ctx, 1, UserSettings{Bundles: []int{1}}, Change{}); err != nil {
+			t.Fatal(err)
+		}
+
+		time.Sleep(res)
+
+		mid := time.Now()
+
+		time.Sleep(res)
+
+		exp := time.Now().Add(5 * res).Truncate(time.Second).Add(time.Second)
+
+		if err := us.Set(ctx, 1, UserSettings{Bundles: []int{2}, Expire: &exp}, Change{}); err != nil {
+			t.Fatal(err)
+		}
+
+		s, err := us.Get(ctx, 1, mid)
+		if err != nil || !sameInts(s.Bundles, []int{1}) {
+			t.Fatal("bad past state:", s, err)
+		}
+
+		s, err = us.Get(ctx, 1, time.Now().Add(res))
+		if err != nil || !sameInts(s.Bundles, []int{2}) {
+			t.Fatal("bad actual state:", s, err)
+		}
+
+		// expired revision falls back to previous one
+		s, err = us.Get(ctx, 1, exp.Add(time.Hour))
+		if err != nil || !sameInts(s.Bundles, []int{1}) {
+			t.Fatal("bad future state:", s, err)
+		}
+	})
+
+	t.Run("scheduled", func(t *testing.T) {
+		us, res := newStore(t)
+
+		if err := us.Set(ctx, 1, UserSettings{Bundles: []int{1}}, Change{}); err != nil {
+			t.Fatal(err)
+		}
+
+		start1 := time.Now().Add(time.Hour).Truncate(time.Second)
+		start2 := start1.Add(time.Hour)
+
+		for _, c := range []struct {
+			start  time.Time
+			set    []int
+			origin string
+		}{
+			{start2, []int{1, 2, 3}, originExpire},
+			{start1, []int{1, 2}, ""},
+		} {
+			if err := us.Set(ctx, 1, UserSettings{Bundles: c.set}, Change{Action: "set-bundles", Start: &c.start, Origin: c.origin}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		check := func(step string, when time.Time, want []int) {
+			if s, err := us.Get(ctx, 1, when); err != nil || !sameInts(s.Bundles, want) {
+				t.Fatalf("%s: at %v: want %v got %v (%v)", step, when, want, s.Bundles, err)
+			}
+		}
+
+		check("actual", time.Now().Add(res), []int{1})
+		check("first", start1, []int{1, 2})
+		check("second", start2.Add(time.Second), []int{1, 2, 3})
+
+		sc, err := us.Scheduled(ctx, 1, time.Now())
+		if err != nil || len(sc) != 2 || !sc[0].Start.Equal(start1) || !sc[1].Start.Equal(start2) ||
+			!sameInts(sc[1].Bundles, []int{1, 2, 3}) || sc[0].UserID != 1 || sc[0].Origin != "" || sc[1].Origin != originExpire {
+			t.Fatal("bad scheduled:", sc, err)
+		}
+
+		if sc2, err := us.Scheduled(ctx, 2, time.Now()); err != nil || len(sc2) != 0 {
+			t.Fatal("scheduled leaked to other user:", sc2, err)
+		}
+
+		if n, err := us.Cancel(ctx, 2, []int{sc[0].ID}, Change{}); err != nil || n != 0 {
+			t.Fatal("cancelled change of other user:", n, err)
+		}
+
+		if n, err := us.Cancel(ctx, 1, []int{sc[1].ID}, Change{Action: "cancel-scheduled"}); err != nil || n != 1 {
+			t.Fatal("bad cancel:", n, err)
+		}
+
+		check("cancelled", start2.Add(time.Second), []int{1, 2})
+		check("kept", time.Now().Add(res), []int{1})
+
+		if sc, err = us.Scheduled(ctx, 1, time.Now()); err != nil || len(sc) != 1 || !sc[0].Start.Equal(start1) {
+			t.Fatal("bad scheduled after cancel:", sc, err)
+		}
+
+		if n, err := us.Cancel(ctx, 1, []int{sc[0].ID}, Change{}); err != nil || n != 1 {
+			t.Fatal("bad cancel:", n, err)
+		}
+
+		check("all cancelled", start2, []int{1})
+
+		rv, err := us.Audit(ctx, AuditFilter{UserID: 1})
+		if err != nil || len(rv) != 5 || rv[0].Action != "" || rv[1].Action != "cancel-scheduled" {
+			t.Fatal("bad audit:", rv, err)
+		}
+	})
+
+	t.Run("compact", func(t *testing.T) {
+		us, res := newStore(t)
+
+		now := time.Now().Truncate(time.Second)
+		past := now.Add(-time.Hour)
+		exp1, exp2 := now.Add(time.Hour), now.Add(2*time.Hour)
+
+		for _, s := range []struct {
+			user int
+			set  UserSettings
+		}{
+			{1, UserSettings{Bundles: []int{1}}},                // hidden by 2
+			{1, UserSettings{Bundles: []int{2}}},                // answer after exp2
+			{1, UserSettings{Bundles: []int{3}, Expire: &exp2}}, // answer in (exp1, exp2]
+			{1, UserSettings{Bundles: []int{4}, Expire: &exp1}}, // answer before exp1
+			{2, UserSettings{Bundles: []int{5}, Expire: &past}}, // never visible
+		} {
+			if err := us.Set(ctx, s.user, s.set, Change{}); err != nil {
+				t.Fatal(err)
+			}
+
+			time.Sleep(res)
+		}
+
+		cutoff := time.Now()
+
+		time.Sleep(res)
+
+		check := func(step string) {
+			for _, c := range []struct {
+				user int
+				when time.Time
+				want []int
+			}{
+				{1, cutoff, []int{4}},
+				{1, exp1.Add(time.Second), []int{3}},
+				{1, exp2.Add(time.Second), []int{2}},
+				{2, cutoff, nil},
+			} {
+				s, err := us.Get(ctx, c.user, c.when)
+				if err != nil || !sameInts(s.Bundles, c.want) {
+					t.Fatalf("%s: user %d at %v: want %v got %v (%v)", step, c.user, c.when, c.want, s.Bundles, err)
+				}
+			}
+		}
+
+		check("before")
+
+		st, err := us.Compact(ctx, cutoff)
+		if err != nil || st.Users != 2 || st.Archived != 2 {
+			t.Fatal("bad compaction:", st, err)
+		}
+
+		check("after")
+
+		if st, err = us.Compact(ctx, cutoff); err != nil || st.Archived != 0 {
+			t.Fatal("bad repeated compaction:", st, err)
+		}
+	})
+
+	t.Run("audit", func(t *testing.T) {
+		us, res := newStore(t)
+
+		changes := []struct {
+			user int
+			ch   Change
+		}{
+			{1, Change{Action: "set-tag", Items: []string{"jun"}, Tag: "jun", Actor: "alice", Reason: "hired"}},
+			{2, Change{Action: "set-bundles", Items: []string{"a", "b"}, Actor: "bob", Caller: "crm", OnBehalfOf: "eve"}},
+			{1, Change{Action: "set-tag", Items: []string{"mid"}, Tag: "mid", Actor: "alice"}},
+		}
+
+		for _, c := range changes {
+			if err := us.Set(ctx, c.user, UserSettings{Bundles: []int{1}}, c.ch); err != nil {
+				t.Fatal(err)
+			}
+
+			time.Sleep(res)
+		}
+
+		rv, err := us.Audit(ctx, AuditFilter{})
+		if err != nil || len(rv) != 3 {
+			t.Fatal("bad full audit:", rv, err)
+		}
+
+		if r := rv[2]; r.UserID != 1 || r.Action != "set-tag" || r.Tag != "jun" ||
+			r.Actor != "alice" || r.Reason != "hired" || !reflect.DeepEqual(r.Items, []string{"jun"}) {
+			t.Fatal("bad audit record:", r)
+		}
+
+		if r := rv[1]; r.Caller != "crm" || r.OnBehalfOf != "eve" || r.Tag != "" || !reflect.DeepEqual(r.Items, []string{"a", "b"}) {
+			t.Fatal("bad audit record:", r)
+		}
+
+		for _, c := range []struct {
+			f    AuditFilter
+			want int
+		}{
+			{AuditFilter{UserID: 1}, 2},
+			{AuditFilter{Actor: "bob"}, 1},
+			{AuditFilter{Tag: "mid"}, 1},
+			{AuditFilter{UserID: 1, Tag: "sen"}, 0},
+			{AuditFilter{Limit: 2}, 2},
+			{AuditFilter{From: time.Now().Add(time.Hour)}, 0},
+			{AuditFilter{To: time.Now().Add(-time.Hour)}, 0},
+		} {
+			if rv, err = us.Audit(ctx, c.f); err != nil || len(rv) != c.want {
+				t.Fatalf("filter %+v: want %d got %d (%v)", c.f, c.want, len(rv), err)
+			}
+		}
+	})
+
+	t.Run("outbox", func(t *testing.T) {
+		us, _ := newStore(t)
+
+		boxes := outboxesOf(us)
+		if len(boxes) != 1 {
+			t.Skip("change events are not recorded")
+		}
+
+		ob := boxes[0]
+
+		for _, uid := range []int{1, 2, 1} {
+			if err := us.Set(ctx, uid, UserSettings{Bundles: []int{uid}}, Change{Action: "set-bundles", Actor: "alice"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		evs, err := ob.Pending(ctx, 10)
+		if err != nil || len(evs) != 3 {
+			t.Fatal("bad pending events:", evs, err)
+		}
+
+		ids := make(map[string]struct{})
+
+		for i, uid := range []int{1, 2, 1} {
+			var ev ChangeEvent
+
+			if err = json.Unmarshal(evs[i].Payload, &ev); err != nil {
+				t.Fatal(err)
+			}
+
+			if evs[i].UserID != uid || ev.UserID != uid || !sameInts(ev.Bundles, []int{uid}) ||
+				ev.Action != "set-bundles" || ev.Actor != "alice" || ev.ID == "" {
+				t.Fatal("bad event:", i, ev)
+			}
+
+			ids[ev.ID] = struct{}{}
+		}
+
+		if len(ids) != 3 {
+			t.Fatal("event ids are not unique:", ids)
+		}
+
+		if evs, err = ob.Pending(ctx, 2); err != nil || len(evs) != 2 {
+			t.Fatal("limit ignored:", evs, err)
+		}
+
+		if err = ob.Ack(ctx, []int64{evs[0].ID, evs[1].ID}); err != nil {
+			t.Fatal(err)
+		}
+
+		if evs, err = ob.Pending(ctx, 10); err != nil || len(evs) != 1 || evs[0].UserID != 1 {
+			t.Fatal("bad events after ack:", evs, err)
+		}
+	})
+
+	t.Run("idempotency", func(t *testing.T) {
+		us, _ := newStore(t)
+
+		is := idempotencyOf(us)
+		if is == nil {
+			t.Skip("idempotency keys are not kept")
+		}
+
+		since := time.Now().Add(-time.Hour)
+
+		claim := func(key, hash string) *IdempotencyRecord {
+			t.Helper()
+
+			rec, err := is.Claim(ctx, 1, key, hash, since)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			return rec
+		}
+
+		if rec := claim("a", "h1"); rec != nil {
+			t.Fatal("new key is taken:", rec)
+		}
+
+		if rec := claim("a", "h2"); rec == nil || rec.Hash != "h1" || rec.Status != 0 {
+			t.Fatal("claim is not kept:", rec)
+		}
+
+		// change, made by request, is recorded along with it.
+		if err := us.Set(withIdempotencyKey(ctx, "a"), 1, UserSettings{Bundles: []int{1}}, Change{}); err != nil {
+			t.Fatal(err)
+		}
+
+		if rec := claim("a", "h1"); rec == nil || rec.Status != statusChanged {
+			t.Fatal("change is not recorded:", rec)
+		}
+
+		if err := is.Complete(ctx, 1, "a", 200, []byte("ok")); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := is.Release(ctx, 1, "a"); err != nil {
+			t.Fatal(err)
+		}
+
+		if rec := claim("a", "h1"); rec == nil || rec.Status != 200 || string(rec.Body) != "ok" {
+			t.Fatal("outcome is not kept:", rec)
+		}
+
+		claim("b", "h1")
+
+		if err := is.Release(ctx, 1, "b"); err != nil {
+			t.Fatal(err)
+		}
+
+		if rec := claim("b", "h1"); rec != nil {
+			t.Fatal("released key is taken:", rec)
+		}
+
+		if rec, err := is.Claim(ctx, 1, "a", "h3", time.Now().Add(time.Hour)); err != nil || rec != nil {
+			t.Fatal("expired key is not replaced:", rec, err)
+		}
+
+		if n, err := is.Purge(ctx, time.Now().Add(time.Hour)); err != nil || n != 2 {
+			t.Fatal("bad purge:", n, err)
+		}
+	})
+}
+
+// testSettingStoreConformance checks, that SettingStore implementation follows
+// expected semantics, any implementation must pass it.
+func testSettingStoreConformance(t *testing.T, newStore settingStoreFactory) {
+	var (
+		ctx = context.Background()
+		c   = demoCatalog()
+		at  = time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+		exp = at.Add(time.Hour)
+	)
+
+	// time-limited value for 'profit-jun' bundle
+	c.BundleValues = append(c.BundleValues, catalogBundleValue{
+		BundleID:  1,
+		ValueID:   2,
+		CreatedAt: at,
+		ExpiredAt: &exp,
+	})
+
+	ss := newStore(t, c)
+
+	t.Run("lists", func(t *testing.T) {
+		names, err := ss.SettingsList(ctx)
+		if err != nil || !reflect.DeepEqual(names, []string{
+			"profit", "max-deals", "max-deal-amount", "extra-status-icon", "extra-access",
+		}) {
+			t.Fatal("bad settings:", names, err)
+		}
+
+		tags, err := ss.TagsList(ctx)
+		if sort.Strings(tags); err != nil || !reflect.DeepEqual(tags, []string{"jun", "mid", "sen"}) {
+			t.Fatal("bad tags:", tags, err)
+		}
+
+		bundles, err := ss.BundlesList(ctx)
+		if err != nil || len(bundles) != len(c.Bundles) {
+			t.Fatal("bad bundles:", bundles, err)
+		}
+
+		for i, b := range bundles {
+			if b != c.Bundles[i] {
+				t.Fatal("bad bundle:", b, c.Bundles[i])
+			}
+		}
+	})
+
+	t.Run("bundles", func(t *testing.T) {
+		for _, q := range []struct {
+			name string
+			fn   func() ([]Bundle, error)
+			want []int
+		}{
+			{"tag", func() ([]Bundle, error) { return ss.BundlesByTag(ctx, "sen") }, []int{3, 7, 10, 13}},
+			{"tag-unknown", func() ([]Bundle, error) { return ss.BundlesByTag(ctx, "god") }, nil},
+			{"id", func() ([]Bundle, error) { return ss.BundlesByID(ctx, []int{4, 2, 99}) }, []int{2, 4}},
+			{"id-empty", func() ([]Bundle, error) { return ss.BundlesByID(ctx, nil) }, nil},
+			{"name", func() ([]Bundle, error) { return ss.BundlesByName(ctx, []string{"deals-sen", "x"}) }, []int{7}},
+			{"name-empty", func() ([]Bundle, error) { return ss.BundlesByName(ctx, nil) }, nil},
+		} {
+			rv, err := q.fn()
+			if err != nil {
+				t.Fatal(q.name, err)
+			}
+
+			ids := make([]int, 0, len(rv))
+			for _, b := range rv {
+				ids = append(ids, b.ID)
+			}
+
+			if len(ids) != len(q.want) || (len(ids) > 0 && !reflect.DeepEqual(ids, q.want)) {
+				t.Fatalf("%s: want %v got %v", q.name, q.want, ids)
+			}
+		}
+
+		rv, err := ss.BundlesByName(ctx, []string{"profit-god"})
+		if err != nil || len(rv) != 1 || rv[0].Tag != "" || rv[0].ParentID != 3 {
+			t.Fatal("bad untagged bundle:", rv, err)
+		}
+	})
+
+	t.Run("values", func(t *testing.T) {
+		for _, q := range []struct {
+			name    string
+			when    time.Time
+			bundles []int
+			want    []Setting
+		}{
+			{"empty", at, nil, nil},
+			{"tagged", at.Add(-time.Second), []int{12, 7}, []Setting{
+				{"extra-access", "courses"},
+				{"extra-status-icon", "http://foo.bar/middle.png"},
+				{"max-deals", "20"},
+			}},
+			{"before", at.Add(-time.Second), []int{1}, []Setting{{"profit", "85"}}},
+			{"during", at.Add(time.Minute), []int{1}, []Setting{{"profit", "85"}, {"profit", "90"}}},
+			{"after", exp, []int{1}, []Setting{{"profit", "85"}}},
+		} {
+			rv, err := ss.Get(ctx, q.when, q.bundles)
+			if err != nil {
+				t.Fatal(q.name, err)
+			}
+
+			sortSettings(rv)
+			sortSettings(q.want)
+
+			if len(rv) != len(q.want) || (len(rv) > 0 && !reflect.DeepEqual(rv, q.want)) {
+				t.Fatalf("%s: want %v got %v", q.name, q.want, rv)
+			}
+		}
+	})
+
+	t.Run("bundle-values", func(t *testing.T) {
+		rv, err := ss.BundleValues(ctx, at.Add(time.Minute), []int{1, 11, 99})
+		if err != nil || len(rv) != 2 {
+			t.Fatal("bad bundle values:", rv, err)
+		}
+
+		sortSettings(rv[1])
+
+		if !reflect.DeepEqual(rv[1], []Setting{{"profit", "85"}, {"profit", "90"}}) ||
+			!reflect.DeepEqual(rv[11], []Setting{{"extra-status-icon", "http://foo.bar/junior.png"}, {"extra-access", ""}}) {
+			t.Fatal("bad bundle values:", rv)
+		}
+
+		if rv, err = ss.BundleValues(ctx, exp, []int{1}); err != nil || !reflect.DeepEqual(rv[1], []Setting{{"profit", "85"}}) {
+			t.Fatal("expired value:", rv, err)
+		}
+
+		if rv, err = ss.BundleValues(ctx, at, nil); err != nil || len(rv) != 0 {
+			t.Fatal("values without bundles:", rv, err)
+		}
+	})
+
+	t.Run("digest", func(t *testing.T) {
+		digest := func(when time.Time) string {
+			d, err := ss.Digest(ctx, when)
+			if err != nil || d == "" {
+				t.Fatal("bad digest:", d, err)
+			}
+
+			return d
+		}
+
+		before := digest(at.Add(-time.Second))
+
+		if d := digest(at.Add(-time.Minute)); d != before {
+			t.Fatal("digest changed without catalog changes:", before, d)
+		}
+
+		if d := digest(at.Add(time.Minute)); d == before {
+			t.Fatal("digest not changed by value activation")
+		}
+
+		if d := digest(exp); d != before {
+			t.Fatal("digest not restored by value expiration:", before, d)
+		}
+	})
+}
+
+// seedCatalog fills settings database with catalog, `bind` converts
+// `?` placeholders to ones driver understands, `ts` converts timestamps to column values.
+func seedCatalog(
+	t *testing.T,
+	db *sql.DB,
+	c catalog,
+	bind func(string) string,
+	ts func(time.Time) interface{},
+) {
+	t.Helper()
+
+	exec := func(query string, args ...interface{}) {
+		if _, err := db.Exec(bind(query), args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, s := range c.Settings {
+		exec(`INSERT INTO settings (id, name) VALUES (?, ?)`, s.ID, s.Name)
+	}
+
+	for _, v := range c.Values {
+		exec(`INSERT INTO settings_values (id, setting_id, name, value) VALUES (?, ?, ?, ?)`,
+			v.ID, v.SettingID, v.Name, v.Value)
+	}
+
+	for _, b := range c.Bundles {
+		exec(`INSERT INTO bundles (id, parent_id, tag, name) VALUES (?, ?, ?, ?)`,
+			b.ID, b.ParentID, nullString(b.Tag), b.Name)
+	}
+
+	for _, bv := range c.BundleValues {
+		var exp interface{}
+
+		if bv.ExpiredAt != nil {
+			exp = ts(*bv.ExpiredAt)
+		}
+
+		exec(`INSERT INTO bundles_values (bundle_id, value_id, created_at, expired_at) VALUES (?, ?, ?, ?)`,
+			bv.BundleID, bv.ValueID, ts(bv.CreatedAt), exp)
+	}
+}
+
+func sameInts(a, b []int) bool {
+	a = append([]int{}, a...)
+	b = append([]int{}, b...)
+
+	sort.Ints(a)
+	sort.Ints(b)
+
+	return reflect.DeepEqual(a, b)
+}
+
+func sortSettings(s []Setting) {
+	sort.Slice(s, func(i, j int) bool {
+		if s[i].Name != s[j].Name {
+			return s[i].Name < s[j].Name
+		}
+
+		return s[i].Value < s[j].Value
+	})
+}
+
+func TestMemoryStoreConformance(t *testing.T) {
+	testUserStoreConformance(t, func(*testing.T) (UserStore, time.Duration) {
+		return NewMemoryUserStore(userStoreOptions{Outbox: true}), time.Millisecond
+	})
+
+	testSettingStoreConformance(t, func(_ *testing.T, c catalog) SettingStore {
+		return NewMemorySettingStore(c)
+	})
+}
+
+func TestMemorySettingStoreKeepsCatalog(t *testing.T) {
+	c := demoCatalog()
+
+	for i, j := 0, len(c.Settings)-1; i < j; i, j = i+1, j-1 {
+		c.Settings[i], c.Settings[j] = c.Settings[j], c.Settings[i]
+	}
+
+	for i, j := 0, len(c.Bundles)-1; i < j; i, j = i+1, j-1 {
+		c.Bundles[i], c.Bundles[j] = c.Bundles[j], c.Bundles[i]
+	}
+
+	settings := append([]catalogSetting{}, c.Settings...)
+	bundles := append([]Bundle{}, c.Bundles...)
+
+	NewMemorySettingStore(c)
+
+	if !reflect.DeepEqual(c.Settings, settings) {
+		t.Fatal("step 1 fail: settings reordered", c.Settings)
+	}
+
+	if !reflect.DeepEqual(c.Bundles, bundles) {
+		t.Fatal("step 2 fail: bundles reordered", c.Bundles)
+	}
+}
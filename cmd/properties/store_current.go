@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"time"
+)
+
+// `user_settings_current` holds the latest revision of every user, it answers Get for moments
+// since that revision creation (while it is not expired), history is queried otherwise.
+const (
+	queryCurrentUpsertMySQL = `
+INSERT INTO user_settings_current
+	(user_id, settings, created_at, expires_at)
+SELECT
+	user_id, settings, created_at, expires_at
+FROM
+	user_settings
+WHERE
+	id = ?
+ON DUPLICATE KEY UPDATE
+	settings = IF(VALUES(created_at) >= user_settings_current.created_at,
+		VALUES(settings), user_settings_current.settings),
+	expires_at = IF(VALUES(created_at) >= user_settings_current.created_at,
+		VALUES(expires_at), user_settings_current.expires_at),
+	created_at = GREATEST(VALUES(created_at), user_settings_current.created_at)`
+
+	// postgres and sqlite share upsert syntax.
+	queryCurrentUpsert = `
+INSERT INTO user_settings_current
+	(user_id, settings, created_at, expires_at)
+SELECT
+	user_id, settings, created_at, expires_at
+FROM
+	user_settings
+WHERE
+	id = ?
+ON CONFLICT (user_id) DO UPDATE SET
+	settings = EXCLUDED.settings,
+	created_at = EXCLUDED.created_at,
+	expires_at = EXCLUDED.expires_at
+WHERE
+	user_settings_current.created_at <= EXCLUDED.created_at`
+)
+
+// currentUpsert returns query, that copies revision (by its id) from history to projection,
+// unless projection already holds newer one, placeholders are `?`-style.
+func currentUpsert(backend string) string {
+	if backend == backendMySQL {
+		return queryCurrentUpsertMySQL
+	}
+
+	return queryCurrentUpsert
+}
+
+const queryCurrent = `
+SELECT
+	settings,
+	created_at,
+	expires_at
+FROM
+	user_settings_current
+WHERE
+	user_id = ?`
+
+// queryLatestRevision selects id of the latest user revision.
+const queryLatestRevision = `
+SELECT
+	id
+FROM
+	user_settings
+WHERE
+	user_id = ?
+ORDER BY
+	created_at DESC, id DESC
+LIMIT 1`
+
+// visibleAt reports whenever revision can be an answer for moment `when`.
+func (r *revisionSpan) visibleAt(when time.Time) bool {
+	return !r.CreatedAt.After(when) && (r.ExpiresAt == nil || r.ExpiresAt.After(when))
+}
+
+// fromCurrent decodes projected revision, it reports false, if history must be queried instead.
+func fromCurrent(buf []byte, r *revisionSpan, when time.Time) (s UserSettings, ok bool, err error) {
+	if !r.visibleAt(when) {
+		return s, false, nil
+	}
+
+	s.Expire = r.ExpiresAt
+	s.Bundles, err = decodePayload(buf)
+
+	return s, true, err
+}
+
+// backfillCurrent builds projection from history for every user, it is safe to run
+// along with serving instances.
+func backfillCurrent(ctx context.Context, db *sql.DB, backend string) (n int, err error) {
+	const (
+		queryUsers = `
+SELECT DISTINCT
+	user_id
+FROM
+	user_settings
+WHERE
+	user_id > ?
+ORDER BY
+	user_id
+LIMIT ?`
+	)
+
+	bind := func(q string) string { return q }
+	if backend == backendPostgres {
+		bind = rebind
+	}
+
+	upsert := bind(currentUpsert(backend))
+
+	var (
+		rows  *sql.Rows
+		users []int
+		after int
+	)
+
+	for {
+		if rows, err = db.QueryContext(ctx, bind(queryUsers), after, compactBatch); err != nil {
+			return
+		}
+
+		if users, err = readInts(rows); err != nil {
+			return
+		}
+
+		for _, uid := range users {
+			var id int
+
+			if err = db.QueryRowContext(ctx, bind(queryLatestRevision), uid).Scan(&id); err != nil {
+				return
+			}
+
+			if _, err = db.ExecContext(ctx, upsert, id); err != nil {
+				return
+			}
+
+			n++
+		}
+
+		if len(users) < compactBatch {
+			return n, nil
+		}
+
+		after = users[len(users)-1]
+	}
+}
+
+// backfillCommand implements `backfill-current [flags]` command.
+func backfillCommand(args []string, getenv func(string) string, w io.Writer) error {
+	var (
+		fs   = flag.NewFlagSet("backfill-current", flag.ContinueOnError)
+		path = fs.String("config", getenv(envConfig), "path to yaml config file")
+	)
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() > 0 {
+		return errors.New("usage: backfill-current [flags]")
+	}
+
+	cfg, err := readConfig(*path, getenv)
+	if err != nil {
+		return err
+	}
+
+	if err = cfg.Validate(); err != nil {
+		return err
+	}
+
+	backend := backendOf(cfg.DB.Users.DSN)
+	if backend == backendMemory {
+		return errors.New("in-memory store has no projection")
+	}
+
+	db, closeFn, err := openDB(&cfg, &cfg.DB.Users, backend, "user-db")
+	if err != nil {
+		return err
+	}
+
+	defer closeFn()
+
+	ctx := context.Background()
+
+	if err = prepareSchema(ctx, db, &cfg.DB.Users, backend, schemaUsers); err != nil {
+		return err
+	}
+
+	n, err := backfillCurrent(ctx, db, backend)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "users projected: %d\n", n)
+
+	return err
+}
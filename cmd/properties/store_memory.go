@@ -0,0 +1,707 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// catalog holds full settings database content, it used to seed in-memory
+// SettingStore (and in tests - any other implementation).
+type catalog struct {
+	Settings     []catalogSetting
+	Values       []catalogValue
+	Bundles      []Bundle
+	BundleValues []catalogBundleValue
+}
+
+type catalogSetting struct {
+	ID   int
+	Name string
+}
+
+type catalogValue struct {
+	ID        int
+	SettingID int
+	Name      string
+	Value     string
+}
+
+type catalogBundleValue struct {
+	BundleID  int
+	ValueID   int
+	CreatedAt time.Time
+	ExpiredAt *time.Time
+}
+
+// userRevision is a single row of users settings history.
+type userRevision struct {
+	ID        int
+	Bundles   []int
+	CreatedAt time.Time
+	ExpiresAt *time.Time
+	Origin    string
+}
+
+type memUser struct {
+	mu      sync.RWMutex
+	now     func() time.Time
+	users   map[int][]userRevision
+	archive map[int][]userRevision
+	audit   []AuditRecord
+	events  bool
+	outbox  []OutboxEvent
+	dead    []OutboxEvent
+	nextEv  int64
+	nextRev int
+	idem    map[string]memIdempotency
+}
+
+type memIdempotency struct {
+	IdempotencyRecord
+	CreatedAt time.Time
+}
+
+// NewMemoryUserStore creates UserStore, that holds everything in memory (codec option is ignored).
+func NewMemoryUserStore(opts userStoreOptions) UserStore {
+	return &memUser{
+		events:  opts.Outbox,
+		now:     time.Now,
+		users:   make(map[int][]userRevision),
+		archive: make(map[int][]userRevision),
+		idem:    make(map[string]memIdempotency),
+	}
+}
+
+// Get returns UserSettings for given user and time.
+func (mu *memUser) Get(_ context.Context, userID int, when time.Time) (s UserSettings, err error) {
+	mu.mu.RLock()
+	defer mu.mu.RUnlock()
+
+	var found *userRevision
+
+	revs := mu.users[userID]
+
+	for i := 0; i < len(revs); i++ {
+		r := &revs[i]
+
+		if r.CreatedAt.After(when) || (r.ExpiresAt != nil && !r.ExpiresAt.After(when)) {
+			continue
+		}
+
+		if found == nil || !r.CreatedAt.Before(found.CreatedAt) { // newer one wins a tie.
+			found = r
+		}
+	}
+
+	if found == nil {
+		return
+	}
+
+	s.Bundles = append(s.Bundles, found.Bundles...)
+
+	if found.ExpiresAt != nil {
+		exp := *found.ExpiresAt
+		s.Expire = &exp
+	}
+
+	return s, nil
+}
+
+// GetMany returns UserSettings for given users and time.
+func (mu *memUser) GetMany(ctx context.Context, userIDs []int, when time.Time) (map[int]UserSettings, error) {
+	return getEach(ctx, mu.Get, userIDs, when)
+}
+
+// Set sets new settings for user, recording change to audit trail.
+func (mu *memUser) Set(ctx context.Context, userID int, s UserSettings, ch Change) error {
+	mu.mu.Lock()
+	defer mu.mu.Unlock()
+
+	now := mu.now()
+
+	mu.nextRev++
+
+	rev := userRevision{
+		ID:        mu.nextRev,
+		Bundles:   append([]int{}, s.Bundles...),
+		CreatedAt: now,
+		Origin:    ch.Origin,
+	}
+
+	if ch.Start != nil {
+		rev.CreatedAt = *ch.Start
+	}
+
+	if s.Expire != nil {
+		exp := *s.Expire
+		rev.ExpiresAt = &exp
+	}
+
+	revs := append(mu.users[userID], rev)
+
+	// scheduled revisions come out of order, history is kept sorted by creation.
+	sort.SliceStable(revs, func(i, j int) bool { return revs[i].CreatedAt.Before(revs[j].CreatedAt) })
+
+	mu.users[userID] = revs
+
+	return mu.record(ctx, userID, &s, &ch, now)
+}
+
+// record writes audit record, request outcome and change event of change, lock must be held.
+func (mu *memUser) record(ctx context.Context, userID int, s *UserSettings, ch *Change, now time.Time) error {
+	mu.audit = append(mu.audit, AuditRecord{
+		ID:         len(mu.audit) + 1,
+		UserID:     userID,
+		Action:     ch.Action,
+		Items:      append([]string{}, ch.Items...),
+		Tag:        ch.Tag,
+		Actor:      ch.Actor,
+		Caller:     ch.Caller,
+		OnBehalfOf: ch.OnBehalfOf,
+		Reason:     ch.Reason,
+		CreatedAt:  now,
+	})
+
+	if mu.events {
+		buf, err := newChangeEvent(userID, s, ch, now)
+		if err != nil {
+			return err
+		}
+
+		mu.nextEv++
+		mu.outbox = append(mu.outbox, OutboxEvent{ID: mu.nextEv, UserID: userID, Payload: buf})
+	}
+
+	if r, ok := mu.idem[claimedKey(ctx)]; ok && r.Status == 0 {
+		r.Status = statusChanged
+		mu.idem[claimedKey(ctx)] = r
+	}
+
+	return nil
+}
+
+// Scheduled returns revisions of user, taking effect after `after`, soonest first.
+func (mu *memUser) Scheduled(_ context.Context, userID int, after time.Time) (rv []ScheduledChange, err error) {
+	mu.mu.RLock()
+	defer mu.mu.RUnlock()
+
+	for _, r := range mu.users[userID] {
+		if !r.CreatedAt.After(after) {
+			continue
+		}
+
+		sc := ScheduledChange{
+			ID:      r.ID,
+			UserID:  userID,
+			Bundles: append([]int{}, r.Bundles...),
+			Start:   r.CreatedAt,
+			Origin:  r.Origin,
+		}
+
+		if r.ExpiresAt != nil {
+			exp := *r.ExpiresAt
+			sc.Expire = &exp
+		}
+
+		rv = append(rv, sc)
+	}
+
+	return rv, nil
+}
+
+// Cancel removes scheduled revisions of user by ids, recording change to audit trail.
+func (mu *memUser) Cancel(ctx context.Context, userID int, ids []int, ch Change) (n int, err error) {
+	mu.mu.Lock()
+	defer mu.mu.Unlock()
+
+	var (
+		now  = mu.now()
+		drop = intSet(ids)
+		keep = mu.users[userID][:0:0]
+	)
+
+	for _, r := range mu.users[userID] {
+		if _, ok := drop[r.ID]; ok && r.CreatedAt.After(now) {
+			n++
+
+			continue
+		}
+
+		keep = append(keep, r)
+	}
+
+	if n == 0 {
+		return 0, nil
+	}
+
+	mu.users[userID] = keep
+
+	return n, mu.record(ctx, userID, &UserSettings{}, &ch, now)
+}
+
+// Claim reserves key for request with given hash.
+func (mu *memUser) Claim(_ context.Context, _ int, key, hash string, since time.Time) (*IdempotencyRecord, error) {
+	mu.mu.Lock()
+	defer mu.mu.Unlock()
+
+	if r, ok := mu.idem[key]; ok && !r.CreatedAt.Before(since) {
+		r.Body = append([]byte{}, r.Body...)
+
+		return &r.IdempotencyRecord, nil
+	}
+
+	mu.idem[key] = memIdempotency{IdempotencyRecord: IdempotencyRecord{Hash: hash}, CreatedAt: mu.now()}
+
+	return nil, nil
+}
+
+// Complete stores outcome of request.
+func (mu *memUser) Complete(_ context.Context, _ int, key string, status int, body []byte) error {
+	mu.mu.Lock()
+	defer mu.mu.Unlock()
+
+	if r, ok := mu.idem[key]; ok {
+		r.Status, r.Body = status, append([]byte{}, body...)
+		mu.idem[key] = r
+	}
+
+	return nil
+}
+
+// Release drops claim of failed request.
+func (mu *memUser) Release(_ context.Context, _ int, key string) error {
+	mu.mu.Lock()
+	defer mu.mu.Unlock()
+
+	if r, ok := mu.idem[key]; ok && r.Status == 0 {
+		delete(mu.idem, key)
+	}
+
+	return nil
+}
+
+// Purge removes records, created before `cutoff`.
+func (mu *memUser) Purge(_ context.Context, cutoff time.Time) (n int, err error) {
+	mu.mu.Lock()
+	defer mu.mu.Unlock()
+
+	for k, r := range mu.idem {
+		if r.CreatedAt.Before(cutoff) {
+			delete(mu.idem, k)
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// Outboxes returns store itself, if change events recording is enabled.
+func (mu *memUser) Outboxes() []Outbox {
+	if !mu.events {
+		return nil
+	}
+
+	return []Outbox{mu}
+}
+
+// Pending returns up to `limit` oldest change events, except dead ones.
+func (mu *memUser) Pending(_ context.Context, limit int) ([]OutboxEvent, error) {
+	mu.mu.RLock()
+	defer mu.mu.RUnlock()
+
+	return append([]OutboxEvent{}, mu.outbox[:min(limit, len(mu.outbox))]...), nil
+}
+
+// Ack removes published change events.
+func (mu *memUser) Ack(_ context.Context, ids []int64) error {
+	mu.mu.Lock()
+	defer mu.mu.Unlock()
+
+	done := make(map[int64]struct{}, len(ids))
+	for _, id := range ids {
+		done[id] = struct{}{}
+	}
+
+	rest := mu.outbox[:0]
+
+	for _, e := range mu.outbox {
+		if _, ok := done[e.ID]; !ok {
+			rest = append(rest, e)
+		}
+	}
+
+	mu.outbox = rest
+
+	return nil
+}
+
+// Fail counts failed publish of change event, dead one is moved out of outbox.
+func (mu *memUser) Fail(_ context.Context, id int64, dead bool) error {
+	mu.mu.Lock()
+	defer mu.mu.Unlock()
+
+	for i := range mu.outbox {
+		if e := &mu.outbox[i]; e.ID == id {
+			e.Attempts++
+
+			if dead {
+				mu.dead = append(mu.dead, *e)
+				mu.outbox = append(mu.outbox[:i], mu.outbox[i+1:]...)
+			}
+
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// Audit returns recorded changes, matching given filter, newest first.
+func (mu *memUser) Audit(_ context.Context, f AuditFilter) (rv []AuditRecord, err error) {
+	mu.mu.RLock()
+	defer mu.mu.RUnlock()
+
+	limit := auditLimit(f.Limit)
+
+	for i := len(mu.audit) - 1; i >= 0 && len(rv) < limit; i-- {
+		r := &mu.audit[i]
+
+		switch {
+		case f.UserID != 0 && r.UserID != f.UserID,
+			f.Actor != "" && r.Actor != f.Actor,
+			f.Tag != "" && r.Tag != f.Tag,
+			!f.From.IsZero() && r.CreatedAt.Before(f.From),
+			!f.To.IsZero() && !r.CreatedAt.Before(f.To):
+			continue
+		}
+
+		rv = append(rv, *r)
+	}
+
+	return rv, nil
+}
+
+// Compact archives superseded revisions, created before `cutoff`.
+func (mu *memUser) Compact(_ context.Context, cutoff time.Time) (st CompactStats, err error) {
+	mu.mu.Lock()
+	defer mu.mu.Unlock()
+
+	for uid, revs := range mu.users {
+		var (
+			idx   []int // revs indexes, newest first
+			spans []revisionSpan
+		)
+
+		for i := len(revs) - 1; i >= 0; i-- {
+			if r := &revs[i]; !r.CreatedAt.After(cutoff) {
+				idx = append(idx, i)
+				spans = append(spans, revisionSpan{CreatedAt: r.CreatedAt, ExpiresAt: r.ExpiresAt})
+			}
+		}
+
+		if len(idx) == 0 {
+			continue
+		}
+
+		st.Users++
+
+		drop := make(map[int]struct{})
+
+		for _, i := range supersededRevisions(spans, cutoff) {
+			drop[idx[i]] = struct{}{}
+		}
+
+		if len(drop) == 0 {
+			continue
+		}
+
+		keep := revs[:0:0]
+
+		for i := range revs {
+			if _, ok := drop[i]; ok {
+				mu.archive[uid] = append(mu.archive[uid], revs[i])
+			} else {
+				keep = append(keep, revs[i])
+			}
+		}
+
+		mu.users[uid] = keep
+		st.Archived += len(drop)
+	}
+
+	return st, nil
+}
+
+type memSetting struct {
+	c        catalog
+	settings map[int]*catalogSetting
+	values   map[int]*catalogValue
+}
+
+// NewMemorySettingStore creates read-only SettingStore over given catalog.
+func NewMemorySettingStore(c catalog) SettingStore {
+	ms := &memSetting{
+		c:        c,
+		settings: make(map[int]*catalogSetting, len(c.Settings)),
+		values:   make(map[int]*catalogValue, len(c.Values)),
+	}
+
+	// store sorts and keeps pointers into catalog, copy it to leave caller's one intact.
+	ms.c.Settings = append([]catalogSetting{}, c.Settings...)
+	ms.c.Bundles = append([]Bundle{}, c.Bundles...)
+	ms.c.Values = append([]catalogValue{}, c.Values...)
+
+	sort.Slice(ms.c.Settings, func(i, j int) bool { return ms.c.Settings[i].ID < ms.c.Settings[j].ID })
+	sort.Slice(ms.c.Bundles, func(i, j int) bool { return ms.c.Bundles[i].ID < ms.c.Bundles[j].ID })
+
+	for i := 0; i < len(ms.c.Settings); i++ {
+		ms.settings[ms.c.Settings[i].ID] = &ms.c.Settings[i]
+	}
+
+	for i := 0; i < len(ms.c.Values); i++ {
+		ms.values[ms.c.Values[i].ID] = &ms.c.Values[i]
+	}
+
+	return ms
+}
+
+// Get returns list of setting values for given bundles at given date.
+func (ms *memSetting) Get(_ context.Context, when time.Time, bundles []int) (rv []Setting, err error) {
+	ms.eachValue(when, bundles, func(_ int, s Setting) {
+		rv = append(rv, s)
+	})
+
+	return rv, nil
+}
+
+// BundleValues returns setting values of bundles at given date, keyed by bundle id.
+func (ms *memSetting) BundleValues(_ context.Context, when time.Time, bundles []int) (map[int][]Setting, error) {
+	rv := make(map[int][]Setting)
+
+	ms.eachValue(when, bundles, func(id int, s Setting) {
+		rv[id] = append(rv[id], s)
+	})
+
+	for _, vs := range rv {
+		sort.SliceStable(vs, func(i, j int) bool { return ms.settingID(vs[i].Name) < ms.settingID(vs[j].Name) })
+	}
+
+	return rv, nil
+}
+
+// eachValue calls `fn` for every setting value of given bundles, active at given date.
+func (ms *memSetting) eachValue(when time.Time, bundles []int, fn func(bundleID int, s Setting)) {
+	ids := intSet(bundles)
+
+	for i := 0; i < len(ms.c.BundleValues); i++ {
+		bv := &ms.c.BundleValues[i]
+
+		if _, ok := ids[bv.BundleID]; !ok || !ms.hasBundle(bv.BundleID) {
+			continue
+		}
+
+		if bv.CreatedAt.After(when) || (bv.ExpiredAt != nil && !bv.ExpiredAt.After(when)) {
+			continue
+		}
+
+		v, ok := ms.values[bv.ValueID]
+		if !ok {
+			continue
+		}
+
+		s, ok := ms.settings[v.SettingID]
+		if !ok {
+			continue
+		}
+
+		fn(bv.BundleID, Setting{Name: s.Name, Value: v.Value})
+	}
+}
+
+// settingID returns id of setting by name.
+func (ms *memSetting) settingID(name string) int {
+	for i := 0; i < len(ms.c.Settings); i++ {
+		if ms.c.Settings[i].Name == name {
+			return ms.c.Settings[i].ID
+		}
+	}
+
+	return 0
+}
+
+// SettingsList returns list of settings names.
+func (ms *memSetting) SettingsList(_ context.Context) (rv []string, err error) {
+	for i := 0; i < len(ms.c.Settings); i++ {
+		rv = append(rv, ms.c.Settings[i].Name)
+	}
+
+	return rv, nil
+}
+
+// TagsList returns list of unique non-empty tags.
+func (ms *memSetting) TagsList(_ context.Context) (rv []string, err error) {
+	seen := make(map[string]struct{})
+
+	for i := 0; i < len(ms.c.Bundles); i++ {
+		tag := ms.c.Bundles[i].Tag
+
+		if _, ok := seen[tag]; ok || tag == "" {
+			continue
+		}
+
+		seen[tag] = struct{}{}
+		rv = append(rv, tag)
+	}
+
+	return rv, nil
+}
+
+// BundlesList returns list of bundles.
+func (ms *memSetting) BundlesList(_ context.Context) ([]Bundle, error) {
+	return ms.filter(func(*Bundle) bool { return true }), nil
+}
+
+// BundlesByTag returns list of bundles by tag.
+func (ms *memSetting) BundlesByTag(_ context.Context, tag string) ([]Bundle, error) {
+	return ms.filter(func(b *Bundle) bool { return tag != "" && b.Tag == tag }), nil
+}
+
+// BundlesByID returns list of bundles by id.
+func (ms *memSetting) BundlesByID(_ context.Context, bundles []int) ([]Bundle, error) {
+	ids := intSet(bundles)
+
+	return ms.filter(func(b *Bundle) bool {
+		_, ok := ids[b.ID]
+
+		return ok
+	}), nil
+}
+
+// BundlesByName returns list of bundles by names.
+func (ms *memSetting) BundlesByName(_ context.Context, names []string) ([]Bundle, error) {
+	set := make(map[string]struct{}, len(names))
+
+	for _, n := range names {
+		set[n] = struct{}{}
+	}
+
+	return ms.filter(func(b *Bundle) bool {
+		_, ok := set[b.Name]
+
+		return ok
+	}), nil
+}
+
+// Digest returns catalog fingerprint at given date.
+func (ms *memSetting) Digest(_ context.Context, when time.Time) (string, error) {
+	h := sha256.New()
+
+	fmt.Fprintf(h, "%v\n%v\n%v\n", ms.c.Settings, ms.c.Values, ms.c.Bundles)
+
+	for i := 0; i < len(ms.c.BundleValues); i++ {
+		bv := &ms.c.BundleValues[i]
+
+		if !bv.CreatedAt.After(when) && (bv.ExpiredAt == nil || bv.ExpiredAt.After(when)) {
+			fmt.Fprintf(h, "%d:%d:%d\n", i, bv.BundleID, bv.ValueID)
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil)[:digestSize]), nil
+}
+
+func (ms *memSetting) hasBundle(id int) bool {
+	for i := 0; i < len(ms.c.Bundles); i++ {
+		if ms.c.Bundles[i].ID == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// filter returns bundles (ordered by id), accepted by `fn`.
+func (ms *memSetting) filter(fn func(*Bundle) bool) (rv []Bundle) {
+	for i := 0; i < len(ms.c.Bundles); i++ {
+		if b := &ms.c.Bundles[i]; fn(b) {
+			rv = append(rv, *b)
+		}
+	}
+
+	return rv
+}
+
+func intSet(a []int) map[int]struct{} {
+	set := make(map[int]struct{}, len(a))
+
+	for _, v := range a {
+		set[v] = struct{}{}
+	}
+
+	return set
+}
+
+// demoCatalog returns catalog, equal to one from `sql/demo/fill.sql`.
+func demoCatalog() (c catalog) {
+	epoch := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	c.Settings = []catalogSetting{
+		{1, "profit"},
+		{2, "max-deals"},
+		{3, "max-deal-amount"},
+		{4, "extra-status-icon"},
+		{5, "extra-access"},
+	}
+
+	c.Values = []catalogValue{
+		{1, 1, "profit-low", "85"},
+		{2, 1, "profit-mid", "90"},
+		{3, 1, "profit-high", "92"},
+		{4, 1, "profit-god", "146"},
+		{5, 2, "deals-10", "10"},
+		{6, 2, "deals-15", "15"},
+		{7, 2, "deals-20", "20"},
+		{8, 3, "amount-100", "100"},
+		{9, 3, "amount-500", "500"},
+		{10, 3, "amount-1000", "1000"},
+		{11, 4, "icon-jun", "http://foo.bar/junior.png"},
+		{12, 4, "icon-mid", "http://foo.bar/middle.png"},
+		{13, 4, "icon-sen", "http://foo.bar/senior.png"},
+		{14, 5, "access-jun", ""},
+		{15, 5, "access-mid", "courses"},
+		{16, 5, "access-sen", "courses;consultant"},
+	}
+
+	c.Bundles = []Bundle{
+		{ID: 1, Tag: "jun", Name: "profit-jun", ParentID: 0},
+		{ID: 2, Tag: "mid", Name: "profit-mid", ParentID: 1},
+		{ID: 3, Tag: "sen", Name: "profit-sen", ParentID: 2},
+		{ID: 4, Tag: "", Name: "profit-god", ParentID: 3},
+		{ID: 5, Tag: "jun", Name: "deals-jun", ParentID: 0},
+		{ID: 6, Tag: "mid", Name: "deals-mid", ParentID: 5},
+		{ID: 7, Tag: "sen", Name: "deals-sen", ParentID: 6},
+		{ID: 8, Tag: "jun", Name: "amount-jun", ParentID: 0},
+		{ID: 9, Tag: "mid", Name: "amount-mid", ParentID: 8},
+		{ID: 10, Tag: "sen", Name: "amount-sen", ParentID: 9},
+		{ID: 11, Tag: "jun", Name: "extra-jun", ParentID: 0},
+		{ID: 12, Tag: "mid", Name: "extra-mid", ParentID: 11},
+		{ID: 13, Tag: "sen", Name: "extra-sen", ParentID: 12},
+	}
+
+	for _, bv := range [][2]int{
+		{1, 1}, {2, 2}, {3, 3}, {4, 4}, {5, 5}, {6, 6}, {7, 7}, {8, 8}, {9, 9}, {10, 10},
+		{11, 11}, {11, 14}, {12, 12}, {12, 15}, {13, 13}, {13, 16},
+	} {
+		c.BundleValues = append(c.BundleValues, catalogBundleValue{
+			BundleID:  bv[0],
+			ValueID:   bv[1],
+			CreatedAt: epoch,
+		})
+	}
+
+	return c
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+	"time"
+)
+
+// envTestMySQLDSN holds dsn of scratch MySQL database, it must have `parseTime=true` set.
+const envTestMySQLDSN = "TEST_MYSQL_DSN"
+
+func TestMySQLStoreConformance(t *testing.T) {
+	dsn := os.Getenv(envTestMySQLDSN)
+	if dsn == "" {
+		t.Skip(envTestMySQLDSN, "not set")
+	}
+
+	db, err := sql.Open(backendMySQL, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	migrateTest(t, db, backendMySQL, schemaUsers)
+	migrateTest(t, db, backendMySQL, schemaSettings)
+
+	truncate := func(t *testing.T, tables ...string) {
+		t.Helper()
+
+		for _, table := range tables {
+			execSQL(t, db, "TRUNCATE TABLE `"+table+"`")
+		}
+	}
+
+	testUserStoreConformance(t, func(t *testing.T) (UserStore, time.Duration) {
+		truncate(t, "user_settings", "user_settings_audit", "user_settings_archive", "user_settings_current",
+			"user_settings_outbox", "user_settings_idempotency")
+
+		return NewUserStore(db, userStoreOptions{Codec: cborCodec{}, Outbox: true}), 10 * time.Millisecond
+	})
+
+	testSettingStoreConformance(t, func(t *testing.T, c catalog) SettingStore {
+		truncate(t, "settings", "settings_values", "bundles", "bundles_values")
+		seedCatalog(t, db, c, func(q string) string { return q }, func(ts time.Time) interface{} { return ts })
+
+		return NewSettingStore(db)
+	})
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+	"time"
+)
+
+const envTestPgDSN = "TEST_PG_DSN"
+
+func TestPgStoreConformance(t *testing.T) {
+	dsn := os.Getenv(envTestPgDSN)
+	if dsn == "" {
+		t.Skip(envTestPgDSN, "not set")
+	}
+
+	db, err := sql.Open(backendPostgres, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	migrateTest(t, db, backendPostgres, schemaUsers)
+	migrateTest(t, db, backendPostgres, schemaSettings)
+
+	testUserStoreConformance(t, func(t *testing.T) (UserStore, time.Duration) {
+		execSQL(t, db, `TRUNCATE user_settings, user_settings_audit, user_settings_archive, user_settings_current, user_settings_outbox, user_settings_idempotency RESTART IDENTITY`)
+
+		return NewPgUserStore(db, userStoreOptions{Codec: cborCodec{}, Outbox: true}), 10 * time.Millisecond
+	})
+
+	testSettingStoreConformance(t, func(t *testing.T, c catalog) SettingStore {
+		execSQL(t, db, `TRUNCATE settings, settings_values, bundles, bundles_values RESTART IDENTITY`)
+		seedCatalog(t, db, c, rebind, func(ts time.Time) interface{} { return ts })
+
+		return NewPgSettingStore(db)
+	})
+}
+
+func execSQL(t *testing.T, db *sql.DB, query string) {
+	t.Helper()
+
+	if _, err := db.Exec(query); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"io"
 	"strconv"
 	"strings"
 	"time"
@@ -34,13 +37,18 @@ type SettingStore interface {
 	BundlesByID(ctx context.Context, bundles []int) ([]Bundle, error)
 	BundlesByTag(ctx context.Context, tag string) ([]Bundle, error)
 	BundlesByName(ctx context.Context, names []string) ([]Bundle, error)
+	// BundleValues returns setting values of every given bundle at given date, keyed by bundle id.
+	BundleValues(ctx context.Context, when time.Time, bundles []int) (map[int][]Setting, error)
+	// Digest returns catalog fingerprint, it changes with catalog content, and with bundle
+	// values activation or expiration (as seen at `when`).
+	Digest(ctx context.Context, when time.Time) (string, error)
 }
 
 type storeSetting struct {
-	db *sql.DB
+	db sqlDB
 }
 
-func NewSettingStore(db *sql.DB) SettingStore {
+func NewSettingStore(db sqlDB) SettingStore {
 	return &storeSetting{db: db}
 }
 
@@ -88,6 +96,62 @@ WHERE
 	return rv, rows.Err()
 }
 
+// queryBundleValues selects setting values of bundles at given date, `?`-placeholders are
+// date (twice) and bundles condition is appended by caller.
+const queryBundleValues = `
+SELECT
+	bv.bundle_id,
+	s.name,
+	v.value
+FROM
+	bundles_values bv
+JOIN
+	settings_values v ON v.id = bv.value_id
+JOIN
+	settings s ON s.id = v.setting_id
+WHERE
+	bv.created_at <= ?
+	AND
+	(bv.expired_at IS NULL OR bv.expired_at > ?)
+	AND
+	bv.bundle_id `
+
+// readBundleValues reads bundle id, setting name and value triples from rows, and closes them.
+func readBundleValues(rows *sql.Rows) (rv map[int][]Setting, err error) {
+	defer rows.Close()
+
+	rv = make(map[int][]Setting)
+
+	for rows.Next() {
+		var (
+			id int
+			s  Setting
+		)
+
+		if err = rows.Scan(&id, &s.Name, &s.Value); err != nil {
+			return nil, err
+		}
+
+		rv[id] = append(rv[id], s)
+	}
+
+	return rv, rows.Err()
+}
+
+// BundleValues returns setting values of bundles at given date, keyed by bundle id.
+func (ss *storeSetting) BundleValues(ctx context.Context, when time.Time, bundles []int) (map[int][]Setting, error) {
+	query := queryBundleValues + `IN (` + intArray(bundles) + `)
+ORDER BY
+	bv.bundle_id, s.id`
+
+	rows, err := ss.db.QueryContext(ctx, query, when, when)
+	if err != nil {
+		return nil, err
+	}
+
+	return readBundleValues(rows)
+}
+
 // SettingsList returns list of settings names.
 func (ss *storeSetting) SettingsList(ctx context.Context) ([]string, error) {
 	const query = `
@@ -212,6 +276,90 @@ ORDER BY id`
 // sql helpers
 
 // strArray takes string slice, returns string usable as SQL `IN` argument.
+// Digest returns catalog fingerprint at given date.
+func (ss *storeSetting) Digest(ctx context.Context, when time.Time) (string, error) {
+	return catalogDigest(ctx, ss.db, func(q string) string { return q }, when)
+}
+
+// catalogDigest hashes catalog content, along with bundle values, active at `when`,
+// `bind` adapts `?`-style placeholders for backend.
+func catalogDigest(ctx context.Context, db sqlDB, bind func(string) string, when interface{}) (string, error) {
+	queries := []struct {
+		query string
+		args  []interface{}
+	}{
+		{query: "SELECT id, name FROM settings ORDER BY id"},
+		{query: "SELECT id, setting_id, name, value FROM settings_values ORDER BY id"},
+		{query: "SELECT id, parent_id, tag, name FROM bundles ORDER BY id"},
+		{
+			query: `
+SELECT
+	id,
+	bundle_id,
+	value_id
+FROM
+	bundles_values
+WHERE
+	created_at <= ?
+	AND
+	(expired_at IS NULL OR expired_at > ?)
+ORDER BY id`,
+			args: []interface{}{when, when},
+		},
+	}
+
+	h := sha256.New()
+
+	for _, q := range queries {
+		rows, err := db.QueryContext(ctx, bind(q.query), q.args...)
+		if err != nil {
+			return "", err
+		}
+
+		if err = hashRows(h, rows); err != nil {
+			return "", err
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil)[:digestSize]), nil
+}
+
+// digestSize is a catalog digest length in bytes.
+const digestSize = 16
+
+// hashRows writes every row to `w`, and closes rows.
+func hashRows(w io.Writer, rows *sql.Rows) (err error) {
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+
+	row := make([]interface{}, len(cols))
+	ptrs := make([]interface{}, len(cols))
+
+	for i := range row {
+		ptrs[i] = &row[i]
+	}
+
+	for rows.Next() {
+		if err = rows.Scan(ptrs...); err != nil {
+			return err
+		}
+
+		if _, err = io.WriteString(w, rowKey(row)+"\n"); err != nil {
+			return err
+		}
+	}
+
+	if _, err = io.WriteString(w, "--\n"); err != nil {
+		return err
+	}
+
+	return rows.Err()
+}
+
 func strArray(a []string) string {
 	var s string
 
@@ -258,6 +406,23 @@ func readStrings(rows *sql.Rows) (rv []string, err error) {
 	return rv, rows.Err()
 }
 
+// readInts reads int slice from rows, and closes them.
+func readInts(rows *sql.Rows) (rv []int, err error) {
+	defer rows.Close()
+
+	var val int
+
+	for rows.Next() {
+		if err = rows.Scan(&val); err != nil {
+			return nil, err
+		}
+
+		rv = append(rv, val)
+	}
+
+	return rv, rows.Err()
+}
+
 // readBundles reads Bundle slice from rows, and closes them.
 func readBundles(rows *sql.Rows) (bundles []Bundle, err error) {
 	defer rows.Close()
@@ -272,6 +437,8 @@ func readBundles(rows *sql.Rows) (bundles []Bundle, err error) {
 			return
 		}
 
+		b.Tag = ""
+
 		if ns.Valid {
 			b.Tag = ns.String
 		}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+type storePgSetting struct {
+	db sqlDB
+}
+
+// NewPgSettingStore creates SettingStore, backed by PostgreSQL.
+func NewPgSettingStore(db sqlDB) SettingStore {
+	return &storePgSetting{db: db}
+}
+
+// Get returns list of setting values for given bundles at given date.
+func (ss *storePgSetting) Get(ctx context.Context, when time.Time, bundles []int) (rv []Setting, err error) {
+	const query = `
+SELECT
+	s.name,
+	v.value
+FROM
+	bundles b
+JOIN
+	bundles_values bv ON
+		bv.bundle_id = b.id
+		AND
+		bv.created_at <= $1
+		AND
+		(bv.expired_at IS NULL OR bv.expired_at > $1)
+JOIN
+	settings_values v ON v.id = bv.value_id
+JOIN
+	settings s ON s.id = v.setting_id
+WHERE
+	b.id = ANY($2)`
+
+	var (
+		rows      *sql.Rows
+		name, val string
+	)
+
+	if rows, err = ss.db.QueryContext(ctx, query, when, intParam(bundles)); err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		if err = rows.Scan(&name, &val); err != nil {
+			return
+		}
+
+		rv = append(rv, Setting{Name: name, Value: val})
+	}
+
+	return rv, rows.Err()
+}
+
+// BundleValues returns setting values of bundles at given date, keyed by bundle id.
+func (ss *storePgSetting) BundleValues(ctx context.Context, when time.Time, bundles []int) (map[int][]Setting, error) {
+	query := rebind(queryBundleValues + `= ANY(?)
+ORDER BY
+	bv.bundle_id, s.id`)
+
+	rows, err := ss.db.QueryContext(ctx, query, when, when, intParam(bundles))
+	if err != nil {
+		return nil, err
+	}
+
+	return readBundleValues(rows)
+}
+
+// SettingsList returns list of settings names.
+func (ss *storePgSetting) SettingsList(ctx context.Context) ([]string, error) {
+	const query = `
+SELECT
+	name
+FROM
+	settings
+ORDER BY id`
+
+	rows, err := ss.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return readStrings(rows)
+}
+
+// TagsList returns list of unique non-empty tags.
+func (ss *storePgSetting) TagsList(ctx context.Context) ([]string, error) {
+	const query = `
+SELECT DISTINCT
+	tag
+FROM
+	bundles
+WHERE
+	tag IS NOT NULL`
+
+	rows, err := ss.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return readStrings(rows)
+}
+
+// BundlesList returns list of bundles.
+func (ss *storePgSetting) BundlesList(ctx context.Context) ([]Bundle, error) {
+	const query = `
+SELECT
+	id,
+	parent_id,
+	name,
+	tag
+FROM
+	bundles
+ORDER BY id`
+
+	rows, err := ss.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return readBundles(rows)
+}
+
+// BundlesByTag returns list of bundles by tag.
+func (ss *storePgSetting) BundlesByTag(ctx context.Context, tag string) ([]Bundle, error) {
+	const query = `
+SELECT
+	id,
+	parent_id,
+	name,
+	tag
+FROM
+	bundles
+WHERE
+	tag = $1
+ORDER BY id`
+
+	rows, err := ss.db.QueryContext(ctx, query, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	return readBundles(rows)
+}
+
+// BundlesByID returns list of bundles by id.
+func (ss *storePgSetting) BundlesByID(ctx context.Context, bundles []int) ([]Bundle, error) {
+	const query = `
+SELECT
+	id,
+	parent_id,
+	name,
+	tag
+FROM
+	bundles
+WHERE
+	id = ANY($1)
+ORDER BY id`
+
+	rows, err := ss.db.QueryContext(ctx, query, intParam(bundles))
+	if err != nil {
+		return nil, err
+	}
+
+	return readBundles(rows)
+}
+
+// BundlesByName returns list of bundles by names.
+func (ss *storePgSetting) BundlesByName(ctx context.Context, names []string) ([]Bundle, error) {
+	const query = `
+SELECT
+	id,
+	parent_id,
+	name,
+	tag
+FROM
+	bundles
+WHERE
+	name = ANY($1)
+ORDER BY id`
+
+	rows, err := ss.db.QueryContext(ctx, query, pq.StringArray(names))
+	if err != nil {
+		return nil, err
+	}
+
+	return readBundles(rows)
+}
+
+// intParam takes int slice, returns value usable as postgres array parameter.
+// Digest returns catalog fingerprint at given date.
+func (ss *storePgSetting) Digest(ctx context.Context, when time.Time) (string, error) {
+	return catalogDigest(ctx, ss.db, rebind, when)
+}
+
+func intParam(a []int) interface{} {
+	rv := make(pq.Int64Array, len(a))
+
+	for i, v := range a {
+		rv[i] = int64(v)
+	}
+
+	return rv
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// sharding strategies.
+const (
+	shardingHash   = "hash"
+	shardingModulo = "modulo"
+)
+
+// ringReplicas is a number of virtual nodes per shard, on consistent hashing ring.
+const ringReplicas = 128
+
+// shardMap maps user ids to shard indexes.
+type shardMap interface {
+	Shard(userID int) int
+}
+
+// moduloMap places user to shard `userID mod N`, it is simple, but changing
+// shards count moves almost every user.
+type moduloMap int
+
+func (m moduloMap) Shard(userID int) int {
+	n := int(m)
+
+	return ((userID % n) + n) % n
+}
+
+// hashRing places user to shard by consistent hashing over shard names, adding or removing
+// shard moves only users of that shard.
+type hashRing struct {
+	points []uint64
+	shards []int
+}
+
+func newHashRing(names []string) *hashRing {
+	r := &hashRing{}
+
+	type point struct {
+		hash  uint64
+		shard int
+	}
+
+	pts := make([]point, 0, len(names)*ringReplicas)
+
+	for i, name := range names {
+		for v := 0; v < ringReplicas; v++ {
+			pts = append(pts, point{hash: hash64(name + "#" + strconv.Itoa(v)), shard: i})
+		}
+	}
+
+	sort.Slice(pts, func(i, j int) bool { return pts[i].hash < pts[j].hash })
+
+	for _, p := range pts {
+		r.points = append(r.points, p.hash)
+		r.shards = append(r.shards, p.shard)
+	}
+
+	return r
+}
+
+func (r *hashRing) Shard(userID int) int {
+	h := hash64(strconv.Itoa(userID))
+
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+
+	return r.shards[i]
+}
+
+func hash64(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+
+	// fnv has weak avalanche on short, similar keys, finalize it (splitmix64).
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+
+	return x
+}
+
+// newShardMap creates shard map of given strategy over named shards.
+func newShardMap(strategy string, names []string) shardMap {
+	if strategy == shardingModulo {
+		return moduloMap(len(names))
+	}
+
+	return newHashRing(names)
+}
+
+// shardedUser routes UserStore calls to shards by user id.
+type shardedUser struct {
+	m      shardMap
+	shards []UserStore
+}
+
+// NewShardedUserStore creates UserStore, that spreads users among `shards` by `m`.
+func NewShardedUserStore(m shardMap, shards []UserStore) UserStore {
+	return &shardedUser{m: m, shards: shards}
+}
+
+func (su *shardedUser) shard(userID int) UserStore {
+	return su.shards[su.m.Shard(userID)]
+}
+
+// Get returns UserSettings for given user and time.
+func (su *shardedUser) Get(ctx context.Context, userID int, when time.Time) (UserSettings, error) {
+	return su.shard(userID).Get(ctx, userID, when)
+}
+
+// GetMany returns UserSettings for given users and time, shards are queried concurrently.
+func (su *shardedUser) GetMany(ctx context.Context, userIDs []int, when time.Time) (map[int]UserSettings, error) {
+	byShard := make(map[int][]int)
+
+	for _, uid := range userIDs {
+		i := su.m.Shard(uid)
+		byShard[i] = append(byShard[i], uid)
+	}
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		first error
+		rv    = make(map[int]UserSettings, len(userIDs))
+	)
+
+	for i, ids := range byShard {
+		wg.Add(1)
+
+		go func(us UserStore, ids []int) {
+			defer wg.Done()
+
+			res, err := us.GetMany(ctx, ids, when)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if err != nil {
+				if first == nil {
+					first = err
+				}
+
+				return
+			}
+
+			for uid, s := range res {
+				rv[uid] = s
+			}
+		}(su.shards[i], ids)
+	}
+
+	wg.Wait()
+
+	if first != nil {
+		return nil, first
+	}
+
+	return rv, nil
+}
+
+// Set sets new settings for user, recording change to audit trail.
+func (su *shardedUser) Set(ctx context.Context, userID int, s UserSettings, ch Change) error {
+	return su.shard(userID).Set(ctx, userID, s, ch)
+}
+
+// Scheduled returns scheduled revisions of user from its shard.
+func (su *shardedUser) Scheduled(ctx context.Context, userID int, after time.Time) ([]ScheduledChange, error) {
+	return su.shard(userID).Scheduled(ctx, userID, after)
+}
+
+// Cancel removes scheduled revisions of user on its shard.
+func (su *shardedUser) Cancel(ctx context.Context, userID int, ids []int, ch Change) (int, error) {
+	return su.shard(userID).Cancel(ctx, userID, ids, ch)
+}
+
+// Audit returns recorded changes, matching given filter, newest first, without user
+// in filter all shards are queried (record ids are unique only inside shard).
+func (su *shardedUser) Audit(ctx context.Context, f AuditFilter) (rv []AuditRecord, err error) {
+	if f.UserID != 0 {
+		return su.shard(f.UserID).Audit(ctx, f)
+	}
+
+	for _, us := range su.shards {
+		res, err := us.Audit(ctx, f)
+		if err != nil {
+			return nil, err
+		}
+
+		rv = append(rv, res...)
+	}
+
+	sort.SliceStable(rv, func(i, j int) bool { return rv[i].CreatedAt.After(rv[j].CreatedAt) })
+
+	if limit := auditLimit(f.Limit); len(rv) > limit {
+		rv = rv[:limit]
+	}
+
+	return rv, nil
+}
+
+// Compact archives superseded revisions on every shard.
+func (su *shardedUser) Compact(ctx context.Context, cutoff time.Time) (st CompactStats, err error) {
+	for _, us := range su.shards {
+		res, err := us.Compact(ctx, cutoff)
+		if err != nil {
+			return st, err
+		}
+
+		st.Users += res.Users
+		st.Archived += res.Archived
+	}
+
+	return st, nil
+}
+
+// getEach implements UserStore.GetMany with Get call for every user.
+func getEach(
+	ctx context.Context,
+	get func(context.Context, int, time.Time) (UserSettings, error),
+	userIDs []int,
+	when time.Time,
+) (map[int]UserSettings, error) {
+	rv := make(map[int]UserSettings, len(userIDs))
+
+	for _, uid := range userIDs {
+		if _, ok := rv[uid]; ok {
+			continue
+		}
+
+		s, err := get(ctx, uid, when)
+		if err != nil {
+			return nil, err
+		}
+
+		rv[uid] = s
+	}
+
+	return rv, nil
+}
+
+// Outboxes returns change events outboxes of all shards.
+func (su *shardedUser) Outboxes() (rv []Outbox) {
+	for _, us := range su.shards {
+		rv = append(rv, outboxesOf(us)...)
+	}
+
+	return rv
+}
+
+// idem returns IdempotencyStore of user shard.
+func (su *shardedUser) idem(userID int) (IdempotencyStore, error) {
+	if is := idempotencyOf(su.shard(userID)); is != nil {
+		return is, nil
+	}
+
+	return nil, errors.New("shard keeps no idempotency keys")
+}
+
+// Claim reserves key for request with given hash on shard of user.
+func (su *shardedUser) Claim(ctx context.Context, userID int, key, hash string, since time.Time) (*IdempotencyRecord, error) {
+	is, err := su.idem(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return is.Claim(ctx, userID, key, hash, since)
+}
+
+// Complete stores outcome of request on shard of user.
+func (su *shardedUser) Complete(ctx context.Context, userID int, key string, status int, body []byte) error {
+	is, err := su.idem(userID)
+	if err != nil {
+		return err
+	}
+
+	return is.Complete(ctx, userID, key, status, body)
+}
+
+// Release drops claim of failed request on shard of user.
+func (su *shardedUser) Release(ctx context.Context, userID int, key string) error {
+	is, err := su.idem(userID)
+	if err != nil {
+		return err
+	}
+
+	return is.Release(ctx, userID, key)
+}
+
+// Purge removes records, created before `cutoff`, from all shards.
+func (su *shardedUser) Purge(ctx context.Context, cutoff time.Time) (n int, err error) {
+	for _, us := range su.shards {
+		is := idempotencyOf(us)
+		if is == nil {
+			continue
+		}
+
+		c, err := is.Purge(ctx, cutoff)
+		if err != nil {
+			return n, err
+		}
+
+		n += c
+	}
+
+	return n, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestModuloMap(t *testing.T) {
+	m := newShardMap(shardingModulo, []string{"a", "b", "c"})
+
+	for _, c := range []struct {
+		user, want int
+	}{
+		{0, 0}, {1, 1}, {5, 2}, {9, 0}, {-1, 2},
+	} {
+		if got := m.Shard(c.user); got != c.want {
+			t.Fatalf("user %d: want %d got %d", c.user, c.want, got)
+		}
+	}
+}
+
+func TestHashRing(t *testing.T) {
+	const users = 20000
+
+	names := []string{"a", "b", "c", "d"}
+	ring := newShardMap(shardingHash, names)
+	counts := make([]int, len(names))
+
+	for uid := 1; uid <= users; uid++ {
+		counts[ring.Shard(uid)]++
+	}
+
+	for i, n := range counts {
+		if n < users/len(names)/2 || n > users/len(names)*3/2 {
+			t.Fatal("step 1 fail: uneven distribution", i, counts)
+		}
+	}
+
+	grown := newShardMap(shardingHash, append(names, "e"))
+	moved := 0
+
+	for uid := 1; uid <= users; uid++ {
+		was, now := ring.Shard(uid), grown.Shard(uid)
+		if was == now {
+			continue
+		}
+
+		if now != len(names) {
+			t.Fatal("step 2 fail: user moved between old shards", uid, was, now)
+		}
+
+		moved++
+	}
+
+	if moved == 0 || moved > users*2/5 {
+		t.Fatal("step 3 fail: moved", moved, "of", users)
+	}
+
+	// order of shards in config does not matter, only names do.
+	shuffled := newShardMap(shardingHash, []string{"d", "c", "b", "a"})
+
+	for uid := 1; uid <= 100; uid++ {
+		if names[ring.Shard(uid)] != []string{"d", "c", "b", "a"}[shuffled.Shard(uid)] {
+			t.Fatal("step 4 fail: placement depends on shards order", uid)
+		}
+	}
+}
+
+func TestShardedStoreConformance(t *testing.T) {
+	for _, strategy := range []string{shardingHash, shardingModulo} {
+		t.Run(strategy, func(t *testing.T) {
+			testUserStoreConformance(t, func(*testing.T) (UserStore, time.Duration) {
+				names := []string{"a", "b", "c"}
+				stores := []UserStore{NewMemoryUserStore(userStoreOptions{}), NewMemoryUserStore(userStoreOptions{}), NewMemoryUserStore(userStoreOptions{})}
+
+				return NewShardedUserStore(newShardMap(strategy, names), stores), time.Millisecond
+			})
+		})
+	}
+}
+
+func TestShardedStoreRouting(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		m      = moduloMap(2)
+		stores = []UserStore{NewMemoryUserStore(userStoreOptions{}), NewMemoryUserStore(userStoreOptions{})}
+		us     = NewShardedUserStore(m, stores)
+	)
+
+	for uid := 1; uid <= 4; uid++ {
+		if err := us.Set(ctx, uid, UserSettings{Bundles: []int{uid}}, Change{Action: "set-bundles"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for uid := 1; uid <= 4; uid++ {
+		own, other := stores[uid%2], stores[(uid+1)%2]
+
+		if s, err := own.Get(ctx, uid, time.Now()); err != nil || !sameInts(s.Bundles, []int{uid}) {
+			t.Fatal("step 1 fail: user not on its shard", uid, s, err)
+		}
+
+		if s, err := other.Get(ctx, uid, time.Now()); err != nil || len(s.Bundles) != 0 {
+			t.Fatal("step 2 fail: user on foreign shard", uid, s, err)
+		}
+	}
+
+	rv, err := us.Audit(ctx, AuditFilter{Limit: 3})
+	if err != nil || len(rv) != 3 {
+		t.Fatal("step 3 fail:", rv, err)
+	}
+
+	for i := 1; i < len(rv); i++ {
+		if rv[i].CreatedAt.After(rv[i-1].CreatedAt) {
+			t.Fatal("step 4 fail: merged audit is not ordered", rv)
+		}
+	}
+}
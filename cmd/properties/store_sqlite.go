@@ -0,0 +1,600 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const (
+	sqlitePrefix   = backendSQLite + ":"
+	sqlitePragmas  = "_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=foreign_keys(1)"
+	sqliteDriverDB = "file:"
+)
+
+// sqliteDSN converts `sqlite:path[?params]` dsn to driver one, adding default pragmas,
+// if none given.
+func sqliteDSN(dsn string) string {
+	path := strings.TrimPrefix(dsn, sqlitePrefix)
+
+	if !strings.Contains(path, "?") {
+		path += "?" + sqlitePragmas
+	}
+
+	return sqliteDriverDB + path
+}
+
+// sqliteTime converts time to sqlite column value.
+func sqliteTime(t time.Time) int64 {
+	return t.UnixMicro()
+}
+
+// sqliteNullTime converts optional time to sqlite column value.
+func sqliteNullTime(t *time.Time) sql.NullInt64 {
+	if t == nil {
+		return sql.NullInt64{}
+	}
+
+	return sql.NullInt64{Int64: sqliteTime(*t), Valid: true}
+}
+
+type storeSQLiteUser struct {
+	*sqlIdempotency
+	db     *sql.DB
+	codec  payloadCodec
+	outbox *sqlOutbox
+	now    func() time.Time
+}
+
+// NewSQLiteUserStore creates UserStore, backed by SQLite.
+func NewSQLiteUserStore(db *sql.DB, opts userStoreOptions) UserStore {
+	su := &storeSQLiteUser{db: db, codec: opts.Codec, now: time.Now}
+	su.sqlIdempotency = &sqlIdempotency{
+		db:     db,
+		bind:   func(q string) string { return q },
+		arg:    func(t time.Time) interface{} { return sqliteTime(t) },
+		insert: `INSERT` + queryIdempotencyInsert + ` ON CONFLICT DO NOTHING`,
+	}
+
+	if opts.Outbox {
+		su.outbox = &sqlOutbox{db: db, bind: func(q string) string { return q }}
+	}
+
+	return su
+}
+
+// Get returns UserSettings for given user and time.
+func (su *storeSQLiteUser) Get(ctx context.Context, userID int, when time.Time) (s UserSettings, err error) {
+	var (
+		buf []byte
+		ts  int64
+		exp sql.NullInt64
+	)
+
+	err = su.db.QueryRowContext(ctx, queryCurrent, userID).Scan(&buf, &ts, &exp)
+	switch {
+	case err == sql.ErrNoRows: // not projected yet
+	case err != nil:
+		return
+	default:
+		r := revisionSpan{CreatedAt: time.UnixMicro(ts)}
+
+		if exp.Valid {
+			t := time.UnixMicro(exp.Int64)
+			r.ExpiresAt = &t
+		}
+
+		if s, ok, err := fromCurrent(buf, &r, when); ok {
+			return s, err
+		}
+	}
+
+	return su.history(ctx, userID, when)
+}
+
+// history returns UserSettings for given user and time from revisions history.
+func (su *storeSQLiteUser) history(ctx context.Context, userID int, when time.Time) (s UserSettings, err error) {
+	const query = `
+SELECT
+	settings,
+	expires_at
+FROM
+	user_settings
+WHERE
+	user_id = ?1
+	AND
+	created_at <= ?2
+	AND
+	(expires_at IS NULL OR expires_at > ?2)
+ORDER BY
+	created_at DESC, id DESC
+LIMIT 1`
+
+	var (
+		buf []byte
+		exp sql.NullInt64
+	)
+
+	err = su.db.QueryRowContext(ctx, query, userID, sqliteTime(when)).Scan(&buf, &exp)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = nil // its OK to return empty, if none found.
+		}
+
+		return
+	}
+
+	if exp.Valid {
+		t := time.UnixMicro(exp.Int64)
+		s.Expire = &t
+	}
+
+	s.Bundles, err = decodePayload(buf)
+
+	return s, err
+}
+
+// GetMany returns UserSettings for given users and time.
+func (su *storeSQLiteUser) GetMany(ctx context.Context, userIDs []int, when time.Time) (map[int]UserSettings, error) {
+	return getEach(ctx, su.Get, userIDs, when)
+}
+
+// Set sets new settings for user, recording change to audit trail.
+func (su *storeSQLiteUser) Set(ctx context.Context, userID int, s UserSettings, ch Change) (err error) {
+	const querySet = `
+INSERT INTO user_settings
+	(user_id, settings, created_at, expires_at, origin)
+VALUES
+	(?, ?, ?, ?, ?)`
+
+	buf, err := encodePayload(su.codec, s.Bundles)
+	if err != nil {
+		return
+	}
+
+	slog.DebugContext(ctx, "user-settings encoded", "user_id", userID, "codec", su.codec.Name(), "size", len(buf))
+
+	tx, err := su.db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	now := su.now()
+
+	start := now
+	if ch.Start != nil {
+		start = *ch.Start
+	}
+
+	res, err := tx.ExecContext(ctx, querySet, userID, buf, sqliteTime(start), sqliteNullTime(s.Expire), ch.Origin)
+	if err != nil {
+		return
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return
+	}
+
+	if _, err = tx.ExecContext(ctx, queryCurrentUpsert, id); err != nil {
+		return
+	}
+
+	if err = su.record(ctx, tx, userID, &s, &ch, now); err != nil {
+		return
+	}
+
+	return tx.Commit()
+}
+
+// record writes audit record, request outcome and change event within transaction of change.
+func (su *storeSQLiteUser) record(ctx context.Context, tx *sql.Tx, userID int, s *UserSettings, ch *Change, now time.Time) error {
+	const queryAudit = `
+INSERT INTO user_settings_audit
+	(user_id, action, items, tag, actor, caller, on_behalf_of, reason, created_at)
+VALUES
+	(?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	items, err := json.Marshal(ch.Items)
+	if err != nil {
+		return err
+	}
+
+	if _, err = tx.ExecContext(ctx, queryAudit, userID, ch.Action, string(items),
+		nullString(ch.Tag), ch.Actor, ch.Caller, ch.OnBehalfOf, ch.Reason, sqliteTime(now)); err != nil {
+		return err
+	}
+
+	if err = su.markChanged(ctx, tx); err != nil {
+		return err
+	}
+
+	if su.outbox != nil {
+		return su.outbox.record(ctx, tx, userID, s, ch, now)
+	}
+
+	return nil
+}
+
+// Scheduled returns revisions of user, taking effect after `after`, soonest first.
+func (su *storeSQLiteUser) Scheduled(ctx context.Context, userID int, after time.Time) ([]ScheduledChange, error) {
+	rows, err := su.db.QueryContext(ctx, queryScheduled, userID, sqliteTime(after))
+	if err != nil {
+		return nil, err
+	}
+
+	return readScheduled(rows, userID, func(rows *sql.Rows, sc *ScheduledChange) (buf []byte, err error) {
+		var (
+			ts  int64
+			exp sql.NullInt64
+		)
+
+		if err = rows.Scan(&sc.ID, &buf, &ts, &exp, &sc.Origin); err != nil {
+			return
+		}
+
+		sc.Start = time.UnixMicro(ts)
+
+		if exp.Valid {
+			t := time.UnixMicro(exp.Int64)
+			sc.Expire = &t
+		}
+
+		return buf, nil
+	})
+}
+
+// Cancel removes scheduled revisions of user by ids, recording change to audit trail.
+func (su *storeSQLiteUser) Cancel(ctx context.Context, userID int, ids []int, ch Change) (n int, err error) {
+	tx, err := su.db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if err != nil || n == 0 {
+			_ = tx.Rollback()
+		}
+	}()
+
+	now := su.now()
+
+	res, err := tx.ExecContext(ctx, queryCancelScheduled(ids), userID, sqliteTime(now))
+	if err != nil {
+		return
+	}
+
+	if n, err = rowsAffected(res); err != nil || n == 0 {
+		return
+	}
+
+	if err = refreshCurrent(ctx, tx, func(q string) string { return q }, queryCurrentUpsert, userID); err != nil {
+		return
+	}
+
+	if err = su.record(ctx, tx, userID, &UserSettings{}, &ch, now); err != nil {
+		return
+	}
+
+	return n, tx.Commit()
+}
+
+// Outboxes returns change events outbox, if recording is enabled.
+func (su *storeSQLiteUser) Outboxes() []Outbox {
+	if su.outbox == nil {
+		return nil
+	}
+
+	return []Outbox{su.outbox}
+}
+
+// Audit returns recorded changes, matching given filter, newest first.
+func (su *storeSQLiteUser) Audit(ctx context.Context, f AuditFilter) (rv []AuditRecord, err error) {
+	query, args := auditQuery(&f)
+
+	for i, a := range args {
+		if t, ok := a.(time.Time); ok {
+			args[i] = sqliteTime(t)
+		}
+	}
+
+	rows, err := su.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			r     AuditRecord
+			items string
+			tag   sql.NullString
+			ts    int64
+		)
+
+		if err = rows.Scan(&r.ID, &r.UserID, &r.Action, &items, &tag,
+			&r.Actor, &r.Caller, &r.OnBehalfOf, &r.Reason, &ts); err != nil {
+			return nil, err
+		}
+
+		if err = json.Unmarshal([]byte(items), &r.Items); err != nil {
+			return nil, err
+		}
+
+		r.Tag = tag.String
+		r.CreatedAt = time.UnixMicro(ts)
+
+		rv = append(rv, r)
+	}
+
+	return rv, rows.Err()
+}
+
+// Compact archives superseded revisions, created before `cutoff`.
+func (su *storeSQLiteUser) Compact(ctx context.Context, cutoff time.Time) (CompactStats, error) {
+	c := sqlCompactor{
+		db:   su.db,
+		bind: func(q string) string { return q },
+		arg:  func(t time.Time) interface{} { return sqliteTime(t) },
+		scan: func(rows *sql.Rows) (id int, r revisionSpan, err error) {
+			var (
+				ts  int64
+				exp sql.NullInt64
+			)
+
+			if err = rows.Scan(&id, &ts, &exp); err != nil {
+				return
+			}
+
+			r.CreatedAt = time.UnixMicro(ts)
+
+			if exp.Valid {
+				t := time.UnixMicro(exp.Int64)
+				r.ExpiresAt = &t
+			}
+
+			return id, r, nil
+		},
+	}
+
+	return c.Run(ctx, cutoff)
+}
+
+type storeSQLiteSetting struct {
+	db *sql.DB
+}
+
+// NewSQLiteSettingStore creates SettingStore, backed by SQLite.
+func NewSQLiteSettingStore(db *sql.DB) SettingStore {
+	return &storeSQLiteSetting{db: db}
+}
+
+// Get returns list of setting values for given bundles at given date.
+func (ss *storeSQLiteSetting) Get(ctx context.Context, when time.Time, bundles []int) (rv []Setting, err error) {
+	const query = `
+SELECT
+	s.name,
+	v.value
+FROM
+	bundles b
+JOIN
+	bundles_values bv ON
+		bv.bundle_id = b.id
+		AND
+		bv.created_at <= ?1
+		AND
+		(bv.expired_at IS NULL OR bv.expired_at > ?1)
+JOIN
+	settings_values v ON v.id = bv.value_id
+JOIN
+	settings s ON s.id = v.setting_id
+WHERE
+	b.id IN (SELECT value FROM json_each(?2))`
+
+	var (
+		rows      *sql.Rows
+		name, val string
+		ids       []byte
+	)
+
+	if ids, err = jsonParam(bundles); err != nil {
+		return
+	}
+
+	if rows, err = ss.db.QueryContext(ctx, query, sqliteTime(when), string(ids)); err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		if err = rows.Scan(&name, &val); err != nil {
+			return
+		}
+
+		rv = append(rv, Setting{Name: name, Value: val})
+	}
+
+	return rv, rows.Err()
+}
+
+// BundleValues returns setting values of bundles at given date, keyed by bundle id.
+func (ss *storeSQLiteSetting) BundleValues(ctx context.Context, when time.Time, bundles []int) (map[int][]Setting, error) {
+	query := queryBundleValues + `IN (SELECT value FROM json_each(?))
+ORDER BY
+	bv.bundle_id, s.id`
+
+	ids, err := jsonParam(bundles)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := ss.db.QueryContext(ctx, query, sqliteTime(when), sqliteTime(when), string(ids))
+	if err != nil {
+		return nil, err
+	}
+
+	return readBundleValues(rows)
+}
+
+// SettingsList returns list of settings names.
+func (ss *storeSQLiteSetting) SettingsList(ctx context.Context) ([]string, error) {
+	const query = `
+SELECT
+	name
+FROM
+	settings
+ORDER BY id`
+
+	rows, err := ss.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return readStrings(rows)
+}
+
+// TagsList returns list of unique non-empty tags.
+func (ss *storeSQLiteSetting) TagsList(ctx context.Context) ([]string, error) {
+	const query = `
+SELECT DISTINCT
+	tag
+FROM
+	bundles
+WHERE
+	tag IS NOT NULL`
+
+	rows, err := ss.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return readStrings(rows)
+}
+
+// BundlesList returns list of bundles.
+func (ss *storeSQLiteSetting) BundlesList(ctx context.Context) ([]Bundle, error) {
+	const query = `
+SELECT
+	id,
+	parent_id,
+	name,
+	tag
+FROM
+	bundles
+ORDER BY id`
+
+	rows, err := ss.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return readBundles(rows)
+}
+
+// BundlesByTag returns list of bundles by tag.
+func (ss *storeSQLiteSetting) BundlesByTag(ctx context.Context, tag string) ([]Bundle, error) {
+	const query = `
+SELECT
+	id,
+	parent_id,
+	name,
+	tag
+FROM
+	bundles
+WHERE
+	tag = ?
+ORDER BY id`
+
+	rows, err := ss.db.QueryContext(ctx, query, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	return readBundles(rows)
+}
+
+// BundlesByID returns list of bundles by id.
+func (ss *storeSQLiteSetting) BundlesByID(ctx context.Context, bundles []int) ([]Bundle, error) {
+	const query = `
+SELECT
+	id,
+	parent_id,
+	name,
+	tag
+FROM
+	bundles
+WHERE
+	id IN (SELECT value FROM json_each(?))
+ORDER BY id`
+
+	ids, err := jsonParam(bundles)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := ss.db.QueryContext(ctx, query, string(ids))
+	if err != nil {
+		return nil, err
+	}
+
+	return readBundles(rows)
+}
+
+// BundlesByName returns list of bundles by names.
+func (ss *storeSQLiteSetting) BundlesByName(ctx context.Context, names []string) ([]Bundle, error) {
+	const query = `
+SELECT
+	id,
+	parent_id,
+	name,
+	tag
+FROM
+	bundles
+WHERE
+	name IN (SELECT value FROM json_each(?))
+ORDER BY id`
+
+	buf, err := jsonParam(names)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := ss.db.QueryContext(ctx, query, string(buf))
+	if err != nil {
+		return nil, err
+	}
+
+	return readBundles(rows)
+}
+
+// jsonParam encodes slice as json array, usable with sqlite `json_each`, nil slice gives empty array.
+// Digest returns catalog fingerprint at given date.
+func (ss *storeSQLiteSetting) Digest(ctx context.Context, when time.Time) (string, error) {
+	return catalogDigest(ctx, ss.db, func(q string) string { return q }, sqliteTime(when))
+}
+
+func jsonParam(v interface{}) ([]byte, error) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	if string(buf) == "null" {
+		return []byte("[]"), nil
+	}
+
+	return buf, nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor"
+)
+
+// openTestSQLite opens fresh database, migrated to latest `schema` version (if any given).
+func openTestSQLite(t *testing.T, schema string) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open(backendSQLite, sqliteDSN(sqlitePrefix+filepath.Join(t.TempDir(), "test.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { db.Close() })
+
+	if schema != "" {
+		migrateTest(t, db, backendSQLite, schema)
+	}
+
+	return db
+}
+
+func migrateTest(t *testing.T, db *sql.DB, backend, schema string) {
+	t.Helper()
+
+	m, err := newMigrator(db, backend, schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = m.Up(context.Background(), m.Latest()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSQLiteStoreConformance(t *testing.T) {
+	for _, c := range codecs {
+		t.Run(c.Name(), func(t *testing.T) {
+			testUserStoreConformance(t, func(t *testing.T) (UserStore, time.Duration) {
+				return NewSQLiteUserStore(openTestSQLite(t, schemaUsers), userStoreOptions{Codec: c, Outbox: true}), time.Millisecond
+			})
+		})
+	}
+
+	testSettingStoreConformance(t, func(t *testing.T, c catalog) SettingStore {
+		db := openTestSQLite(t, schemaSettings)
+
+		seedCatalog(t, db, c, func(q string) string { return q }, func(ts time.Time) interface{} {
+			return sqliteTime(ts)
+		})
+
+		return NewSQLiteSettingStore(db)
+	})
+}
+
+func TestSQLiteBackfillCurrent(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "users.db")
+	env := map[string]string{
+		envDBUsers:    sqlitePrefix + path,
+		envDBSettings: backendMemory + ":",
+	}
+	getenv := func(k string) string { return env[k] }
+
+	var buf bytes.Buffer
+
+	if err := migrateCommand([]string{"-db", schemaUsers, "up"}, getenv, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open(backendSQLite, sqliteDSN(sqlitePrefix+path))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	// history, written before projection was introduced
+	now := time.Now()
+
+	for i, r := range []struct {
+		user    int
+		bundles []int
+		age     time.Duration
+	}{
+		{1, []int{1}, 2 * time.Hour},
+		{1, []int{2}, time.Hour},
+		{2, []int{3}, time.Hour},
+	} {
+		b, _ := cbor.Marshal(r.bundles, cbor.EncOptions{Canonical: true})
+
+		if _, err = db.Exec(`INSERT INTO user_settings (user_id, settings, created_at) VALUES (?, ?, ?)`,
+			r.user, b, sqliteTime(now.Add(-r.age))); err != nil {
+			t.Fatalf("step 1.%d fail: %v", i, err)
+		}
+	}
+
+	us := NewSQLiteUserStore(db, userStoreOptions{Codec: cborCodec{}})
+
+	if s, err := us.Get(ctx, 1, now); err != nil || !sameInts(s.Bundles, []int{2}) {
+		t.Fatal("step 2 fail: no fallback to history:", s, err)
+	}
+
+	if err = backfillCommand(nil, getenv, &buf); err != nil || !strings.Contains(buf.String(), "projected: 2") {
+		t.Fatal("step 3 fail:", buf.String(), err)
+	}
+
+	var n int
+
+	if err = db.QueryRow(`SELECT COUNT(*) FROM user_settings_current`).Scan(&n); err != nil || n != 2 {
+		t.Fatal("step 4 fail:", n, err)
+	}
+
+	// older revision does not override projected one
+	if _, err = db.Exec(queryCurrentUpsert, 1); err != nil {
+		t.Fatal("step 5 fail:", err)
+	}
+
+	if s, err := us.Get(ctx, 1, now); err != nil || !sameInts(s.Bundles, []int{2}) {
+		t.Fatal("step 6 fail:", s, err)
+	}
+
+	if s, err := us.Get(ctx, 1, now.Add(-90*time.Minute)); err != nil || !sameInts(s.Bundles, []int{1}) {
+		t.Fatal("step 7 fail: bad past state:", s, err)
+	}
+}
+
+func TestSQLiteSameInstantWrites(t *testing.T) {
+	var (
+		ctx = context.Background()
+		db  = openTestSQLite(t, schemaUsers)
+		now = time.Now()
+		us  = NewSQLiteUserStore(db, userStoreOptions{Codec: cborCodec{}}).(*storeSQLiteUser)
+	)
+
+	us.now = func() time.Time { return now }
+
+	for _, b := range []int{1, 2, 3} {
+		if err := us.Set(ctx, 1, UserSettings{Bundles: []int{b}}, Change{Action: "set-bundles"}); err != nil {
+			t.Fatal("step 1 fail:", b, err)
+		}
+	}
+
+	if s, err := us.Get(ctx, 1, now); err != nil || !sameInts(s.Bundles, []int{3}) {
+		t.Fatal("step 2 fail:", s, err)
+	}
+
+	// history orders revisions with equal timestamps by id.
+	if _, err := db.Exec(`DELETE FROM user_settings_current`); err != nil {
+		t.Fatal(err)
+	}
+
+	if s, err := us.Get(ctx, 1, now); err != nil || !sameInts(s.Bundles, []int{3}) {
+		t.Fatal("step 3 fail:", s, err)
+	}
+}
@@ -3,10 +3,11 @@ package main
 import (
 	"context"
 	"database/sql"
-	"log"
+	"encoding/json"
+	"log/slog"
+	"strconv"
+	"strings"
 	"time"
-
-	"github.com/fxamacker/cbor"
 )
 
 // UserSettings holds two arrays: bundle and settings ids, and time,
@@ -16,21 +17,122 @@ type UserSettings struct {
 	Expire  *time.Time `json:"expire,omitempty"`
 }
 
+// Change describes who, why and how changes user settings.
+type Change struct {
+	// Action is a name of api method, that made the change.
+	Action string
+	// Items holds tag or bundle names, that was (un-)set.
+	Items []string
+	// Tag is set for tag-related actions.
+	Tag string
+	// Actor is a trusted identity, the change is attributed to: authenticated caller,
+	// or client-supplied one, when authentication is disabled.
+	Actor string
+	// Caller is an authenticated identity (if any), that made the request.
+	Caller string
+	// OnBehalfOf is a client-supplied (untrusted) person or system, the change is made for.
+	OnBehalfOf string
+	// Reason is a free-form comment.
+	Reason string
+	// Start is a time, the change takes effect at, nil - immediately.
+	Start *time.Time
+	// Origin is recorded along with revision, it is set for revisions, made by service itself
+	// (see originExpire), empty - for requested ones.
+	Origin string
+}
+
+// AuditRecord holds single recorded change.
+type AuditRecord struct {
+	ID         int       `json:"id"`
+	UserID     int       `json:"user_id"`
+	Action     string    `json:"action"`
+	Items      []string  `json:"items"`
+	Tag        string    `json:"tag,omitempty"`
+	Actor      string    `json:"actor,omitempty"`
+	Caller     string    `json:"caller,omitempty"`
+	OnBehalfOf string    `json:"on_behalf_of,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// AuditFilter narrows audit query, zero-valued fields are ignored.
+type AuditFilter struct {
+	UserID int
+	Actor  string
+	Tag    string
+	From   time.Time
+	To     time.Time
+	Limit  int
+}
+
 type UserStore interface {
 	Get(ctx context.Context, userID int, when time.Time) (s UserSettings, err error)
-	Set(ctx context.Context, userID int, s UserSettings) error
+	// GetMany returns UserSettings for given users and time, keyed by user id.
+	GetMany(ctx context.Context, userIDs []int, when time.Time) (map[int]UserSettings, error)
+	Set(ctx context.Context, userID int, s UserSettings, ch Change) error
+	Audit(ctx context.Context, f AuditFilter) ([]AuditRecord, error)
+	// Compact archives revisions, created before `cutoff`, that can not affect Get results
+	// for any moment since `cutoff`.
+	Compact(ctx context.Context, cutoff time.Time) (CompactStats, error)
+	// Scheduled returns revisions of user, that take effect after `after`, soonest first.
+	Scheduled(ctx context.Context, userID int, after time.Time) ([]ScheduledChange, error)
+	// Cancel removes not yet effective revisions of user with given ids, it reports number
+	// of removed ones.
+	Cancel(ctx context.Context, userID int, ids []int, ch Change) (int, error)
 }
 
 type storeUser struct {
-	db *sql.DB
+	*sqlIdempotency
+	db     sqlDB
+	codec  payloadCodec
+	outbox *sqlOutbox
 }
 
-func NewUserStore(db *sql.DB) UserStore {
-	return &storeUser{db: db}
+// NewUserStore creates UserStore, backed by MySQL.
+func NewUserStore(db sqlDB, opts userStoreOptions) UserStore {
+	su := &storeUser{db: db, codec: opts.Codec}
+	su.sqlIdempotency = &sqlIdempotency{
+		db:     db,
+		bind:   func(q string) string { return q },
+		arg:    func(t time.Time) interface{} { return t },
+		insert: `INSERT IGNORE` + queryIdempotencyInsert,
+	}
+
+	if opts.Outbox {
+		su.outbox = &sqlOutbox{db: db, bind: func(q string) string { return q }}
+	}
+
+	return su
 }
 
 // Get returns UserSettings for given user and time.
 func (su *storeUser) Get(ctx context.Context, userID int, when time.Time) (s UserSettings, err error) {
+	var (
+		buf []byte
+		r   revisionSpan
+		exp sql.NullTime
+	)
+
+	err = queryRow(ctx, su.db, queryCurrent, []interface{}{userID}, &buf, &r.CreatedAt, &exp)
+	switch {
+	case err == sql.ErrNoRows: // not projected yet
+	case err != nil:
+		return
+	default:
+		if exp.Valid {
+			r.ExpiresAt = &exp.Time
+		}
+
+		if s, ok, err := fromCurrent(buf, &r, when); ok {
+			return s, err
+		}
+	}
+
+	return su.history(ctx, userID, when)
+}
+
+// history returns UserSettings for given user and time from revisions history.
+func (su *storeUser) history(ctx context.Context, userID int, when time.Time) (s UserSettings, err error) {
 	const query = `
 	SELECT
 		settings,
@@ -44,7 +146,7 @@ func (su *storeUser) Get(ctx context.Context, userID int, when time.Time) (s Use
 		AND
 		(expires_at IS NULL OR expires_at > ?)
 	ORDER BY
-		created_at DESC
+		created_at DESC, id DESC
 	LIMIT 1
 	`
 
@@ -53,7 +155,7 @@ func (su *storeUser) Get(ctx context.Context, userID int, when time.Time) (s Use
 		snt sql.NullTime
 	)
 
-	err = su.db.QueryRowContext(ctx, query, userID, when, when).Scan(&buf, &snt)
+	err = queryRow(ctx, su.db, query, []interface{}{userID, when, when}, &buf, &snt)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			err = nil // its OK to return empty, if none found.
@@ -66,29 +168,276 @@ func (su *storeUser) Get(ctx context.Context, userID int, when time.Time) (s Use
 		s.Expire = &snt.Time
 	}
 
-	err = cbor.Unmarshal(buf, &s.Bundles)
+	s.Bundles, err = decodePayload(buf)
 
 	return s, err
 }
 
-// Set sets new settings for user.
-func (su *storeUser) Set(ctx context.Context, userID int, s UserSettings) (err error) {
-	const query = `
+// GetMany returns UserSettings for given users and time.
+func (su *storeUser) GetMany(ctx context.Context, userIDs []int, when time.Time) (map[int]UserSettings, error) {
+	return getEach(ctx, su.Get, userIDs, when)
+}
+
+// revisionStart returns time, revision of change takes effect at. It is taken from application
+// clock (as reads compare revisions against it), truncated to microseconds, database keeps.
+func revisionStart(ch *Change) time.Time {
+	if ch.Start != nil {
+		return *ch.Start
+	}
+
+	return time.Now().Truncate(time.Microsecond)
+}
+
+// Set sets new settings for user, recording change to audit trail.
+func (su *storeUser) Set(ctx context.Context, userID int, s UserSettings, ch Change) (err error) {
+	const querySet = `
 INSERT INTO user_settings
-	(user_id, settings, expires_at)
+	(user_id, settings, created_at, expires_at, origin)
 VALUES
-	(?, ?, ?)`
+	(?, ?, ?, ?, ?)`
+
+	buf, err := encodePayload(su.codec, s.Bundles)
+	if err != nil {
+		return
+	}
+
+	slog.DebugContext(ctx, "user-settings encoded", "user_id", userID, "codec", su.codec.Name(), "size", len(buf))
+
+	tx, err := su.db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	res, err := tx.ExecContext(ctx, querySet, userID, buf, revisionStart(&ch), s.Expire, ch.Origin)
+	if err != nil {
+		return
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return
+	}
+
+	if _, err = tx.ExecContext(ctx, queryCurrentUpsertMySQL, id); err != nil {
+		return
+	}
+
+	if err = su.record(ctx, tx, userID, &s, &ch); err != nil {
+		return
+	}
+
+	return tx.Commit()
+}
+
+// record writes audit record, request outcome and change event within transaction of change.
+func (su *storeUser) record(ctx context.Context, tx *sql.Tx, userID int, s *UserSettings, ch *Change) error {
+	const queryAudit = `
+INSERT INTO user_settings_audit
+	(user_id, action, items, tag, actor, caller, on_behalf_of, reason)
+VALUES
+	(?, ?, ?, ?, ?, ?, ?, ?)`
+
+	items, err := json.Marshal(ch.Items)
+	if err != nil {
+		return err
+	}
+
+	if _, err = tx.ExecContext(ctx, queryAudit, userID, ch.Action, items,
+		nullString(ch.Tag), ch.Actor, ch.Caller, ch.OnBehalfOf, ch.Reason); err != nil {
+		return err
+	}
+
+	if err = su.markChanged(ctx, tx); err != nil {
+		return err
+	}
+
+	if su.outbox != nil {
+		return su.outbox.record(ctx, tx, userID, s, ch, time.Now())
+	}
+
+	return nil
+}
+
+// Scheduled returns revisions of user, taking effect after `after`, soonest first.
+func (su *storeUser) Scheduled(ctx context.Context, userID int, after time.Time) ([]ScheduledChange, error) {
+	rows, err := su.db.QueryContext(ctx, queryScheduled, userID, after)
+	if err != nil {
+		return nil, err
+	}
+
+	return readScheduled(rows, userID, scanScheduled)
+}
+
+// Cancel removes scheduled revisions of user by ids, recording change to audit trail.
+func (su *storeUser) Cancel(ctx context.Context, userID int, ids []int, ch Change) (n int, err error) {
+	tx, err := su.db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
 
-	var buf []byte
+	defer func() {
+		if err != nil || n == 0 {
+			_ = tx.Rollback()
+		}
+	}()
 
-	buf, err = cbor.Marshal(s.Bundles, cbor.EncOptions{Canonical: true})
+	res, err := tx.ExecContext(ctx, queryCancelScheduled(ids), userID, time.Now())
 	if err != nil {
 		return
 	}
 
-	log.Println("cbor size:", len(buf))
+	if n, err = rowsAffected(res); err != nil || n == 0 {
+		return
+	}
+
+	if err = refreshCurrent(ctx, tx, func(q string) string { return q }, queryCurrentUpsertMySQL, userID); err != nil {
+		return
+	}
+
+	if err = su.record(ctx, tx, userID, &UserSettings{}, &ch); err != nil {
+		return
+	}
+
+	return n, tx.Commit()
+}
+
+// Outboxes returns change events outbox, if recording is enabled.
+func (su *storeUser) Outboxes() []Outbox {
+	if su.outbox == nil {
+		return nil
+	}
+
+	return []Outbox{su.outbox}
+}
+
+// Audit returns recorded changes, matching given filter, newest first.
+func (su *storeUser) Audit(ctx context.Context, f AuditFilter) (rv []AuditRecord, err error) {
+	query, args := auditQuery(&f)
+
+	rows, err := su.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return readAudit(rows)
+}
+
+// Compact archives superseded revisions, created before `cutoff`.
+func (su *storeUser) Compact(ctx context.Context, cutoff time.Time) (CompactStats, error) {
+	c := sqlCompactor{
+		db:   su.db,
+		bind: func(q string) string { return q },
+		arg:  func(t time.Time) interface{} { return t },
+		scan: scanRevision,
+		lock: " FOR UPDATE",
+	}
+
+	return c.Run(ctx, cutoff)
+}
 
-	_, err = su.db.ExecContext(ctx, query, userID, buf, s.Expire)
+// readAudit reads AuditRecord slice from rows, and closes them.
+func readAudit(rows *sql.Rows) (rv []AuditRecord, err error) {
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			r     AuditRecord
+			items []byte
+			tag   sql.NullString
+		)
+
+		if err = rows.Scan(&r.ID, &r.UserID, &r.Action, &items, &tag,
+			&r.Actor, &r.Caller, &r.OnBehalfOf, &r.Reason, &r.CreatedAt); err != nil {
+			return nil, err
+		}
+
+		if err = json.Unmarshal(items, &r.Items); err != nil {
+			return nil, err
+		}
+
+		r.Tag = tag.String
+
+		rv = append(rv, r)
+	}
+
+	return rv, rows.Err()
+}
+
+// auditQuery builds sql query and its arguments for given filter.
+func auditQuery(f *AuditFilter) (query string, args []interface{}) {
+	const (
+		base = `
+SELECT
+	id,
+	user_id,
+	action,
+	items,
+	tag,
+	actor,
+	caller,
+	on_behalf_of,
+	reason,
+	created_at
+FROM
+	user_settings_audit`
+	)
+
+	var where []string
+
+	if f.UserID != 0 {
+		where = append(where, "user_id = ?")
+		args = append(args, f.UserID)
+	}
+
+	if f.Actor != "" {
+		where = append(where, "actor = ?")
+		args = append(args, f.Actor)
+	}
+
+	if f.Tag != "" {
+		where = append(where, "tag = ?")
+		args = append(args, f.Tag)
+	}
+
+	if !f.From.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, f.From)
+	}
+
+	if !f.To.IsZero() {
+		where = append(where, "created_at < ?")
+		args = append(args, f.To)
+	}
+
+	query = base
+
+	if len(where) > 0 {
+		query += "\nWHERE\n\t" + strings.Join(where, "\n\tAND\n\t")
+	}
+
+	query += "\nORDER BY id DESC\nLIMIT " + strconv.Itoa(auditLimit(f.Limit))
+
+	return query, args
+}
+
+// auditLimit returns effective audit query limit.
+func auditLimit(n int) int {
+	const defLimit = 100
+
+	if n <= 0 {
+		return defLimit
+	}
+
+	return n
+}
 
-	return
+// nullString maps empty string to sql NULL.
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
 }
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type storePgUser struct {
+	*sqlIdempotency
+	db     sqlDB
+	codec  payloadCodec
+	outbox *sqlOutbox
+}
+
+// NewPgUserStore creates UserStore, backed by PostgreSQL.
+func NewPgUserStore(db sqlDB, opts userStoreOptions) UserStore {
+	su := &storePgUser{db: db, codec: opts.Codec}
+	su.sqlIdempotency = &sqlIdempotency{
+		db:     db,
+		bind:   rebind,
+		arg:    func(t time.Time) interface{} { return t },
+		insert: `INSERT` + queryIdempotencyInsert + ` ON CONFLICT DO NOTHING`,
+	}
+
+	if opts.Outbox {
+		su.outbox = &sqlOutbox{db: db, bind: rebind}
+	}
+
+	return su
+}
+
+// Get returns UserSettings for given user and time.
+func (su *storePgUser) Get(ctx context.Context, userID int, when time.Time) (s UserSettings, err error) {
+	var (
+		buf []byte
+		r   revisionSpan
+		exp sql.NullTime
+	)
+
+	err = queryRow(ctx, su.db, rebind(queryCurrent), []interface{}{userID}, &buf, &r.CreatedAt, &exp)
+	switch {
+	case err == sql.ErrNoRows: // not projected yet
+	case err != nil:
+		return
+	default:
+		if exp.Valid {
+			r.ExpiresAt = &exp.Time
+		}
+
+		if s, ok, err := fromCurrent(buf, &r, when); ok {
+			return s, err
+		}
+	}
+
+	return su.history(ctx, userID, when)
+}
+
+// history returns UserSettings for given user and time from revisions history.
+func (su *storePgUser) history(ctx context.Context, userID int, when time.Time) (s UserSettings, err error) {
+	const query = `
+SELECT
+	settings,
+	expires_at
+FROM
+	user_settings
+WHERE
+	user_id = $1
+	AND
+	created_at <= $2
+	AND
+	(expires_at IS NULL OR expires_at > $2)
+ORDER BY
+	created_at DESC, id DESC
+LIMIT 1`
+
+	var (
+		buf []byte
+		snt sql.NullTime
+	)
+
+	err = queryRow(ctx, su.db, query, []interface{}{userID, when}, &buf, &snt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = nil // its OK to return empty, if none found.
+		}
+
+		return
+	}
+
+	if snt.Valid {
+		s.Expire = &snt.Time
+	}
+
+	s.Bundles, err = decodePayload(buf)
+
+	return s, err
+}
+
+// GetMany returns UserSettings for given users and time.
+func (su *storePgUser) GetMany(ctx context.Context, userIDs []int, when time.Time) (map[int]UserSettings, error) {
+	return getEach(ctx, su.Get, userIDs, when)
+}
+
+// Set sets new settings for user, recording change to audit trail.
+func (su *storePgUser) Set(ctx context.Context, userID int, s UserSettings, ch Change) (err error) {
+	const querySet = `
+INSERT INTO user_settings
+	(user_id, settings, created_at, expires_at, origin)
+VALUES
+	($1, $2, $3, $4, $5)
+RETURNING id`
+
+	buf, err := encodePayload(su.codec, s.Bundles)
+	if err != nil {
+		return
+	}
+
+	slog.DebugContext(ctx, "user-settings encoded", "user_id", userID, "codec", su.codec.Name(), "size", len(buf))
+
+	tx, err := su.db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	var id int
+
+	if err = tx.QueryRowContext(ctx, querySet, userID, buf, revisionStart(&ch), s.Expire, ch.Origin).Scan(&id); err != nil {
+		return
+	}
+
+	if _, err = tx.ExecContext(ctx, rebind(queryCurrentUpsert), id); err != nil {
+		return
+	}
+
+	if err = su.record(ctx, tx, userID, &s, &ch); err != nil {
+		return
+	}
+
+	return tx.Commit()
+}
+
+// record writes audit record, request outcome and change event within transaction of change.
+func (su *storePgUser) record(ctx context.Context, tx *sql.Tx, userID int, s *UserSettings, ch *Change) error {
+	const queryAudit = `
+INSERT INTO user_settings_audit
+	(user_id, action, items, tag, actor, caller, on_behalf_of, reason)
+VALUES
+	($1, $2, $3, $4, $5, $6, $7, $8)`
+
+	items, err := json.Marshal(ch.Items)
+	if err != nil {
+		return err
+	}
+
+	if _, err = tx.ExecContext(ctx, queryAudit, userID, ch.Action, string(items),
+		nullString(ch.Tag), ch.Actor, ch.Caller, ch.OnBehalfOf, ch.Reason); err != nil {
+		return err
+	}
+
+	if err = su.markChanged(ctx, tx); err != nil {
+		return err
+	}
+
+	if su.outbox != nil {
+		return su.outbox.record(ctx, tx, userID, s, ch, time.Now())
+	}
+
+	return nil
+}
+
+// Scheduled returns revisions of user, taking effect after `after`, soonest first.
+func (su *storePgUser) Scheduled(ctx context.Context, userID int, after time.Time) ([]ScheduledChange, error) {
+	rows, err := su.db.QueryContext(ctx, rebind(queryScheduled), userID, after)
+	if err != nil {
+		return nil, err
+	}
+
+	return readScheduled(rows, userID, scanScheduled)
+}
+
+// Cancel removes scheduled revisions of user by ids, recording change to audit trail.
+func (su *storePgUser) Cancel(ctx context.Context, userID int, ids []int, ch Change) (n int, err error) {
+	tx, err := su.db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if err != nil || n == 0 {
+			_ = tx.Rollback()
+		}
+	}()
+
+	res, err := tx.ExecContext(ctx, rebind(queryCancelScheduled(ids)), userID, time.Now())
+	if err != nil {
+		return
+	}
+
+	if n, err = rowsAffected(res); err != nil || n == 0 {
+		return
+	}
+
+	if err = refreshCurrent(ctx, tx, rebind, queryCurrentUpsert, userID); err != nil {
+		return
+	}
+
+	if err = su.record(ctx, tx, userID, &UserSettings{}, &ch); err != nil {
+		return
+	}
+
+	return n, tx.Commit()
+}
+
+// Outboxes returns change events outbox, if recording is enabled.
+func (su *storePgUser) Outboxes() []Outbox {
+	if su.outbox == nil {
+		return nil
+	}
+
+	return []Outbox{su.outbox}
+}
+
+// Audit returns recorded changes, matching given filter, newest first.
+func (su *storePgUser) Audit(ctx context.Context, f AuditFilter) (rv []AuditRecord, err error) {
+	query, args := auditQuery(&f)
+
+	rows, err := su.db.QueryContext(ctx, rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return readAudit(rows)
+}
+
+// Compact archives superseded revisions, created before `cutoff`.
+func (su *storePgUser) Compact(ctx context.Context, cutoff time.Time) (CompactStats, error) {
+	c := sqlCompactor{
+		db:   su.db,
+		bind: rebind,
+		arg:  func(t time.Time) interface{} { return t },
+		scan: scanRevision,
+		lock: " FOR UPDATE",
+	}
+
+	return c.Run(ctx, cutoff)
+}
+
+// rebind replaces `?` placeholders in query with postgres-style `$N` ones.
+func rebind(query string) string {
+	var (
+		sb strings.Builder
+		n  int
+	)
+
+	sb.Grow(len(query) + 8)
+
+	for _, r := range query {
+		if r != '?' {
+			sb.WriteRune(r)
+
+			continue
+		}
+
+		n++
+
+		sb.WriteByte('$')
+		sb.WriteString(strconv.Itoa(n))
+	}
+
+	return sb.String()
+}
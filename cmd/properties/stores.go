@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+)
+
+// store backends, each one is also a name of sql driver (if any).
+const (
+	backendMySQL    = "mysql"
+	backendPostgres = "postgres"
+	backendSQLite   = "sqlite"
+	backendMemory   = "memory"
+)
+
+// backendOf selects store backend by dsn scheme: `memory:`, `sqlite:`, `postgres://`
+// (or `postgresql://`), dsn without scheme is treated as mysql one.
+func backendOf(dsn string) string {
+	switch {
+	case strings.HasPrefix(dsn, backendMemory+":"):
+		return backendMemory
+	case strings.HasPrefix(dsn, sqlitePrefix):
+		return backendSQLite
+	case strings.HasPrefix(dsn, "postgres://"), strings.HasPrefix(dsn, "postgresql://"):
+		return backendPostgres
+	default:
+		return backendMySQL
+	}
+}
+
+func connectDB(driver string, cfg *dbConfig) (*sql.DB, error) {
+	dsn := cfg.DSN
+
+	if driver == backendSQLite {
+		dsn = sqliteDSN(dsn)
+	}
+
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.MaxIdleConns)
+	db.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+
+	return db, db.Ping()
+}
+
+// openDB connects to database, retrying as configured, returned function closes connection.
+func openDB(cfg *config, dbc *dbConfig, driver, name string) (db *sql.DB, closeFn func(), err error) {
+	conn := func() (err error) {
+		db, err = connectDB(driver, dbc)
+		return
+	}
+
+	if err = retry(cfg.Retry.Attempts, cfg.Retry.Delay, conn); err != nil {
+		return nil, nil, fmt.Errorf("%s connect fail: %w", name, err)
+	}
+
+	closeFn = func() {
+		if err := db.Close(); err != nil {
+			slog.Error(name+" close", "err", err)
+		}
+	}
+
+	return db, closeFn, nil
+}
+
+// openUserStore opens UserStore for configured backend (sharded one, if shards are configured),
+// returned function releases its resources.
+func openUserStore(cfg *config) (UserStore, func(), error) {
+	if len(cfg.DB.UserShards) == 0 {
+		return openUserDB(cfg, &cfg.DB.Users, "user-db")
+	}
+
+	var (
+		names   = make([]string, len(cfg.DB.UserShards))
+		stores  = make([]UserStore, len(cfg.DB.UserShards))
+		closers []func()
+	)
+
+	closeAll := func() {
+		for _, fn := range closers {
+			fn()
+		}
+	}
+
+	for i := range cfg.DB.UserShards {
+		sc := &cfg.DB.UserShards[i]
+
+		us, closeFn, err := openUserDB(cfg, &sc.dbConfig, "user-db-"+sc.Name)
+		if err != nil {
+			closeAll()
+
+			return nil, nil, err
+		}
+
+		names[i], stores[i] = sc.Name, us
+		closers = append(closers, closeFn)
+	}
+
+	slog.Info("using sharded user store", "shards", names, "sharding", cfg.DB.Sharding)
+
+	return NewShardedUserStore(newShardMap(cfg.DB.Sharding, names), stores), closeAll, nil
+}
+
+// openUserDB opens UserStore over single database, returned function releases its resources.
+func openUserDB(cfg *config, dbc *dbConfig, name string) (UserStore, func(), error) {
+	backend := backendOf(dbc.DSN)
+
+	opts := userStoreOptions{
+		Codec:  codecByName(cfg.DB.Codec),
+		Outbox: cfg.Outbox.Broker != "",
+	}
+
+	if backend == backendMemory {
+		slog.Warn("using in-memory user store, all changes will be lost on exit", "db", name)
+
+		return NewMemoryUserStore(opts), func() {}, nil
+	}
+
+	db, closeFn, err := openDB(cfg, dbc, backend, name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err = prepareSchema(context.Background(), db, dbc, backend, schemaUsers); err != nil {
+		closeFn()
+
+		return nil, nil, fmt.Errorf("%s schema: %w", name, err)
+	}
+
+	if backend == backendSQLite {
+		return NewSQLiteUserStore(db, opts), closeFn, nil
+	}
+
+	rdb, closeFn, err := withReplicas(db, closeFn, dbc, backend, name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if backend == backendPostgres {
+		return NewPgUserStore(rdb, opts), closeFn, nil
+	}
+
+	return NewUserStore(rdb, opts), closeFn, nil
+}
+
+// openSettingStore opens SettingStore for configured backend, returned function releases its resources.
+func openSettingStore(cfg *config) (SettingStore, func(), error) {
+	backend := backendOf(cfg.DB.Settings.DSN)
+
+	if backend == backendMemory {
+		slog.Warn("using in-memory setting store, filled with demo catalog")
+
+		return NewMemorySettingStore(demoCatalog()), func() {}, nil
+	}
+
+	db, closeFn, err := openDB(cfg, &cfg.DB.Settings, backend, "setting-db")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err = prepareSchema(context.Background(), db, &cfg.DB.Settings, backend, schemaSettings); err != nil {
+		closeFn()
+
+		return nil, nil, fmt.Errorf("setting-db schema: %w", err)
+	}
+
+	if backend == backendSQLite {
+		return NewSQLiteSettingStore(db), closeFn, nil
+	}
+
+	rdb, closeFn, err := withReplicas(db, closeFn, &cfg.DB.Settings, backend, "setting-db")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if backend == backendPostgres {
+		return NewPgSettingStore(rdb), closeFn, nil
+	}
+
+	return NewSettingStore(rdb), closeFn, nil
+}
+
+// withReplicas wraps primary database with replica routing, if any replicas configured,
+// returned function releases both primary and replicas.
+func withReplicas(primary *sql.DB, closeFn func(), dbc *dbConfig, backend, name string) (sqlDB, func(), error) {
+	if len(dbc.Replicas) == 0 {
+		return primary, closeFn, nil
+	}
+
+	rdb, rClose, err := openReplicas(primary, dbc, backend, name)
+	if err != nil {
+		closeFn()
+
+		return nil, nil, err
+	}
+
+	return rdb, func() {
+		rClose()
+		closeFn()
+	}, nil
+}
+
+// prepareSchema applies pending migrations (if configured to, always - for embedded SQLite,
+// which has no one else to create its schema), then ensures database schema version is
+// the one this build expects.
+func prepareSchema(ctx context.Context, db *sql.DB, dbc *dbConfig, backend, schema string) error {
+	m, err := newMigrator(db, backend, schema)
+	if err != nil {
+		return err
+	}
+
+	if dbc.AutoMigrate || backend == backendSQLite {
+		if err = m.Up(ctx, m.Latest()); err != nil {
+			return err
+		}
+	}
+
+	return m.Check(ctx)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	serviceName = "properties-svc"
+	attrStmt    = "db.statement.name"
+	attrUserID  = "app.user_id"
+)
+
+// tracer is used for all spans, it follows globally registered provider,
+// which is a no-op unless tracing is configured.
+var tracer = otel.Tracer("github.com/s0rg/properties-svc")
+
+// setupTracing registers global tracer provider, exporting spans via OTLP/HTTP,
+// returned function flushes and stops exporter. Empty endpoint keeps no-op tracing.
+func setupTracing(ctx context.Context, cfg *tracingConfig) (shutdown func(context.Context) error, err error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	if cfg.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.Endpoint)}
+
+	if cfg.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+
+	exp, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(serviceName))),
+	)
+
+	otel.SetTracerProvider(tp)
+
+	return tp.Shutdown, nil
+}
+
+// startSpan starts new span, as child of one found in `ctx` (if any).
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records `err` (if any) and ends span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+// userAttr returns span attribute for user id.
+func userAttr(userID int) attribute.KeyValue {
+	return attribute.Int(attrUserID, userID)
+}
+
+// stmtSpan starts span for single sql statement.
+func stmtSpan(ctx context.Context, name, stmt string) (context.Context, trace.Span) {
+	return startSpan(ctx, name, attribute.String(attrStmt, stmt))
+}
+
+// tracedUserStore wraps UserStore, adding span for every call.
+type tracedUserStore struct {
+	next UserStore
+}
+
+func traceUserStore(us UserStore) UserStore {
+	return &tracedUserStore{next: us}
+}
+
+func (t *tracedUserStore) Get(ctx context.Context, userID int, when time.Time) (s UserSettings, err error) {
+	ctx, span := stmtSpan(ctx, "UserStore.Get", "user_settings.select_actual")
+	defer func() { endSpan(span, err) }()
+
+	return t.next.Get(ctx, userID, when)
+}
+
+func (t *tracedUserStore) GetMany(ctx context.Context, userIDs []int, when time.Time) (rv map[int]UserSettings, err error) {
+	ctx, span := stmtSpan(ctx, "UserStore.GetMany", "user_settings.select_actual_many")
+	defer func() { endSpan(span, err) }()
+
+	span.SetAttributes(attribute.Int("users.count", len(userIDs)))
+
+	return t.next.GetMany(ctx, userIDs, when)
+}
+
+func (t *tracedUserStore) Set(ctx context.Context, userID int, s UserSettings, ch Change) (err error) {
+	ctx, span := stmtSpan(ctx, "UserStore.Set", "user_settings.insert")
+	defer func() { endSpan(span, err) }()
+
+	return t.next.Set(ctx, userID, s, ch)
+}
+
+func (t *tracedUserStore) Scheduled(ctx context.Context, userID int, after time.Time) (rv []ScheduledChange, err error) {
+	ctx, span := stmtSpan(ctx, "UserStore.Scheduled", "user_settings.select_scheduled")
+	defer func() { endSpan(span, err) }()
+
+	return t.next.Scheduled(ctx, userID, after)
+}
+
+func (t *tracedUserStore) Cancel(ctx context.Context, userID int, ids []int, ch Change) (n int, err error) {
+	ctx, span := stmtSpan(ctx, "UserStore.Cancel", "user_settings.cancel_scheduled")
+	defer func() { endSpan(span, err) }()
+
+	return t.next.Cancel(ctx, userID, ids, ch)
+}
+
+func (t *tracedUserStore) Audit(ctx context.Context, f AuditFilter) (rv []AuditRecord, err error) {
+	ctx, span := stmtSpan(ctx, "UserStore.Audit", "user_settings_audit.select")
+	defer func() { endSpan(span, err) }()
+
+	return t.next.Audit(ctx, f)
+}
+
+func (t *tracedUserStore) Compact(ctx context.Context, cutoff time.Time) (st CompactStats, err error) {
+	ctx, span := stmtSpan(ctx, "UserStore.Compact", "user_settings.compact")
+	defer func() { endSpan(span, err) }()
+
+	return t.next.Compact(ctx, cutoff)
+}
+
+// tracedSettingStore wraps SettingStore, adding span for every call.
+type tracedSettingStore struct {
+	next SettingStore
+}
+
+func traceSettingStore(ss SettingStore) SettingStore {
+	return &tracedSettingStore{next: ss}
+}
+
+func (t *tracedSettingStore) Get(ctx context.Context, period time.Time, bundles []int) (rv []Setting, err error) {
+	ctx, span := stmtSpan(ctx, "SettingStore.Get", "settings_values.select_by_bundles")
+	defer func() { endSpan(span, err) }()
+
+	return t.next.Get(ctx, period, bundles)
+}
+
+func (t *tracedSettingStore) TagsList(ctx context.Context) (rv []string, err error) {
+	ctx, span := stmtSpan(ctx, "SettingStore.TagsList", "bundles.select_tags")
+	defer func() { endSpan(span, err) }()
+
+	return t.next.TagsList(ctx)
+}
+
+func (t *tracedSettingStore) SettingsList(ctx context.Context) (rv []string, err error) {
+	ctx, span := stmtSpan(ctx, "SettingStore.SettingsList", "settings.select_names")
+	defer func() { endSpan(span, err) }()
+
+	return t.next.SettingsList(ctx)
+}
+
+func (t *tracedSettingStore) BundlesList(ctx context.Context) (rv []Bundle, err error) {
+	ctx, span := stmtSpan(ctx, "SettingStore.BundlesList", "bundles.select_all")
+	defer func() { endSpan(span, err) }()
+
+	return t.next.BundlesList(ctx)
+}
+
+func (t *tracedSettingStore) BundlesByID(ctx context.Context, bundles []int) (rv []Bundle, err error) {
+	ctx, span := stmtSpan(ctx, "SettingStore.BundlesByID", "bundles.select_by_id")
+	defer func() { endSpan(span, err) }()
+
+	return t.next.BundlesByID(ctx, bundles)
+}
+
+func (t *tracedSettingStore) BundlesByTag(ctx context.Context, tag string) (rv []Bundle, err error) {
+	ctx, span := stmtSpan(ctx, "SettingStore.BundlesByTag", "bundles.select_by_tag")
+	defer func() { endSpan(span, err) }()
+
+	return t.next.BundlesByTag(ctx, tag)
+}
+
+func (t *tracedSettingStore) BundlesByName(ctx context.Context, names []string) (rv []Bundle, err error) {
+	ctx, span := stmtSpan(ctx, "SettingStore.BundlesByName", "bundles.select_by_name")
+	defer func() { endSpan(span, err) }()
+
+	return t.next.BundlesByName(ctx, names)
+}
+
+func (t *tracedSettingStore) BundleValues(ctx context.Context, when time.Time, bundles []int) (rv map[int][]Setting, err error) {
+	ctx, span := stmtSpan(ctx, "SettingStore.BundleValues", "settings_values.select_by_bundle")
+	defer func() { endSpan(span, err) }()
+
+	return t.next.BundleValues(ctx, when, bundles)
+}
+
+func (t *tracedSettingStore) Digest(ctx context.Context, when time.Time) (rv string, err error) {
+	ctx, span := stmtSpan(ctx, "SettingStore.Digest", "catalog.digest")
+	defer func() { endSpan(span, err) }()
+
+	return t.next.Digest(ctx, when)
+}
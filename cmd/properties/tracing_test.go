@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+type stubUserStore struct {
+	UserStore
+	err error
+}
+
+func (s *stubUserStore) Get(context.Context, int, time.Time) (UserSettings, error) {
+	return UserSettings{Bundles: []int{1}}, nil
+}
+
+func (s *stubUserStore) Set(context.Context, int, UserSettings, Change) error { return s.err }
+
+type stubSettingStore struct{ SettingStore }
+
+func (stubSettingStore) BundlesByID(context.Context, []int) ([]Bundle, error) {
+	return []Bundle{{ID: 1}}, nil
+}
+
+func (stubSettingStore) BundlesByTag(context.Context, string) ([]Bundle, error) {
+	return []Bundle{{ID: 2, ParentID: 1}}, nil
+}
+
+func (stubSettingStore) BundlesList(context.Context) ([]Bundle, error) {
+	return []Bundle{{ID: 1}, {ID: 2, ParentID: 1}}, nil
+}
+
+func TestTracingSpans(t *testing.T) {
+	exp := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+
+	old := tracer
+	tracer = tp.Tracer("test")
+
+	defer func() { tracer = old }()
+
+	us := &stubUserStore{err: errors.New("boom")}
+	h := handler{user: traceUserStore(us), setting: traceSettingStore(stubSettingStore{})}
+
+	if err := h.SetTag(context.Background(), 1, "mid", nil, modeMerge, Change{}); err == nil {
+		t.Fatal("step 1 fail: no error")
+	}
+
+	spans := exp.GetSpans()
+
+	want := []string{
+		"UserStore.Get",
+		"SettingStore.BundlesByID",
+		"SettingStore.BundlesByTag",
+		"SettingStore.BundlesList",
+		"UserStore.Set",
+		"handler.SetTag",
+	}
+
+	if len(spans) != len(want) {
+		t.Fatalf("step 2 fail: got %d spans", len(spans))
+	}
+
+	root := spans[len(spans)-1].SpanContext.SpanID()
+
+	for i, s := range spans {
+		if s.Name != want[i] {
+			t.Fatalf("step 3 fail: span %d is '%s'", i, s.Name)
+		}
+
+		if i < len(want)-1 && s.Parent.SpanID() != root {
+			t.Fatalf("step 4 fail: span '%s' is not a child of handler", s.Name)
+		}
+	}
+
+	if spans[4].Status.Code != codes.Error || spans[5].Status.Code != codes.Error {
+		t.Fatal("step 5 fail: error not recorded")
+	}
+}
@@ -1,7 +1,7 @@
 USE `settingsdb`;
 
 
-INSERT INTO `settings`
+INSERT IGNORE INTO `settings`
     (`id`, `name`, `notify`)
 VALUES
     (1, 'profit', 1),
@@ -11,7 +11,7 @@ VALUES
     (5, 'extra-access', 0);
 
 
-INSERT INTO `settings_values`
+INSERT IGNORE INTO `settings_values`
     (`id`, `setting_id`, `name`, `value`)
 VALUES
     ( 1, 1, 'profit-low', '85'),
@@ -32,7 +32,7 @@ VALUES
     (16, 5, 'access-sen', 'courses;consultant');
 
 
-INSERT INTO `bundles`
+INSERT IGNORE INTO `bundles`
     (`id`, `tag`, `name`, `parent_id`)
 VALUES
     ( 1, 'jun', 'profit-jun',  0),
@@ -50,7 +50,7 @@ VALUES
     (13, 'sen',  'extra-sen', 12);
 
 
-INSERT INTO `bundles_values`
+INSERT IGNORE INTO `bundles_values`
     (`bundle_id`, `value_id`)
 VALUES
     ( 1,  1),